@@ -0,0 +1,156 @@
+// Package accesslog aggregates per-service traffic metrics from the stream
+// access log of LBEX generated NGINX configuration.  NGINX sends the log to
+// LBEX as syslog messages over a unix datagram socket, so nothing is written to
+// disk.
+package accesslog
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path"
+	"sync"
+
+	"github.com/golang/glog"
+	"github.com/sostheim/lbex/metrics"
+)
+
+// DefaultSocket - the unix datagram socket the collector receives the log on
+const DefaultSocket = "/var/run/lbex/stream-log.sock"
+
+// maxMessageSize - NGINX limits syslog messages to 4KiB
+const maxMessageSize = 4096
+
+var (
+	sessions = metrics.NewCounterVec("lbex_stream_sessions_total",
+		"Total number of completed stream sessions, by session status.", "service", "port", "protocol", "status")
+	receivedBytes = metrics.NewCounterVec("lbex_stream_received_bytes_total",
+		"Total bytes received from clients.", "service", "port")
+	sentBytes = metrics.NewCounterVec("lbex_stream_sent_bytes_total",
+		"Total bytes sent to clients.", "service", "port")
+	sessionDuration = metrics.NewSummaryVec("lbex_stream_session_duration_seconds",
+		"Duration of completed stream sessions.", "service", "port")
+	upstreamSessions = metrics.NewCounterVec("lbex_stream_upstream_sessions_total",
+		"Total number of stream sessions connected to the upstream.", "service", "port", "upstream")
+	upstreamConnectFailures = metrics.NewCounterVec("lbex_stream_upstream_connect_failures_total",
+		"Total number of failed attempts to connect to the upstream.", "service", "port", "upstream")
+	upstreamSentBytes = metrics.NewCounterVec("lbex_stream_upstream_sent_bytes_total",
+		"Total bytes sent to the upstream.", "service", "port", "upstream")
+	upstreamReceivedBytes = metrics.NewCounterVec("lbex_stream_upstream_received_bytes_total",
+		"Total bytes received from the upstream.", "service", "port", "upstream")
+	logErrors = metrics.NewCounterVec("lbex_stream_log_errors_total",
+		"Total number of stream access log messages that could not be parsed.")
+)
+
+// RegisterMetrics registers the traffic metric families with the registry
+func RegisterMetrics(r *metrics.Registry) {
+	r.MustRegister(sessions, receivedBytes, sentBytes, sessionDuration, upstreamSessions,
+		upstreamConnectFailures, upstreamSentBytes, upstreamReceivedBytes, logErrors)
+}
+
+// Collector receives the stream access log, and records each entry in the
+// traffic metrics
+type Collector struct {
+	socket string
+	conn   *net.UnixConn
+	lock   sync.Mutex
+}
+
+// NewCollector creates a collector that listens on socket
+func NewCollector(socket string) *Collector {
+	return &Collector{socket: socket}
+}
+
+// Destination returns the NGINX access_log destination of the collector
+func (c *Collector) Destination() string {
+	return "syslog:server=unix:" + c.socket + ",nohostname,tag=lbex"
+}
+
+// Start listens on the collector's socket, and receives the log in the
+// background
+func (c *Collector) Start() error {
+	if err := os.MkdirAll(path.Dir(c.socket), 0755); err != nil {
+		return fmt.Errorf("failed to create stream log socket directory: %v", err)
+	}
+	// a socket left behind by a previous run
+	if err := os.Remove(c.socket); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove stream log socket: %v", err)
+	}
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: c.socket, Net: "unixgram"})
+	if err != nil {
+		return fmt.Errorf("failed to listen for the stream log: %v", err)
+	}
+	// NGINX's workers may not run as the same user as LBEX
+	if err := os.Chmod(c.socket, 0666); err != nil {
+		conn.Close()
+		return fmt.Errorf("failed to set stream log socket permissions: %v", err)
+	}
+
+	c.lock.Lock()
+	c.conn = conn
+	c.lock.Unlock()
+	glog.V(2).Infof("receiving the stream access log on: %s", c.socket)
+	go c.receive(conn)
+	return nil
+}
+
+// Close stops receiving the log
+func (c *Collector) Close() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.conn != nil {
+		c.conn.Close()
+		c.conn = nil
+		os.Remove(c.socket)
+	}
+}
+
+func (c *Collector) receive(conn *net.UnixConn) {
+	buf := make([]byte, maxMessageSize)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			c.lock.Lock()
+			closed := c.conn != conn
+			c.lock.Unlock()
+			if !closed {
+				glog.Errorf("stream log receive failed: %v", err)
+			}
+			return
+		}
+		entry, err := Parse(string(buf[:n]))
+		if err != nil {
+			glog.V(3).Infof("%v", err)
+			logErrors.With().Inc()
+			continue
+		}
+		Record(entry)
+	}
+}
+
+// Record adds the entry to the traffic metrics
+func Record(entry *Entry) {
+	sessions.With(entry.Service, entry.Port, entry.Protocol, entry.Status).Inc()
+	receivedBytes.With(entry.Service, entry.Port).Add(entry.BytesReceived)
+	sentBytes.With(entry.Service, entry.Port).Add(entry.BytesSent)
+	sessionDuration.With(entry.Service, entry.Port).Observe(entry.SessionTime)
+
+	for _, attempt := range entry.Upstreams {
+		if !attempt.Connected {
+			upstreamConnectFailures.With(entry.Service, entry.Port, attempt.Address).Inc()
+			continue
+		}
+		upstreamSessions.With(entry.Service, entry.Port, attempt.Address).Inc()
+		upstreamSentBytes.With(entry.Service, entry.Port, attempt.Address).Add(attempt.BytesSent)
+		upstreamReceivedBytes.With(entry.Service, entry.Port, attempt.Address).Add(attempt.BytesReceived)
+	}
+}
+
+// Forget removes the service's traffic metrics, e.g. once it is deleted
+func (c *Collector) Forget(service string) {
+	for _, vec := range []*metrics.CounterVec{sessions, receivedBytes, sentBytes, upstreamSessions,
+		upstreamConnectFailures, upstreamSentBytes, upstreamReceivedBytes} {
+		vec.DeleteMatching("service", service)
+	}
+	sessionDuration.DeleteMatching("service", service)
+}
@@ -0,0 +1,122 @@
+package accesslog
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// Marker - the first field of every LBEX stream access log entry
+const Marker = "lbex"
+
+// Format - the fields of an LBEX stream access log entry, in order, following
+// the marker and the service's namespace/name and port name.  The upstream
+// variables are lists, with one element per upstream attempted.
+// http://nginx.org/en/docs/stream/ngx_stream_core_module.html#variables
+// http://nginx.org/en/docs/stream/ngx_stream_upstream_module.html#variables
+const Format = "$protocol|$status|$session_time|$bytes_received|$bytes_sent|" +
+	"$upstream_addr|$upstream_connect_time|$upstream_bytes_sent|$upstream_bytes_received"
+
+// the number of '|' separated fields in an entry, including the marker,
+// service and port
+const numFields = 12
+
+// Entry is a single, completed, stream session
+type Entry struct {
+	Service       string
+	Port          string
+	Protocol      string
+	Status        string
+	SessionTime   float64
+	BytesReceived float64
+	BytesSent     float64
+	Upstreams     []Attempt
+}
+
+// Attempt is a single upstream connection attempt of a session
+type Attempt struct {
+	Address       string
+	Connected     bool
+	BytesSent     float64
+	BytesReceived float64
+}
+
+// Parse parses an entry from a syslog message, or the bare log line
+func Parse(msg string) (*Entry, error) {
+	start := strings.Index(msg, Marker+"|")
+	if start < 0 {
+		return nil, fmt.Errorf("not an lbex stream log entry: %q", msg)
+	}
+	fields := strings.Split(strings.TrimRight(msg[start:], "\r\n"), "|")
+	if len(fields) != numFields {
+		return nil, fmt.Errorf("expected %d fields, found %d: %q", numFields, len(fields), msg)
+	}
+
+	entry := &Entry{
+		Service:       fields[1],
+		Port:          fields[2],
+		Protocol:      fields[3],
+		Status:        fields[4],
+		SessionTime:   parseNumber(fields[5]),
+		BytesReceived: parseNumber(fields[6]),
+		BytesSent:     parseNumber(fields[7]),
+	}
+
+	addrs := splitList(fields[8])
+	connectTimes := splitList(fields[9])
+	sent := splitList(fields[10])
+	received := splitList(fields[11])
+	for i, addr := range addrs {
+		attempt := Attempt{
+			Address:       addr,
+			Connected:     listElem(connectTimes, i) != "-",
+			BytesSent:     parseNumber(listElem(sent, i)),
+			BytesReceived: parseNumber(listElem(received, i)),
+		}
+		// NGINX moves on to the next upstream only when connecting fails, and
+		// reports a bad gateway when the last upstream can't be connected to
+		if i < len(addrs)-1 || entry.Status == "502" {
+			attempt.Connected = false
+		}
+		entry.Upstreams = append(entry.Upstreams, attempt)
+	}
+	return entry, nil
+}
+
+// splitList splits an NGINX upstream variable list, "-" and "" are empty
+func splitList(value string) []string {
+	if value == "" || value == "-" {
+		return nil
+	}
+	list := strings.Split(value, ",")
+	for i := range list {
+		list[i] = strings.TrimSpace(list[i])
+	}
+	return list
+}
+
+func listElem(list []string, i int) string {
+	if i < len(list) {
+		return list[i]
+	}
+	return "-"
+}
+
+// parseNumber returns 0 for the NGINX empty value "-"
+func parseNumber(value string) float64 {
+	n, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return 0
+	}
+	return n
+}
+
+func (e Entry) String() string {
+	j, err := json.Marshal(e)
+	if err != nil {
+		return string("cant't marshal: " + reflect.TypeOf(e).String() + ", to json string, err: " + err.Error())
+	}
+	return string(j)
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/golang/glog"
+	"github.com/sostheim/lbex/bgp"
+	"github.com/sostheim/lbex/nginx"
+)
+
+// adminNode - a known node, its' state, and the services it is an upstream of
+type adminNode struct {
+	nginx.Node
+	// Upstream - whether or not the backend has the node as an upstream
+	// candidate
+	Upstream bool
+	Services []string
+}
+
+type adminNodeByName []adminNode
+
+func (n adminNodeByName) Len() int {
+	return len(n)
+}
+func (n adminNodeByName) Swap(i, j int) {
+	n[i], n[j] = n[j], n[i]
+}
+func (n adminNodeByName) Less(i, j int) bool {
+	return n[i].Name < n[j].Name
+}
+
+// adminService - a managed service's spec, and the state derived from it
+type adminService struct {
+	Key       string
+	Spec      *nginx.ServiceSpec
+	Targets   []nginx.Target
+	Nodes     []string
+	Summary   nginx.ServiceSummary
+	Error     string `json:",omitempty"`
+	Selection serviceSelection
+}
+
+// serveAdmin serves the read-only admin API.  When token is not empty every
+// request must present it as a bearer token.
+func serveAdmin(port int, token string, lbex *lbExController) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/nodes", lbex.adminNodes)
+	mux.HandleFunc("/services", lbex.adminServices)
+	mux.HandleFunc("/services/", lbex.adminService)
+	mux.HandleFunc("/selection/", lbex.adminSelection)
+	mux.HandleFunc("/queues", lbex.adminQueues)
+	mux.HandleFunc("/vips", lbex.adminVIPs)
+	mux.HandleFunc("/bgp", lbex.adminBGP)
+
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed, the admin API is read-only", http.StatusMethodNotAllowed)
+			return
+		}
+		if token != "" {
+			presented := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if subtle.ConstantTimeCompare([]byte(presented), []byte(token)) != 1 {
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+				return
+			}
+		}
+		mux.ServeHTTP(w, r)
+	}
+	glog.Errorf("admin API server exited: %v", http.ListenAndServe(":"+strconv.Itoa(port), http.HandlerFunc(handler)))
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	j, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(append(j, '\n'))
+}
+
+// adminNodes lists every node known to the informer, ordered by name
+func (lbex *lbExController) adminNodes(w http.ResponseWriter, r *http.Request) {
+	state := lbex.lb.State()
+	nodes := []adminNode{}
+	for _, obj := range lbex.nodesStore.List() {
+		if ValidateNodeObjectType(obj) != nil {
+			continue
+		}
+		name, _ := GetNodeName(obj)
+		node, _ := newNode(name, obj)
+		_, upstream := state.Node(name)
+		nodes = append(nodes, adminNode{
+			Node:     node,
+			Upstream: upstream,
+			Services: state.ServicesForNode(name),
+		})
+	}
+	sort.Sort(adminNodeByName(nodes))
+	writeJSON(w, nodes)
+}
+
+// adminServices lists every managed service, ordered by key
+func (lbex *lbExController) adminServices(w http.ResponseWriter, r *http.Request) {
+	lbex.specLock.RLock()
+	keys := make([]string, 0, len(lbex.serviceSpecs))
+	for key := range lbex.serviceSpecs {
+		keys = append(keys, key)
+	}
+	lbex.specLock.RUnlock()
+	sort.Strings(keys)
+
+	services := []adminService{}
+	for _, key := range keys {
+		if svc, ok := lbex.adminServiceState(key); ok {
+			services = append(services, svc)
+		}
+	}
+	writeJSON(w, services)
+}
+
+// adminService serves /services/<namespace>/<name>, and the service's applied
+// configuration text from /services/<namespace>/<name>/config
+func (lbex *lbExController) adminService(w http.ResponseWriter, r *http.Request) {
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, "/services/"), "/")
+	parts := strings.Split(path, "/")
+	if len(parts) < 2 || len(parts) > 3 || (len(parts) == 3 && parts[2] != "config") {
+		http.NotFound(w, r)
+		return
+	}
+	key := parts[0] + "/" + parts[1]
+
+	svc, ok := lbex.adminServiceState(key)
+	if !ok {
+		http.Error(w, "not a managed service: "+key, http.StatusNotFound)
+		return
+	}
+	if len(parts) == 2 {
+		writeJSON(w, svc)
+		return
+	}
+
+	config, err := lbex.lb.ServiceConfig(key, svc.Spec.ConfigName)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Write([]byte(config))
+}
+
+func (lbex *lbExController) adminServiceState(key string) (adminService, bool) {
+	lbex.specLock.RLock()
+	spec, ok := lbex.serviceSpecs[key]
+	lbex.specLock.RUnlock()
+	if !ok {
+		return adminService{}, false
+	}
+
+	state := lbex.lb.State()
+	svc := adminService{
+		Key:     key,
+		Spec:    spec,
+		Targets: state.ServiceTargets(key),
+		Nodes:   state.ServiceNodes(key),
+		Summary: state.ServiceSummaries()[key],
+	}
+	lbex.errLock.Lock()
+	svc.Error = lbex.serviceErrors[key]
+	lbex.errLock.Unlock()
+	if obj, exists, err := lbex.servicesStore.GetByKey(key); err == nil && exists {
+		svc.Selection = lbex.selectService(obj)
+	}
+	return svc, true
+}
+
+// adminSelection serves /selection/<namespace>/<name>, the selection decision
+// for any service, managed or not
+func (lbex *lbExController) adminSelection(w http.ResponseWriter, r *http.Request) {
+	key := strings.Trim(strings.TrimPrefix(r.URL.Path, "/selection/"), "/")
+	obj, exists, err := lbex.servicesStore.GetByKey(key)
+	if err != nil || !exists {
+		http.Error(w, "no such service: "+key, http.StatusNotFound)
+		return
+	}
+	writeJSON(w, lbex.selectService(obj))
+}
+
+// adminQueues lists the contents of each work queue
+func (lbex *lbExController) adminQueues(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, map[string]QueueContents{
+		"nodes":     lbex.nodesQueue.Contents(),
+		"services":  lbex.servicesQueue.Contents(),
+		"endpoints": lbex.endpointsQueue.Contents(),
+	})
+}
+
+// adminVIP - a LoadBalancer service address allocation
+type adminVIP struct {
+	Address string
+	Pool    string
+	// Announced - whether or not this instance has the address on its'
+	// --l2-interface
+	Announced bool
+}
+
+// adminVIPs lists the load balancer address allocations, by service key,
+// including those of other LBEX instances that share the ConfigMap
+func (lbex *lbExController) adminVIPs(w http.ResponseWriter, r *http.Request) {
+	vips := map[string]adminVIP{}
+	if lbex.vips == nil {
+		writeJSON(w, vips)
+		return
+	}
+	allocations, err := lbex.vips.Allocations()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	announced := make(map[string]bool)
+	if lbex.announcer != nil {
+		for _, address := range lbex.announcer.Assigned() {
+			announced[address] = true
+		}
+	}
+	for key, address := range allocations {
+		pool, _ := lbex.vips.PoolOf(address)
+		vips[key] = adminVIP{Address: address, Pool: pool, Announced: announced[address]}
+	}
+	writeJSON(w, vips)
+}
+
+// adminBGP lists the state of the session with each BGP peer
+func (lbex *lbExController) adminBGP(w http.ResponseWriter, r *http.Request) {
+	if lbex.speaker == nil {
+		writeJSON(w, []bgp.PeerStatus{})
+		return
+	}
+	writeJSON(w, lbex.speaker.Status())
+}
@@ -0,0 +1,360 @@
+package annotations
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"k8s.io/client-go/pkg/api/v1"
+	"k8s.io/client-go/pkg/labels"
+)
+
+const (
+	// SeverityError - the annotation is ignored, or replaced by a default
+	SeverityError = "error"
+	// SeverityWarning - the annotation has no effect
+	SeverityWarning = "warning"
+
+	// LBEXAnnotationBase - the prefix of every LBEX annotation, except the
+	// port annotations
+	LBEXAnnotationBase = "loadbalancer.lbex/"
+)
+
+// KnownAnnotations - every LBEX annotation key, except the port annotations
+var KnownAnnotations = []string{
+	LBEXIpPassthrough,
+	LBEXAlgorithmKey,
+	LBEXMethodKey,
+	LBEXHostKey,
+	LBEXResolverKey,
+	LBEXUpstreamType,
+	LBEXNodeAddressType,
+	LBEXNodeSet,
+	LBEXNodeSelector,
+	LBEXIPFamily,
+	LBEXDualStack,
+	LBEXPoolKey,
+}
+
+// Requirement - an annotation that only has an effect when the annotation Key
+// has one of Values
+type Requirement struct {
+	Key    string
+	Values []string
+}
+
+// LintOptions - the rules that service annotations are checked against
+type LintOptions struct {
+	// Values - the valid values of each enumerated annotation
+	Values map[string][]string
+	// Defaults - the value used for each enumerated annotation when it is
+	// not present
+	Defaults map[string]string
+	// Requires - annotations that only have an effect in combination with
+	// another annotation's value
+	Requires map[string]Requirement
+	// Lists - enumerated annotations whose value is a comma separated list
+	// of their' values
+	Lists map[string]bool
+	// UnnamedPort - the port annotation name suffix for a service's single
+	// unnamed port
+	UnnamedPort string
+	// RequirePort - every service port must have a port annotation
+	RequirePort bool
+	// ServiceAddresses - LoadBalancer services are allocated a load balancer
+	// address of their' own, which is of a single IP family
+	ServiceAddresses bool
+}
+
+// Finding is a single problem found with a service's annotations
+type Finding struct {
+	Severity string `json:"severity"`
+	Key      string `json:"key"`
+	Value    string `json:"value,omitempty"`
+	Message  string `json:"message"`
+	// Default - the value used in place of an invalid value
+	Default string `json:"default,omitempty"`
+}
+
+func (f Finding) String() string {
+	j, err := json.Marshal(f)
+	if err != nil {
+		return string("cant't marshal: " + reflect.TypeOf(f).String() + ", to json string, err: " + err.Error())
+	}
+	return string(j)
+}
+
+// IsLBEXKey returns true for any annotation key that looks like it is
+// intended for LBEX, including misspellings of the LBEX prefixes
+func IsLBEXKey(key string) bool {
+	return key != LBEXClassKey && strings.Contains(strings.ToLower(key), "lbex")
+}
+
+// Lint checks the service's annotations, returning the findings ordered by
+// key.  It reports unknown LBEX keys, invalid values, missing, invalid and
+// conflicting port annotations, and annotations that have no effect in
+// combination with the others.
+func Lint(service *v1.Service, opts LintOptions) []Finding {
+	findings := []Finding{}
+	add := func(severity, key, value, format string, args ...interface{}) {
+		findings = append(findings, Finding{Severity: severity, Key: key, Value: value, Message: fmt.Sprintf(format, args...)})
+	}
+	as := service.GetAnnotations()
+
+	lbexKeys := false
+	for key := range as {
+		if IsLBEXKey(key) {
+			lbexKeys = true
+			break
+		}
+	}
+	if as[LBEXClassKey] != LBEXClassKeyValue {
+		if lbexKeys {
+			add(SeverityWarning, LBEXClassKey, as[LBEXClassKey],
+				"LBEX annotations are present, but LBEX only manages services annotated with %s: %s", LBEXClassKey, LBEXClassKeyValue)
+		}
+	}
+
+	known := make(map[string]bool)
+	for _, key := range KnownAnnotations {
+		known[key] = true
+	}
+
+	// port annotations, by service port name
+	portNames := make(map[string]bool)
+	for _, port := range service.Spec.Ports {
+		name := port.Name
+		if name == "" {
+			name = opts.UnnamedPort
+		}
+		portNames[name] = true
+	}
+
+	for key, value := range as {
+		if !IsLBEXKey(key) {
+			continue
+		}
+		switch {
+		case strings.HasPrefix(key, LBEXPortAnnotationBase):
+			name := strings.TrimPrefix(key, LBEXPortAnnotationBase)
+			if !portNames[name] {
+				add(SeverityError, key, value, "no service port is named %q", name)
+			}
+		case known[key]:
+		default:
+			msg := "unknown LBEX annotation"
+			if suggestion := closest(key, append(portKeys(portNames), KnownAnnotations...)); suggestion != "" {
+				msg += ", did you mean " + suggestion + "?"
+			}
+			add(SeverityError, key, value, "%s", msg)
+		}
+	}
+
+	// port annotation values, and listen port conflicts
+	listeners := make(map[string]string)
+	for _, port := range service.Spec.Ports {
+		name := port.Name
+		if name == "" {
+			name = opts.UnnamedPort
+		}
+		key := LBEXPortAnnotationBase + name
+		value, ok := as[key]
+		if !ok {
+			if opts.RequirePort {
+				add(SeverityError, key, "", "missing port annotation for service port %q", name)
+			}
+			continue
+		}
+		listen, err := strconv.Atoi(value)
+		if err != nil {
+			add(SeverityError, key, value, "port is not an integer")
+			continue
+		}
+		if listen <= 0 || listen > 65535 {
+			add(SeverityError, key, value, "port is out of range (1-65535)")
+			continue
+		}
+		protocol := string(port.Protocol)
+		if protocol == "" {
+			protocol = string(v1.ProtocolTCP)
+		}
+		listener := value + "/" + protocol
+		if other, ok := listeners[listener]; ok {
+			add(SeverityError, key, value, "listen port %s conflicts with %s", listener, other)
+			continue
+		}
+		listeners[listener] = key
+	}
+
+	for _, key := range []string{LBEXIpPassthrough, LBEXDualStack} {
+		if value, ok := as[key]; ok {
+			if _, err := strconv.ParseBool(value); err != nil {
+				add(SeverityError, key, value, "not a boolean value")
+			}
+		}
+	}
+
+	findings = append(findings, InvalidValues(service, opts)...)
+
+	// combinations
+	for key, requirement := range opts.Requires {
+		value, ok := as[key]
+		if !ok {
+			continue
+		}
+		actual, ok := as[requirement.Key]
+		if !ok || !contains(opts.Values[requirement.Key], actual) {
+			actual = opts.Defaults[requirement.Key]
+		}
+		if !contains(requirement.Values, actual) {
+			add(SeverityWarning, key, value, "has no effect unless %s is %s, it is: %s",
+				requirement.Key, strings.Join(requirement.Values, " or "), actual)
+		}
+	}
+
+	sort.Sort(findingByKey(findings))
+	return findings
+}
+
+// InvalidValues returns a finding for each enumerated annotation of the
+// service that does not have one of its' valid values, for an invalid node
+// selector, and for dual stack listeners on a load balancer address, ordered
+// by key
+func InvalidValues(service *v1.Service, opts LintOptions) []Finding {
+	findings := []Finding{}
+	as := service.GetAnnotations()
+	for key, values := range opts.Values {
+		value, ok := as[key]
+		if !ok {
+			continue
+		}
+		if opts.Lists[key] {
+			if !containsAll(values, value) {
+				findings = append(findings, Finding{
+					Severity: SeverityError,
+					Key:      key,
+					Value:    value,
+					Message:  "invalid value, must be a comma separated list of: " + strings.Join(values, ", "),
+					Default:  opts.Defaults[key],
+				})
+			}
+		} else if !contains(values, value) {
+			findings = append(findings, Finding{
+				Severity: SeverityError,
+				Key:      key,
+				Value:    value,
+				Message:  "invalid value, must be one of: " + strings.Join(values, ", "),
+				Default:  opts.Defaults[key],
+			})
+		}
+	}
+	if value, ok := as[LBEXNodeSelector]; ok {
+		if _, err := labels.Parse(value); err != nil {
+			findings = append(findings, Finding{
+				Severity: SeverityError,
+				Key:      LBEXNodeSelector,
+				Value:    value,
+				Message:  "invalid label selector: " + err.Error(),
+				Default:  opts.Defaults[LBEXNodeSelector],
+			})
+		}
+	}
+	if value, ok := as[LBEXDualStack]; ok && opts.ServiceAddresses && service.Spec.Type == v1.ServiceTypeLoadBalancer {
+		if dualStack, _ := strconv.ParseBool(value); dualStack {
+			findings = append(findings, Finding{
+				Severity: SeverityError,
+				Key:      LBEXDualStack,
+				Value:    value,
+				Message:  "dual stack listeners are not supported on a load balancer address, which is of a single IP family",
+				Default:  "false",
+			})
+		}
+	}
+	sort.Sort(findingByKey(findings))
+	return findings
+}
+
+func portKeys(portNames map[string]bool) []string {
+	keys := []string{}
+	for name := range portNames {
+		keys = append(keys, LBEXPortAnnotationBase+name)
+	}
+	return keys
+}
+
+func contains(list []string, value string) bool {
+	for _, current := range list {
+		if current == value {
+			return true
+		}
+	}
+	return false
+}
+
+// containsAll returns true if every element of the comma separated list is
+// in list
+func containsAll(list []string, values string) bool {
+	for _, value := range strings.Split(values, ",") {
+		if !contains(list, strings.TrimSpace(value)) {
+			return false
+		}
+	}
+	return true
+}
+
+// closest returns the candidate nearest to key, if it is within two edits
+// and so a likely misspelling
+func closest(key string, candidates []string) string {
+	best, bestDistance := "", 3
+	for _, candidate := range candidates {
+		if d := distance(key, candidate); d < bestDistance {
+			best, bestDistance = candidate, d
+		}
+	}
+	return best
+}
+
+// distance returns the Levenshtein edit distance between a and b
+func distance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	curr := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		curr[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			curr[j] = prev[j-1] + cost
+			if prev[j]+1 < curr[j] {
+				curr[j] = prev[j] + 1
+			}
+			if curr[j-1]+1 < curr[j] {
+				curr[j] = curr[j-1] + 1
+			}
+		}
+		prev, curr = curr, prev
+	}
+	return prev[len(b)]
+}
+
+type findingByKey []Finding
+
+func (f findingByKey) Len() int {
+	return len(f)
+}
+func (f findingByKey) Swap(i, j int) {
+	f[i], f[j] = f[j], f[i]
+}
+func (f findingByKey) Less(i, j int) bool {
+	if f[i].Key != f[j].Key {
+		return f[i].Key < f[j].Key
+	}
+	return f[i].Message < f[j].Message
+}
@@ -59,6 +59,15 @@ const (
 	// LBEXNodeSet - set of nodes to load balance across
 	LBEXNodeSet = "loadbalancer.lbex/node-set"
 
+	// LBEXNodeSelector - label selector of the nodes to load balance across
+	LBEXNodeSelector = "loadbalancer.lbex/node-selector"
+
+	// LBEXIPFamily - IP family of the node addresses
+	LBEXIPFamily = "loadbalancer.lbex/ip-family"
+
+	// LBEXDualStack - listen on both IPv4 and IPv6 addresses
+	LBEXDualStack = "loadbalancer.lbex/dual-stack"
+
 	// LBEXPoolKey - service affinity pool key
 	LBEXPoolKey = "loadbalancer.lbex/service-pool"
 )
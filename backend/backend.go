@@ -0,0 +1,136 @@
+package backend
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/sostheim/lbex/annotations"
+	"github.com/sostheim/lbex/nginx"
+)
+
+// Capabilities describes the features supported by a Backend
+type Capabilities struct {
+	// Algorithms - the subset of nginx.SupportedAlgorithms that may be applied
+	Algorithms []string
+	// UpstreamTypes - the subset of nginx.UpstreamTypes that may be applied
+	UpstreamTypes []string
+	// UDP - UDP services can be load balanced
+	UDP bool
+	// LiveUpdate - upstream changes are applied without a reload
+	LiveUpdate bool
+	// Passthrough - client source addresses can be passed through to upstreams
+	Passthrough bool
+}
+
+// Backend is a load balancer data plane.  The controller drives each backend
+// from the same service model (nginx.ServiceSpec, nginx.Target and nginx.Node),
+// and has no knowledge of how a backend renders or applies that model.
+type Backend interface {
+	// Name returns the name of the backend, e.g. "nginx"
+	Name() string
+	// Capabilities reports the features the backend supports
+	Capabilities() Capabilities
+	// Start starts the data plane
+	Start() error
+	// Run runs any background work for the backend until stopCh is closed.
+	// The backend calls resync when every service needs to be re-applied.
+	Run(resync func(), stopCh <-chan struct{})
+	// State returns the backend's node and service upstream state
+	State() *nginx.State
+
+	// AddOrUpdateNode adds, updates or (if inactive) removes an upstream
+	// candidate node, returning the keys of the services affected.
+	AddOrUpdateNode(node nginx.Node) []string
+	// DeleteNode removes an upstream candidate node, returning the keys of
+	// the services affected.
+	DeleteNode(name string) []string
+
+	// AddOrUpdateService applies the service model and commits it
+	AddOrUpdateService(svc *nginx.ServiceSpec) error
+	// DeleteService removes the service identified by key, and configuration
+	// name, and commits the change
+	DeleteService(key, name string) error
+	// ServiceConfig returns the service's currently applied configuration,
+	// as text
+	ServiceConfig(key, name string) (string, error)
+
+	// Validate checks the backend's complete current configuration
+	Validate() error
+	// Reload commits the current configuration to the running data plane,
+	// unless it is unchanged since the last reload
+	Reload() error
+	// ReloadStats returns the counts of applied, skipped and failed reloads
+	ReloadStats() nginx.ReloadStats
+	// Healthy returns nil if the data plane is running, otherwise the reason
+	// that it is not
+	Healthy() error
+}
+
+// rejected is implemented by errors for configurations that the data plane
+// rejected, such as nginx.InvalidConfigError
+type rejected interface {
+	Rejected() bool
+}
+
+// IsRejected returns true if the error indicates that the data plane rejected
+// a configuration, i.e. retrying the same configuration will not succeed.
+func IsRejected(err error) bool {
+	r, ok := err.(rejected)
+	return ok && r.Rejected()
+}
+
+// Supports returns true if the capability set includes value
+func Supports(set []string, value string) bool {
+	for _, current := range set {
+		if current == value {
+			return true
+		}
+	}
+	return false
+}
+
+// Check returns an error listing each feature of the service that the backend
+// does not support, or nil if the service can be applied as specified.
+func (c Capabilities) Check(svc *nginx.ServiceSpec) error {
+	reasons := []string{}
+	if svc.Algorithm != "" && !Supports(c.Algorithms, svc.Algorithm) {
+		reasons = append(reasons, fmt.Sprintf("algorithm %s is not supported", svc.Algorithm))
+	}
+	if svc.UpstreamType != "" && !Supports(c.UpstreamTypes, svc.UpstreamType) {
+		reasons = append(reasons, fmt.Sprintf("upstream type %s is not supported", svc.UpstreamType))
+	}
+	if !c.UDP {
+		seen := map[int]bool{}
+		ports := []int{}
+		for _, target := range svc.Topology {
+			if strings.EqualFold(target.Protocol, "udp") && !seen[target.ServicePort] {
+				seen[target.ServicePort] = true
+				ports = append(ports, target.ServicePort)
+			}
+		}
+		sort.Ints(ports)
+		for _, port := range ports {
+			reasons = append(reasons, fmt.Sprintf("UDP port %d is not supported", port))
+		}
+	}
+	if !c.Passthrough && svc.Service != nil {
+		if passthrough, _ := annotations.GetOptionalBoolAnnotation(annotations.LBEXIpPassthrough, svc.Service); passthrough {
+			reasons = append(reasons, "source address passthrough is not supported")
+		}
+	}
+	if len(reasons) > 0 {
+		return fmt.Errorf("unsupported by the backend: %s", strings.Join(reasons, "; "))
+	}
+	return nil
+}
+
+func (c Capabilities) String() string {
+	j, err := json.Marshal(c)
+	if err != nil {
+		return string("cant't marshal: " + reflect.TypeOf(c).String() + ", to json string, err: " + err.Error())
+	}
+	return string(j)
+}
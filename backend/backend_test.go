@@ -0,0 +1,82 @@
+package backend
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/sostheim/lbex/annotations"
+	"github.com/sostheim/lbex/nginx"
+
+	v1 "k8s.io/client-go/pkg/api/v1"
+)
+
+func TestCapabilitiesCheck(t *testing.T) {
+	tcp := nginx.Target{ServicePort: 80, Protocol: "TCP"}
+	udp := nginx.Target{ServicePort: 53, Protocol: "UDP"}
+	passthrough := &v1.Service{ObjectMeta: v1.ObjectMeta{
+		Annotations: map[string]string{annotations.LBEXIpPassthrough: "true"},
+	}}
+
+	tests := []struct {
+		name    string
+		backend Backend
+		svc     nginx.ServiceSpec
+		reasons []string
+	}{
+		{
+			name:    "haproxy TCP",
+			backend: &haproxyBackend{},
+			svc:     nginx.ServiceSpec{Algorithm: nginx.LeastConnections, Topology: []nginx.Target{tcp}},
+		},
+		{
+			name:    "haproxy least_time",
+			backend: &haproxyBackend{},
+			svc:     nginx.ServiceSpec{Algorithm: nginx.LowestLatency, Topology: []nginx.Target{tcp}},
+			reasons: []string{"algorithm least_time"},
+		},
+		{
+			name:    "haproxy UDP",
+			backend: &haproxyBackend{},
+			svc:     nginx.ServiceSpec{Topology: []nginx.Target{tcp, udp, udp}},
+			reasons: []string{"UDP port 53 is not supported"},
+		},
+		{
+			name:    "proxy passthrough",
+			backend: &proxyBackend{},
+			svc:     nginx.ServiceSpec{Service: passthrough, Topology: []nginx.Target{tcp, udp}},
+			reasons: []string{"passthrough"},
+		},
+		{
+			name:    "proxy least_time",
+			backend: &proxyBackend{},
+			svc:     nginx.ServiceSpec{Algorithm: nginx.LowestLatency, Topology: []nginx.Target{tcp, udp}},
+			reasons: []string{"algorithm least_time"},
+		},
+		{
+			name:    "nginx",
+			backend: &nginxBackend{},
+			svc:     nginx.ServiceSpec{Service: passthrough, Algorithm: nginx.LowestLatency, Topology: []nginx.Target{tcp, udp}},
+		},
+	}
+	for _, test := range tests {
+		err := test.backend.Capabilities().Check(&test.svc)
+		if len(test.reasons) == 0 {
+			if err != nil {
+				t.Errorf("%s: unexpected error: %v", test.name, err)
+			}
+			continue
+		}
+		if err == nil {
+			t.Errorf("%s: got no error, want %v", test.name, test.reasons)
+			continue
+		}
+		for _, reason := range test.reasons {
+			if !strings.Contains(err.Error(), reason) {
+				t.Errorf("%s: error %q does not include %q", test.name, err, reason)
+			}
+		}
+		if n := strings.Count(err.Error(), "not supported"); n != len(test.reasons) {
+			t.Errorf("%s: error %q: got %d reasons, want %d", test.name, err, n, len(test.reasons))
+		}
+	}
+}
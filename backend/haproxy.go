@@ -0,0 +1,43 @@
+package backend
+
+import (
+	"github.com/sostheim/lbex/haproxy"
+	"github.com/sostheim/lbex/nginx"
+)
+
+// haproxyBackend is the HAProxy data plane, configured through a
+// haproxy.Configurator
+type haproxyBackend struct {
+	*haproxy.Configurator
+}
+
+// NewHAProxy creates the HAProxy backend.  When local is true HAProxy is
+// neither run nor configured, for a dry run configFile is written but HAProxy
+// is not run.
+func NewHAProxy(configFile string, local, dryRun, healthCheck bool, healthPort int) (Backend, error) {
+	ctl, err := haproxy.NewController(configFile, local, dryRun)
+	if err != nil {
+		return nil, err
+	}
+	return &haproxyBackend{
+		Configurator: haproxy.NewConfigurator(ctl, healthCheck, healthPort),
+	}, nil
+}
+
+func (hb *haproxyBackend) Name() string {
+	return "haproxy"
+}
+
+func (hb *haproxyBackend) Capabilities() Capabilities {
+	return Capabilities{
+		Algorithms:    haproxy.SupportedAlgorithms,
+		UpstreamTypes: nginx.UpstreamTypes,
+		UDP:           false,
+		LiveUpdate:    false,
+		Passthrough:   true,
+	}
+}
+
+func (hb *haproxyBackend) Run(resync func(), stopCh <-chan struct{}) {
+	<-stopCh
+}
@@ -0,0 +1,111 @@
+package backend
+
+import (
+	"time"
+
+	"github.com/sostheim/lbex/accesslog"
+	"github.com/sostheim/lbex/nginx"
+)
+
+// templatePollPeriod - how often the NGINX template override directory is
+// checked for changes
+var templatePollPeriod = 10 * time.Second
+
+// nginxBackend is the NGINX data plane, configured through an nginx.Configurator
+type nginxBackend struct {
+	*nginx.Configurator
+	ngxc        *nginx.NginxController
+	templateDir string
+	// collector - receives the stream access log, nil if traffic metrics are
+	// disabled
+	collector *accesslog.Collector
+	dryRun    bool
+}
+
+// NewNginx creates the NGINX backend.  With trafficMetrics, per-service traffic
+// metrics are collected from the stream access log.
+func NewNginx(cfgType nginx.Configuration, nginxConfPath string, dryRun bool, templateDir string, trafficMetrics, healthCheck bool, healthPort int) (Backend, error) {
+	var collector *accesslog.Collector
+	destination := ""
+	if trafficMetrics {
+		collector = accesslog.NewCollector(accesslog.DefaultSocket)
+		destination = collector.Destination()
+	}
+	ngxc, err := nginx.NewNginxController(cfgType, nginxConfPath, dryRun, templateDir, destination, healthCheck, healthPort)
+	if err != nil {
+		return nil, err
+	}
+	return &nginxBackend{
+		Configurator: nginx.NewConfigurator(ngxc),
+		ngxc:         ngxc,
+		templateDir:  templateDir,
+		collector:    collector,
+		dryRun:       dryRun,
+	}, nil
+}
+
+func (nb *nginxBackend) Name() string {
+	return "nginx"
+}
+
+func (nb *nginxBackend) Capabilities() Capabilities {
+	return Capabilities{
+		Algorithms:    nginx.SupportedAlgorithms,
+		UpstreamTypes: nginx.UpstreamTypes,
+		UDP:           true,
+		LiveUpdate:    false,
+		Passthrough:   true,
+	}
+}
+
+func (nb *nginxBackend) Start() error {
+	// the log socket must exist before NGINX starts sending to it
+	if nb.collector != nil && !nb.dryRun {
+		if err := nb.collector.Start(); err != nil {
+			return err
+		}
+	}
+	return nb.ngxc.Start()
+}
+
+// Run watches the template override directory until stopCh is closed, then
+// stops NGINX and the access log collector
+func (nb *nginxBackend) Run(resync func(), stopCh <-chan struct{}) {
+	nb.ngxc.WatchTemplates(nb.templateDir, templatePollPeriod, resync, stopCh)
+	// NGINX logs to the collector for as long as it runs, so neither is
+	// stopped until stopCh is closed, whether or not templates are watched
+	<-stopCh
+	nb.ngxc.Stop()
+	if nb.collector != nil {
+		nb.collector.Close()
+	}
+}
+
+// DeleteService removes the service, and its' traffic metrics
+func (nb *nginxBackend) DeleteService(key, name string) error {
+	if nb.collector != nil {
+		nb.collector.Forget(key)
+	}
+	return nb.Configurator.DeleteService(key, name)
+}
+
+func (nb *nginxBackend) ServiceConfig(key, name string) (string, error) {
+	content, err := nb.ngxc.StreamConfiguration(name)
+	return string(content), err
+}
+
+func (nb *nginxBackend) Validate() error {
+	return nb.ngxc.Validate()
+}
+
+func (nb *nginxBackend) Reload() error {
+	return nb.ngxc.Reload()
+}
+
+func (nb *nginxBackend) ReloadStats() nginx.ReloadStats {
+	return nb.ngxc.ReloadStats()
+}
+
+func (nb *nginxBackend) Healthy() error {
+	return nb.ngxc.Healthy()
+}
@@ -0,0 +1,87 @@
+package backend
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/sostheim/lbex/accesslog"
+	"github.com/sostheim/lbex/nginx"
+)
+
+// runNginx runs the backend in the background, returning a channel that is
+// closed when Run returns
+func runNginx(nb *nginxBackend, stopCh chan struct{}) chan struct{} {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		nb.Run(func() {}, stopCh)
+	}()
+	return done
+}
+
+func newTestNginx(t *testing.T) (*nginxBackend, func()) {
+	dir, err := ioutil.TempDir("", "lbex-nginx")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	ngxc, err := nginx.NewNginxController(nginx.LocalCfg, dir, false, "", "", false, 0)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatalf("NewNginxController: %v", err)
+	}
+	return &nginxBackend{Configurator: nginx.NewConfigurator(ngxc), ngxc: ngxc}, func() { os.RemoveAll(dir) }
+}
+
+func TestNginxRunWithoutTemplateDir(t *testing.T) {
+	nb, cleanup := newTestNginx(t)
+	defer cleanup()
+
+	stopCh := make(chan struct{})
+	done := runNginx(nb, stopCh)
+	select {
+	case <-done:
+		t.Fatalf("Run returned, and stopped NGINX, before stopCh was closed")
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	close(stopCh)
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Run did not return after stopCh was closed")
+	}
+}
+
+func TestNginxRunKeepsCollector(t *testing.T) {
+	nb, cleanup := newTestNginx(t)
+	defer cleanup()
+	dir, err := ioutil.TempDir("", "lbex-log")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	socket := dir + "/stream-log.sock"
+	nb.collector = accesslog.NewCollector(socket)
+	if err := nb.collector.Start(); err != nil {
+		t.Fatalf("collector start: %v", err)
+	}
+
+	stopCh := make(chan struct{})
+	done := runNginx(nb, stopCh)
+	time.Sleep(200 * time.Millisecond)
+	if _, err := os.Stat(socket); err != nil {
+		t.Errorf("stream log socket closed before stopCh was closed: %v", err)
+	}
+
+	close(stopCh)
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Run did not return after stopCh was closed")
+	}
+	if _, err := os.Stat(socket); !os.IsNotExist(err) {
+		t.Errorf("stream log socket not removed after stopCh was closed: %v", err)
+	}
+}
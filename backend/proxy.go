@@ -0,0 +1,44 @@
+package backend
+
+import (
+	"time"
+
+	"github.com/sostheim/lbex/nginx"
+	"github.com/sostheim/lbex/proxy"
+)
+
+// drainTimeout - how long connections to removed proxy upstreams are allowed
+// to complete
+var drainTimeout = 30 * time.Second
+
+// proxyBackend is the in-process Go data plane, configured through a
+// proxy.Configurator
+type proxyBackend struct {
+	*proxy.Configurator
+}
+
+// NewProxy creates the in-process proxy backend
+func NewProxy(healthCheck bool, healthPort int) (Backend, error) {
+	return &proxyBackend{
+		Configurator: proxy.NewConfigurator(proxy.NewProxy(drainTimeout), healthCheck, healthPort),
+	}, nil
+}
+
+func (pb *proxyBackend) Name() string {
+	return "proxy"
+}
+
+func (pb *proxyBackend) Capabilities() Capabilities {
+	return Capabilities{
+		Algorithms:    proxy.SupportedAlgorithms,
+		UpstreamTypes: nginx.UpstreamTypes,
+		UDP:           true,
+		LiveUpdate:    true,
+		Passthrough:   false,
+	}
+}
+
+func (pb *proxyBackend) Run(resync func(), stopCh <-chan struct{}) {
+	<-stopCh
+	pb.Close()
+}
@@ -0,0 +1,162 @@
+package backend
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/sostheim/lbex/nginx"
+)
+
+// Recorder is a no-op Backend that records the service model it is given,
+// for use in tests and for running the controller without a data plane.
+type Recorder struct {
+	lock  sync.Mutex
+	state *nginx.State
+
+	// Services - the last applied spec, by service key
+	Services map[string]*nginx.ServiceSpec
+	// Deleted - the keys of deleted services, in order
+	Deleted []string
+	// Reloads - the number of commits
+	Reloads int
+	// Err - if set, returned by AddOrUpdateService, DeleteService and Reload
+	Err error
+	// Supported - the capabilities reported, every feature by default
+	Supported Capabilities
+}
+
+// NewRecorder creates a new recording backend
+func NewRecorder() *Recorder {
+	return &Recorder{
+		state:    nginx.NewState(),
+		Services: make(map[string]*nginx.ServiceSpec),
+		Supported: Capabilities{
+			Algorithms:    nginx.SupportedAlgorithms,
+			UpstreamTypes: nginx.UpstreamTypes,
+			UDP:           true,
+			LiveUpdate:    true,
+			Passthrough:   true,
+		},
+	}
+}
+
+// Name returns "recorder"
+func (r *Recorder) Name() string {
+	return "recorder"
+}
+
+// Capabilities reports the Supported capabilities
+func (r *Recorder) Capabilities() Capabilities {
+	return r.Supported
+}
+
+// Start does nothing
+func (r *Recorder) Start() error {
+	return nil
+}
+
+// Run does nothing
+func (r *Recorder) Run(resync func(), stopCh <-chan struct{}) {
+}
+
+// State returns the recorder's node and service upstream state
+func (r *Recorder) State() *nginx.State {
+	return r.state
+}
+
+// AddOrUpdateNode records the node
+func (r *Recorder) AddOrUpdateNode(node nginx.Node) []string {
+	return r.state.UpdateNode(node)
+}
+
+// DeleteNode removes the node
+func (r *Recorder) DeleteNode(name string) []string {
+	node, ok := r.state.Node(name)
+	if !ok {
+		return nil
+	}
+	node.Active = false
+	return r.state.UpdateNode(node)
+}
+
+// AddOrUpdateService records the spec, and the nodes its' targets run on
+func (r *Recorder) AddOrUpdateService(svc *nginx.ServiceSpec) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.Err != nil {
+		return r.Err
+	}
+
+	nodeNames := []string{}
+	if svc.UpstreamType == nginx.HostNode {
+		for _, target := range svc.Topology {
+			nodeNames = append(nodeNames, target.NodeName)
+		}
+	}
+	r.state.SetServiceUpstreams(svc.Key, nodeNames, svc.Topology, false)
+	ports := make(map[string]bool)
+	for _, target := range svc.Topology {
+		ports[target.PortName] = true
+	}
+	r.state.SetServiceSummary(svc.Key, nginx.ServiceSummary{
+		Listeners:       len(ports),
+		UpstreamServers: len(svc.Topology),
+	})
+	r.Services[svc.Key] = svc
+	r.Reloads++
+	return nil
+}
+
+// DeleteService records the deletion
+func (r *Recorder) DeleteService(key, name string) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.Err != nil {
+		return r.Err
+	}
+
+	r.state.RemoveService(key)
+	delete(r.Services, key)
+	r.Deleted = append(r.Deleted, key)
+	r.Reloads++
+	return nil
+}
+
+// ServiceConfig returns the recorded spec, as JSON
+func (r *Recorder) ServiceConfig(key, name string) (string, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	svc, ok := r.Services[key]
+	if !ok {
+		return "", fmt.Errorf("no configuration for service: %s", key)
+	}
+	return svc.String(), nil
+}
+
+// Validate always succeeds
+func (r *Recorder) Validate() error {
+	return nil
+}
+
+// ReloadStats reports each commit as an applied reload
+func (r *Recorder) ReloadStats() nginx.ReloadStats {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return nginx.ReloadStats{Applied: uint64(r.Reloads)}
+}
+
+// Healthy always succeeds
+func (r *Recorder) Healthy() error {
+	return nil
+}
+
+// Reload records a commit
+func (r *Recorder) Reload() error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.Err != nil {
+		return r.Err
+	}
+	r.Reloads++
+	return nil
+}
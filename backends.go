@@ -0,0 +1,55 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"runtime"
+
+	"github.com/sostheim/lbex/backend"
+	"github.com/sostheim/lbex/haproxy"
+	"github.com/sostheim/lbex/nginx"
+)
+
+// newBackend creates the load balancer data plane backend selected by --backend
+func newBackend(cfg *config) (backend.Backend, error) {
+	// local testing -> no actual data plane instance, a dry run writes the
+	// configuration even when running locally
+	dryRun := *cfg.dryRun
+	local := runtime.GOOS == "darwin" && !dryRun
+
+	if dryRun {
+		if *cfg.outputDir == "" {
+			return nil, fmt.Errorf("--dry-run requires --output-dir")
+		}
+		if err := os.MkdirAll(*cfg.outputDir, 0755); err != nil {
+			return nil, fmt.Errorf("failed to create output directory: %v", err)
+		}
+	}
+
+	switch *cfg.backend {
+	case "nginx":
+		cfgType := nginx.StreamCfg
+		if local {
+			cfgType = nginx.LocalCfg
+		}
+		confPath := "/etc/nginx/"
+		if dryRun {
+			confPath = *cfg.outputDir
+		}
+		return backend.NewNginx(cfgType, confPath, dryRun, *cfg.templateDir, *cfg.trafficMetrics, *cfg.healthCheck, *cfg.healthCheckPort)
+	case "haproxy":
+		configFile := haproxy.DefaultConfigFile
+		if dryRun {
+			configFile = path.Join(*cfg.outputDir, path.Base(configFile))
+		}
+		return backend.NewHAProxy(configFile, local, dryRun, *cfg.healthCheck, *cfg.healthCheckPort)
+	case "proxy":
+		if dryRun {
+			return nil, fmt.Errorf("the proxy backend applies configuration directly, --dry-run is not supported")
+		}
+		return backend.NewProxy(*cfg.healthCheck, *cfg.healthCheckPort)
+	default:
+		return nil, fmt.Errorf("unknown backend: %s, must be one of: nginx, haproxy, proxy", *cfg.backend)
+	}
+}
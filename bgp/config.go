@@ -0,0 +1,165 @@
+package bgp
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"k8s.io/client-go/pkg/util/yaml"
+)
+
+const (
+	// DefaultPort - the BGP port
+	DefaultPort = 179
+	// DefaultHoldTime - the hold time, in seconds, proposed to peers
+	DefaultHoldTime = 90
+	// DefaultLocalPref - the local preference of routes advertised to iBGP
+	// peers
+	DefaultLocalPref = 100
+)
+
+// Config - the BGP configuration, e.g.
+//
+//	localASN: 64512
+//	routerID: 10.0.0.10
+//	pools:
+//	  web:
+//	    peers:
+//	    - address: 10.0.0.1
+//	      asn: 64500
+//	    communities: ["64512:100"]
+//	    localPref: 200
+//
+// The pool "" (or "default") holds the peers of addresses from the unnamed
+// --vip-range pool.
+type Config struct {
+	LocalASN uint32                `json:"localASN"`
+	RouterID string                `json:"routerID"`
+	Pools    map[string]PoolConfig `json:"pools"`
+}
+
+// PoolConfig - the peers that the addresses of a pool are advertised to, and
+// the attributes of the routes
+type PoolConfig struct {
+	Peers       []PeerConfig `json:"peers"`
+	Communities []string     `json:"communities,omitempty"`
+	LocalPref   uint32       `json:"localPref,omitempty"`
+}
+
+// PeerConfig - a BGP peer
+type PeerConfig struct {
+	Address  string `json:"address"`
+	ASN      uint32 `json:"asn"`
+	Port     int    `json:"port,omitempty"`
+	HoldTime int    `json:"holdTime,omitempty"`
+}
+
+func (c Config) String() string {
+	j, err := json.Marshal(c)
+	if err != nil {
+		return string("cant't marshal: " + reflect.TypeOf(c).String() + ", to json string, err: " + err.Error())
+	}
+	return string(j)
+}
+
+// LoadConfig reads a YAML or JSON configuration file, and validates it
+func LoadConfig(filename string) (*Config, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	cfg := &Config{}
+	if err := yaml.NewYAMLOrJSONDecoder(f, 4096).Decode(cfg); err != nil {
+		return nil, fmt.Errorf("%s: %v", filename, err)
+	}
+	if err := cfg.validate(); err != nil {
+		return nil, fmt.Errorf("%s: %v", filename, err)
+	}
+	return cfg, nil
+}
+
+// validate checks the configuration, and sets the defaults of omitted values
+func (c *Config) validate() error {
+	if c.LocalASN == 0 {
+		return fmt.Errorf("localASN is required")
+	}
+	if ip := net.ParseIP(c.RouterID); ip == nil || ip.To4() == nil {
+		return fmt.Errorf("invalid routerID %q, must be an IPv4 address", c.RouterID)
+	}
+	if len(c.Pools) == 0 {
+		return fmt.Errorf("at least one pool is required")
+	}
+
+	pools := make(map[string]PoolConfig)
+	for name, pool := range c.Pools {
+		if name == "default" {
+			name = ""
+		}
+		if _, ok := pools[name]; ok {
+			return fmt.Errorf("pool %q: defined more than once", name)
+		}
+		if len(pool.Peers) == 0 {
+			return fmt.Errorf("pool %q: at least one peer is required", name)
+		}
+		if _, err := parseCommunities(pool.Communities); err != nil {
+			return fmt.Errorf("pool %q: %v", name, err)
+		}
+		if pool.LocalPref == 0 {
+			pool.LocalPref = DefaultLocalPref
+		}
+		peers := make([]PeerConfig, len(pool.Peers))
+		for i, peer := range pool.Peers {
+			if net.ParseIP(peer.Address) == nil {
+				return fmt.Errorf("pool %q: invalid peer address %q", name, peer.Address)
+			}
+			if peer.ASN == 0 {
+				return fmt.Errorf("pool %q: peer %s: asn is required", name, peer.Address)
+			}
+			if peer.Port == 0 {
+				peer.Port = DefaultPort
+			}
+			if peer.Port < 1 || peer.Port > 65535 {
+				return fmt.Errorf("pool %q: peer %s: invalid port %d", name, peer.Address, peer.Port)
+			}
+			if peer.HoldTime == 0 {
+				peer.HoldTime = DefaultHoldTime
+			}
+			// RFC 4271: the hold time must be zero or at least three seconds
+			if peer.HoldTime < 3 || peer.HoldTime > 65535 {
+				return fmt.Errorf("pool %q: peer %s: invalid holdTime %d, must be 3 to 65535 seconds", name, peer.Address, peer.HoldTime)
+			}
+			peers[i] = peer
+		}
+		pool.Peers = peers
+		pools[name] = pool
+	}
+	c.Pools = pools
+	return nil
+}
+
+// parseCommunities parses communities in the "asn:value" notation
+func parseCommunities(communities []string) ([]uint32, error) {
+	values := []uint32{}
+	for _, community := range communities {
+		parts := strings.Split(community, ":")
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid community %q, must be asn:value", community)
+		}
+		high, err := strconv.ParseUint(parts[0], 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("invalid community %q: %v", community, err)
+		}
+		low, err := strconv.ParseUint(parts[1], 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("invalid community %q: %v", community, err)
+		}
+		values = append(values, uint32(high)<<16|uint32(low))
+	}
+	return values, nil
+}
@@ -0,0 +1,312 @@
+package bgp
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+)
+
+// BGP-4 message types, RFC 4271
+const (
+	msgOpen         = 1
+	msgUpdate       = 2
+	msgNotification = 3
+	msgKeepalive    = 4
+
+	headerLen     = 19
+	maxMessageLen = 4096
+	version       = 4
+)
+
+// path attribute types and flags, RFC 4271, RFC 1997 and RFC 4760
+const (
+	attrOrigin      = 1
+	attrASPath      = 2
+	attrNextHop     = 3
+	attrLocalPref   = 5
+	attrCommunities = 8
+	attrMPReach     = 14
+	attrMPUnreach   = 15
+
+	flagOptional   = 0x80
+	flagTransitive = 0x40
+	flagExtended   = 0x10
+
+	originIGP  = 0
+	asSequence = 2
+)
+
+// capabilities, RFC 5492, RFC 4760 and RFC 6793
+const (
+	paramCapabilities = 2
+	capMultiprotocol  = 1
+	capFourOctetAS    = 65
+
+	afiIPv4     = 1
+	afiIPv6     = 2
+	safiUnicast = 1
+
+	// asTrans - the 2 octet AS number of a speaker with a 4 octet AS number
+	asTrans = 23456
+)
+
+// NOTIFICATION error codes and subcodes, RFC 4271 and RFC 4486
+const (
+	errHeader           = 1
+	errOpen             = 2
+	errHoldTimerExpired = 4
+	errCease            = 6
+
+	subcodeBadPeerAS        = 2
+	subcodeAdminShutdown    = 2
+	subcodeUnacceptableHold = 6
+)
+
+// notificationError - a NOTIFICATION received from, or sent to, a peer
+type notificationError struct {
+	code    byte
+	subcode byte
+}
+
+func (n notificationError) Error() string {
+	return fmt.Sprintf("notification: code %d, subcode %d", n.code, n.subcode)
+}
+
+// message - a BGP message, without its' header
+type message struct {
+	msgType byte
+	body    []byte
+}
+
+func readMessage(r io.Reader) (message, error) {
+	header := make([]byte, headerLen)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return message{}, err
+	}
+	for _, b := range header[:16] {
+		if b != 0xff {
+			return message{}, errors.New("invalid message marker")
+		}
+	}
+	length := int(binary.BigEndian.Uint16(header[16:18]))
+	if length < headerLen || length > maxMessageLen {
+		return message{}, fmt.Errorf("invalid message length: %d", length)
+	}
+	body := make([]byte, length-headerLen)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return message{}, err
+	}
+	return message{msgType: header[18], body: body}, nil
+}
+
+func encodeMessage(msgType byte, body []byte) []byte {
+	msg := make([]byte, headerLen, headerLen+len(body))
+	for i := 0; i < 16; i++ {
+		msg[i] = 0xff
+	}
+	binary.BigEndian.PutUint16(msg[16:], uint16(headerLen+len(body)))
+	msg[18] = msgType
+	return append(msg, body...)
+}
+
+// open - the parameters of an OPEN message
+type open struct {
+	asn        uint32
+	holdTime   uint16
+	routerID   net.IP
+	fourOctet  bool
+	families   map[uint32]bool
+	rawPeerASN uint16
+}
+
+// family encodes an address family identifier and subsequent address family
+// identifier as a map key
+func family(afi uint16, safi byte) uint32 {
+	return uint32(afi)<<8 | uint32(safi)
+}
+
+func encodeOpen(o open) []byte {
+	capability := func(code byte, value []byte) []byte {
+		return append([]byte{code, byte(len(value))}, value...)
+	}
+	caps := []byte{}
+	caps = append(caps, capability(capMultiprotocol, []byte{0, afiIPv4, 0, safiUnicast})...)
+	caps = append(caps, capability(capMultiprotocol, []byte{0, afiIPv6, 0, safiUnicast})...)
+	asn4 := make([]byte, 4)
+	binary.BigEndian.PutUint32(asn4, o.asn)
+	caps = append(caps, capability(capFourOctetAS, asn4)...)
+	params := append([]byte{paramCapabilities, byte(len(caps))}, caps...)
+
+	asn2 := uint16(asTrans)
+	if o.asn <= 0xffff {
+		asn2 = uint16(o.asn)
+	}
+	body := make([]byte, 10)
+	body[0] = version
+	binary.BigEndian.PutUint16(body[1:], asn2)
+	binary.BigEndian.PutUint16(body[3:], o.holdTime)
+	copy(body[5:9], o.routerID.To4())
+	body[9] = byte(len(params))
+	return encodeMessage(msgOpen, append(body, params...))
+}
+
+func decodeOpen(body []byte) (open, error) {
+	if len(body) < 10 || body[0] != version {
+		return open{}, errors.New("invalid OPEN message")
+	}
+	o := open{
+		rawPeerASN: binary.BigEndian.Uint16(body[1:3]),
+		holdTime:   binary.BigEndian.Uint16(body[3:5]),
+		routerID:   net.IP(body[5:9]),
+		families:   make(map[uint32]bool),
+	}
+	o.asn = uint32(o.rawPeerASN)
+	params := body[10:]
+	if len(params) < int(body[9]) {
+		return open{}, errors.New("invalid OPEN optional parameters")
+	}
+	params = params[:body[9]]
+	for len(params) >= 2 {
+		paramType, paramLen := params[0], int(params[1])
+		if len(params) < 2+paramLen {
+			return open{}, errors.New("invalid OPEN optional parameter")
+		}
+		value := params[2 : 2+paramLen]
+		params = params[2+paramLen:]
+		if paramType != paramCapabilities {
+			continue
+		}
+		for len(value) >= 2 {
+			code, capLen := value[0], int(value[1])
+			if len(value) < 2+capLen {
+				return open{}, errors.New("invalid OPEN capability")
+			}
+			capValue := value[2 : 2+capLen]
+			value = value[2+capLen:]
+			switch {
+			case code == capMultiprotocol && capLen == 4:
+				o.families[family(binary.BigEndian.Uint16(capValue[0:2]), capValue[3])] = true
+			case code == capFourOctetAS && capLen == 4:
+				o.fourOctet = true
+				o.asn = binary.BigEndian.Uint32(capValue)
+			}
+		}
+	}
+	// without the multiprotocol capability, only IPv4 unicast is supported
+	if len(o.families) == 0 {
+		o.families[family(afiIPv4, safiUnicast)] = true
+	}
+	return o, nil
+}
+
+func encodeKeepalive() []byte {
+	return encodeMessage(msgKeepalive, nil)
+}
+
+func encodeNotification(code, subcode byte) []byte {
+	return encodeMessage(msgNotification, []byte{code, subcode})
+}
+
+// attributes - the path attributes of an advertised route
+type attributes struct {
+	communities []uint32
+	localPref   uint32
+}
+
+// updateParams - the session parameters that determine the encoding of an
+// UPDATE message
+type updateParams struct {
+	localASN  uint32
+	ibgp      bool
+	fourOctet bool
+	nextHop4  net.IP
+	nextHop6  net.IP
+}
+
+func pathAttribute(flags, attrType byte, value []byte) []byte {
+	if len(value) > 255 {
+		attr := []byte{flags | flagExtended, attrType, 0, 0}
+		binary.BigEndian.PutUint16(attr[2:], uint16(len(value)))
+		return append(attr, value...)
+	}
+	return append([]byte{flags, attrType, byte(len(value))}, value...)
+}
+
+// encodePrefix encodes a host route (/32 or /128) as NLRI
+func encodePrefix(ip net.IP) []byte {
+	if ip4 := ip.To4(); ip4 != nil {
+		return append([]byte{32}, ip4...)
+	}
+	return append([]byte{128}, ip.To16()...)
+}
+
+// encodeAdvertisement encodes an UPDATE that advertises the host route for ip
+func encodeAdvertisement(p updateParams, ip net.IP, attrs attributes) []byte {
+	asPath := []byte{}
+	if !p.ibgp {
+		if p.fourOctet {
+			asPath = []byte{asSequence, 1, 0, 0, 0, 0}
+			binary.BigEndian.PutUint32(asPath[2:], p.localASN)
+		} else {
+			asPath = []byte{asSequence, 1, 0, 0}
+			asn := uint16(asTrans)
+			if p.localASN <= 0xffff {
+				asn = uint16(p.localASN)
+			}
+			binary.BigEndian.PutUint16(asPath[2:], asn)
+		}
+	}
+
+	pathAttrs := []byte{}
+	pathAttrs = append(pathAttrs, pathAttribute(flagTransitive, attrOrigin, []byte{originIGP})...)
+	pathAttrs = append(pathAttrs, pathAttribute(flagTransitive, attrASPath, asPath)...)
+
+	nlri := []byte{}
+	if ip.To4() != nil {
+		pathAttrs = append(pathAttrs, pathAttribute(flagTransitive, attrNextHop, p.nextHop4.To4())...)
+		nlri = encodePrefix(ip)
+	} else {
+		mp := []byte{0, afiIPv6, safiUnicast, 16}
+		mp = append(mp, p.nextHop6.To16()...)
+		mp = append(mp, 0)
+		mp = append(mp, encodePrefix(ip)...)
+		pathAttrs = append(pathAttrs, pathAttribute(flagOptional, attrMPReach, mp)...)
+	}
+	if p.ibgp {
+		localPref := make([]byte, 4)
+		binary.BigEndian.PutUint32(localPref, attrs.localPref)
+		pathAttrs = append(pathAttrs, pathAttribute(flagTransitive, attrLocalPref, localPref)...)
+	}
+	if len(attrs.communities) > 0 {
+		communities := make([]byte, 4*len(attrs.communities))
+		for i, c := range attrs.communities {
+			binary.BigEndian.PutUint32(communities[4*i:], c)
+		}
+		pathAttrs = append(pathAttrs, pathAttribute(flagOptional|flagTransitive, attrCommunities, communities)...)
+	}
+
+	body := []byte{0, 0}
+	lenAttrs := make([]byte, 2)
+	binary.BigEndian.PutUint16(lenAttrs, uint16(len(pathAttrs)))
+	body = append(body, lenAttrs...)
+	body = append(body, pathAttrs...)
+	body = append(body, nlri...)
+	return encodeMessage(msgUpdate, body)
+}
+
+// encodeWithdrawal encodes an UPDATE that withdraws the host route for ip
+func encodeWithdrawal(ip net.IP) []byte {
+	if ip.To4() != nil {
+		withdrawn := encodePrefix(ip)
+		body := []byte{0, byte(len(withdrawn))}
+		body = append(body, withdrawn...)
+		return encodeMessage(msgUpdate, append(body, 0, 0))
+	}
+	mp := []byte{0, afiIPv6, safiUnicast}
+	mp = append(mp, encodePrefix(ip)...)
+	pathAttrs := pathAttribute(flagOptional, attrMPUnreach, mp)
+	body := []byte{0, 0, 0, byte(len(pathAttrs))}
+	return encodeMessage(msgUpdate, append(body, pathAttrs...))
+}
@@ -0,0 +1,265 @@
+package bgp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"reflect"
+	"testing"
+)
+
+// update - the decoded content of an UPDATE message
+type update struct {
+	withdrawn   []string
+	nlri        []string
+	origin      int
+	asPath      []uint32
+	nextHop     string
+	localPref   uint32
+	communities []uint32
+	attrFlags   map[byte]byte
+}
+
+// decodePrefixes decodes host routes, /32 or /128, from NLRI
+func decodePrefixes(t *testing.T, b []byte) []string {
+	prefixes := []string{}
+	for len(b) > 0 {
+		n := (int(b[0]) + 7) / 8
+		if len(b) < 1+n {
+			t.Fatalf("truncated prefix: %x", b)
+		}
+		prefixes = append(prefixes, net.IP(b[1:1+n]).String())
+		b = b[1+n:]
+	}
+	return prefixes
+}
+
+// decodeUpdate decodes an UPDATE, independently of the encoder, with AS path
+// segments of asLen octet AS numbers
+func decodeUpdate(t *testing.T, raw []byte, asLen int) update {
+	msg, err := readMessage(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatalf("readMessage: %v", err)
+	}
+	if msg.msgType != msgUpdate {
+		t.Fatalf("message type: got %d, want UPDATE", msg.msgType)
+	}
+	body := msg.body
+	u := update{origin: -1, attrFlags: make(map[byte]byte)}
+
+	withdrawnLen := int(binary.BigEndian.Uint16(body))
+	u.withdrawn = decodePrefixes(t, body[2:2+withdrawnLen])
+	body = body[2+withdrawnLen:]
+	attrsLen := int(binary.BigEndian.Uint16(body))
+	attrs := body[2 : 2+attrsLen]
+	u.nlri = decodePrefixes(t, body[2+attrsLen:])
+
+	for len(attrs) > 0 {
+		flags, attrType := attrs[0], attrs[1]
+		var value []byte
+		if flags&flagExtended != 0 {
+			n := int(binary.BigEndian.Uint16(attrs[2:]))
+			value, attrs = attrs[4:4+n], attrs[4+n:]
+		} else {
+			n := int(attrs[2])
+			value, attrs = attrs[3:3+n], attrs[3+n:]
+		}
+		u.attrFlags[attrType] = flags
+		switch attrType {
+		case attrOrigin:
+			u.origin = int(value[0])
+		case attrASPath:
+			for len(value) > 0 {
+				count := int(value[1])
+				for i := 0; i < count; i++ {
+					segment := value[2+i*asLen : 2+(i+1)*asLen]
+					if asLen == 4 {
+						u.asPath = append(u.asPath, binary.BigEndian.Uint32(segment))
+					} else {
+						u.asPath = append(u.asPath, uint32(binary.BigEndian.Uint16(segment)))
+					}
+				}
+				value = value[2+count*asLen:]
+			}
+		case attrNextHop:
+			u.nextHop = net.IP(value).String()
+		case attrLocalPref:
+			u.localPref = binary.BigEndian.Uint32(value)
+		case attrCommunities:
+			for i := 0; i+4 <= len(value); i += 4 {
+				u.communities = append(u.communities, binary.BigEndian.Uint32(value[i:]))
+			}
+		case attrMPReach:
+			if afi, safi := binary.BigEndian.Uint16(value), value[2]; afi != afiIPv6 || safi != safiUnicast {
+				t.Fatalf("MP_REACH family: got %d/%d, want IPv6 unicast", afi, safi)
+			}
+			n := int(value[3])
+			u.nextHop = net.IP(value[4 : 4+n]).String()
+			// the reserved octet follows the next hop
+			u.nlri = append(u.nlri, decodePrefixes(t, value[5+n:])...)
+		case attrMPUnreach:
+			if afi, safi := binary.BigEndian.Uint16(value), value[2]; afi != afiIPv6 || safi != safiUnicast {
+				t.Fatalf("MP_UNREACH family: got %d/%d, want IPv6 unicast", afi, safi)
+			}
+			u.withdrawn = append(u.withdrawn, decodePrefixes(t, value[3:])...)
+		}
+	}
+	return u
+}
+
+func TestOpenRoundTrip(t *testing.T) {
+	tests := []struct {
+		name       string
+		asn        uint32
+		rawPeerASN uint16
+	}{
+		{name: "2 octet AS", asn: 64512, rawPeerASN: 64512},
+		{name: "4 octet AS", asn: 4200000001, rawPeerASN: asTrans},
+	}
+	for _, test := range tests {
+		raw := encodeOpen(open{asn: test.asn, holdTime: 90, routerID: net.ParseIP("10.0.0.1")})
+		msg, err := readMessage(bytes.NewReader(raw))
+		if err != nil {
+			t.Fatalf("%s: readMessage: %v", test.name, err)
+		}
+		if msg.msgType != msgOpen {
+			t.Fatalf("%s: message type: got %d, want OPEN", test.name, msg.msgType)
+		}
+		o, err := decodeOpen(msg.body)
+		if err != nil {
+			t.Fatalf("%s: decodeOpen: %v", test.name, err)
+		}
+		if o.asn != test.asn || o.rawPeerASN != test.rawPeerASN || !o.fourOctet {
+			t.Errorf("%s: AS: got %d (raw %d, 4 octet %t), want %d (raw %d, 4 octet)",
+				test.name, o.asn, o.rawPeerASN, o.fourOctet, test.asn, test.rawPeerASN)
+		}
+		if o.holdTime != 90 || !o.routerID.Equal(net.ParseIP("10.0.0.1")) {
+			t.Errorf("%s: got hold time %d, router ID %s", test.name, o.holdTime, o.routerID)
+		}
+		want := map[uint32]bool{family(afiIPv4, safiUnicast): true, family(afiIPv6, safiUnicast): true}
+		if !reflect.DeepEqual(o.families, want) {
+			t.Errorf("%s: families: got %v, want %v", test.name, o.families, want)
+		}
+	}
+}
+
+func TestDecodeOpenWithoutCapabilities(t *testing.T) {
+	body := []byte{version, 0xfc, 0x00, 0, 180, 10, 0, 0, 2, 0}
+	o, err := decodeOpen(body)
+	if err != nil {
+		t.Fatalf("decodeOpen: %v", err)
+	}
+	if o.asn != 64512 || o.fourOctet {
+		t.Errorf("got AS %d, 4 octet %t, want 64512 without 4 octet", o.asn, o.fourOctet)
+	}
+	if want := map[uint32]bool{family(afiIPv4, safiUnicast): true}; !reflect.DeepEqual(o.families, want) {
+		t.Errorf("families: got %v, want IPv4 unicast only", o.families)
+	}
+	if _, err := decodeOpen([]byte{3, 0, 0}); err == nil {
+		t.Errorf("invalid OPEN: got no error")
+	}
+}
+
+func TestAdvertisementRoundTrip(t *testing.T) {
+	attrs := attributes{communities: []uint32{64512<<16 | 100}, localPref: 200}
+	tests := []struct {
+		name   string
+		params updateParams
+		ip     string
+		asLen  int
+		want   update
+	}{
+		{
+			name:   "eBGP IPv4",
+			params: updateParams{localASN: 64512, nextHop4: net.ParseIP("10.0.0.1")},
+			ip:     "192.0.2.10",
+			asLen:  2,
+			want:   update{nlri: []string{"192.0.2.10"}, asPath: []uint32{64512}, nextHop: "10.0.0.1"},
+		},
+		{
+			name:   "eBGP 4 octet AS to a 4 octet peer",
+			params: updateParams{localASN: 4200000001, fourOctet: true, nextHop4: net.ParseIP("10.0.0.1")},
+			ip:     "192.0.2.10",
+			asLen:  4,
+			want:   update{nlri: []string{"192.0.2.10"}, asPath: []uint32{4200000001}, nextHop: "10.0.0.1"},
+		},
+		{
+			name:   "eBGP 4 octet AS to a 2 octet peer",
+			params: updateParams{localASN: 4200000001, nextHop4: net.ParseIP("10.0.0.1")},
+			ip:     "192.0.2.10",
+			asLen:  2,
+			want:   update{nlri: []string{"192.0.2.10"}, asPath: []uint32{asTrans}, nextHop: "10.0.0.1"},
+		},
+		{
+			name:   "iBGP IPv4",
+			params: updateParams{localASN: 64512, ibgp: true, nextHop4: net.ParseIP("10.0.0.1")},
+			ip:     "192.0.2.10",
+			asLen:  2,
+			want:   update{nlri: []string{"192.0.2.10"}, nextHop: "10.0.0.1", localPref: 200},
+		},
+		{
+			name:   "eBGP IPv6",
+			params: updateParams{localASN: 64512, nextHop6: net.ParseIP("fd00::1")},
+			ip:     "2001:db8::10",
+			asLen:  2,
+			want:   update{nlri: []string{"2001:db8::10"}, asPath: []uint32{64512}, nextHop: "fd00::1"},
+		},
+	}
+	for _, test := range tests {
+		u := decodeUpdate(t, encodeAdvertisement(test.params, net.ParseIP(test.ip), attrs), test.asLen)
+		if len(u.withdrawn) != 0 {
+			t.Errorf("%s: withdrawn: got %v, want none", test.name, u.withdrawn)
+		}
+		if !reflect.DeepEqual(u.nlri, test.want.nlri) {
+			t.Errorf("%s: NLRI: got %v, want %v", test.name, u.nlri, test.want.nlri)
+		}
+		if u.origin != originIGP {
+			t.Errorf("%s: origin: got %d, want IGP", test.name, u.origin)
+		}
+		if !reflect.DeepEqual(u.asPath, test.want.asPath) {
+			t.Errorf("%s: AS path: got %v, want %v", test.name, u.asPath, test.want.asPath)
+		}
+		if u.nextHop != test.want.nextHop {
+			t.Errorf("%s: next hop: got %s, want %s", test.name, u.nextHop, test.want.nextHop)
+		}
+		if u.localPref != test.want.localPref {
+			t.Errorf("%s: local preference: got %d, want %d", test.name, u.localPref, test.want.localPref)
+		}
+		if !reflect.DeepEqual(u.communities, attrs.communities) {
+			t.Errorf("%s: communities: got %v, want %v", test.name, u.communities, attrs.communities)
+		}
+		if flags := u.attrFlags[attrCommunities]; flags != flagOptional|flagTransitive {
+			t.Errorf("%s: communities flags: got %#x, want optional transitive", test.name, flags)
+		}
+	}
+}
+
+func TestWithdrawalRoundTrip(t *testing.T) {
+	for _, ip := range []string{"192.0.2.10", "2001:db8::10"} {
+		u := decodeUpdate(t, encodeWithdrawal(net.ParseIP(ip)), 2)
+		if want := []string{ip}; !reflect.DeepEqual(u.withdrawn, want) {
+			t.Errorf("%s: withdrawn: got %v, want %v", ip, u.withdrawn, want)
+		}
+		if len(u.nlri) != 0 {
+			t.Errorf("%s: NLRI: got %v, want none", ip, u.nlri)
+		}
+	}
+}
+
+func TestReadMessageInvalid(t *testing.T) {
+	keepalive := encodeKeepalive()
+	badMarker := append([]byte{}, keepalive...)
+	badMarker[0] = 0
+	badLength := append([]byte{}, keepalive...)
+	binary.BigEndian.PutUint16(badLength[16:], maxMessageLen+1)
+
+	for name, raw := range map[string][]byte{"marker": badMarker, "length": badLength, "truncated": keepalive[:10]} {
+		if _, err := readMessage(bytes.NewReader(raw)); err == nil {
+			t.Errorf("invalid %s: got no error", name)
+		}
+	}
+	msg, err := readMessage(bytes.NewReader(encodeNotification(errCease, subcodeAdminShutdown)))
+	if err != nil || msg.msgType != msgNotification || !bytes.Equal(msg.body, []byte{errCease, subcodeAdminShutdown}) {
+		t.Errorf("notification: got %v %v", msg, err)
+	}
+}
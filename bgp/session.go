@@ -0,0 +1,376 @@
+package bgp
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+const (
+	// connectRetry - the time between attempts to connect to a peer
+	connectRetry = 5 * time.Second
+	// connectTimeout - how long a connection attempt may take
+	connectTimeout = 5 * time.Second
+	// openTimeout - how long the peer has to respond to the OPEN message
+	openTimeout = 30 * time.Second
+	// closeTimeout - how long the final withdrawals and NOTIFICATION may take
+	// to send, on shutdown
+	closeTimeout = 2 * time.Second
+)
+
+// session states
+const (
+	StateIdle        = "Idle"
+	StateConnect     = "Connect"
+	StateOpenSent    = "OpenSent"
+	StateEstablished = "Established"
+)
+
+// session - the BGP session with one peer, that advertises the desired
+// routes of the peer's pool
+type session struct {
+	pool     string
+	peer     PeerConfig
+	localASN uint32
+	routerID net.IP
+
+	lock sync.Mutex
+	// desired - the routes that should be advertised, by address
+	desired map[string]attributes
+	state   string
+	// established - the time the session was established
+	established time.Time
+	// advertised - the routes advertised to the peer, only used by run, and
+	// their' number
+	advertised map[string]bool
+	routes     int
+	lastError  string
+
+	// changed - signals run that the desired routes have changed
+	changed chan struct{}
+}
+
+func newSession(pool string, peer PeerConfig, localASN uint32, routerID net.IP) *session {
+	return &session{
+		pool:     pool,
+		peer:     peer,
+		localASN: localASN,
+		routerID: routerID,
+		desired:  make(map[string]attributes),
+		state:    StateIdle,
+		changed:  make(chan struct{}, 1),
+	}
+}
+
+func (s *session) String() string {
+	return net.JoinHostPort(s.peer.Address, strconv.Itoa(s.peer.Port))
+}
+
+// setRoutes replaces the routes that should be advertised to the peer
+func (s *session) setRoutes(routes map[string]attributes) {
+	s.lock.Lock()
+	s.desired = routes
+	s.lock.Unlock()
+	select {
+	case s.changed <- struct{}{}:
+	default:
+	}
+}
+
+func (s *session) setState(state string, err error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if state == StateEstablished && s.state != StateEstablished {
+		s.established = time.Now()
+	}
+	s.state = state
+	if err != nil {
+		s.lastError = err.Error()
+	}
+}
+
+// run connects to the peer, and re-connects whenever the session fails, until
+// stopCh is closed
+func (s *session) run(stopCh <-chan struct{}) {
+	for {
+		err := s.connect(stopCh)
+		s.setState(StateIdle, err)
+		select {
+		case <-stopCh:
+			return
+		default:
+		}
+		if err != nil {
+			glog.Warningf("bgp peer %s: %v", s, err)
+		}
+		select {
+		case <-stopCh:
+			return
+		case <-time.After(connectRetry):
+		}
+	}
+}
+
+// connect establishes the session, and then advertises the desired routes
+// until the session fails, or stopCh is closed
+func (s *session) connect(stopCh <-chan struct{}) error {
+	s.setState(StateConnect, nil)
+	conn, err := net.DialTimeout("tcp", s.String(), connectTimeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	s.setState(StateOpenSent, nil)
+	peerOpen, err := s.openSession(conn)
+	if err != nil {
+		return err
+	}
+	holdTime := time.Duration(s.peer.HoldTime) * time.Second
+	if peerHold := time.Duration(peerOpen.holdTime) * time.Second; peerHold < holdTime {
+		holdTime = peerHold
+	}
+
+	local := conn.LocalAddr().(*net.TCPAddr).IP
+	params := updateParams{
+		localASN:  s.localASN,
+		ibgp:      s.peer.ASN == s.localASN,
+		fourOctet: peerOpen.fourOctet,
+	}
+	// routes are only advertised in the address family of the session, with
+	// the session's local address as their' next hop
+	routeFamily := family(afiIPv6, safiUnicast)
+	if local.To4() != nil {
+		routeFamily = family(afiIPv4, safiUnicast)
+		params.nextHop4 = local
+	} else {
+		params.nextHop6 = local
+	}
+	if !peerOpen.families[routeFamily] {
+		conn.Write(encodeNotification(errCease, 0))
+		return fmt.Errorf("the peer does not support the address family of the session")
+	}
+
+	s.setState(StateEstablished, nil)
+	glog.Infof("bgp peer %s: session established, hold time %v", s, holdTime)
+	s.advertised = make(map[string]bool)
+	defer s.countRoutes()
+
+	messages := make(chan message)
+	readErr := make(chan error, 1)
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for {
+			msg, err := readMessage(conn)
+			if err != nil {
+				readErr <- err
+				return
+			}
+			select {
+			case messages <- msg:
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	var keepalive <-chan time.Time
+	var hold *time.Timer
+	if holdTime > 0 {
+		ticker := time.NewTicker(holdTime / 3)
+		defer ticker.Stop()
+		keepalive = ticker.C
+		hold = time.NewTimer(holdTime)
+		defer hold.Stop()
+	}
+	holdExpired := func() <-chan time.Time {
+		if hold == nil {
+			return nil
+		}
+		return hold.C
+	}
+
+	if err := s.sync(conn, params); err != nil {
+		return err
+	}
+	for {
+		select {
+		case <-stopCh:
+			s.close(conn)
+			return nil
+		case <-s.changed:
+			if err := s.sync(conn, params); err != nil {
+				return err
+			}
+		case <-keepalive:
+			if _, err := conn.Write(encodeKeepalive()); err != nil {
+				return err
+			}
+		case <-holdExpired():
+			conn.Write(encodeNotification(errHoldTimerExpired, 0))
+			return fmt.Errorf("hold timer expired")
+		case err := <-readErr:
+			return fmt.Errorf("session closed: %v", err)
+		case msg := <-messages:
+			if hold != nil {
+				if !hold.Stop() {
+					select {
+					case <-hold.C:
+					default:
+					}
+				}
+				hold.Reset(holdTime)
+			}
+			switch msg.msgType {
+			case msgNotification:
+				if len(msg.body) < 2 {
+					return fmt.Errorf("invalid NOTIFICATION message")
+				}
+				return notificationError{code: msg.body[0], subcode: msg.body[1]}
+			case msgOpen:
+				conn.Write(encodeNotification(errCease, 0))
+				return fmt.Errorf("unexpected OPEN message")
+			}
+			// the peer's routes, and keepalives, are ignored
+		}
+	}
+}
+
+// openSession exchanges OPEN and KEEPALIVE messages with the peer, and
+// returns the peer's OPEN
+func (s *session) openSession(conn net.Conn) (open, error) {
+	conn.SetDeadline(time.Now().Add(openTimeout))
+	defer conn.SetDeadline(time.Time{})
+
+	local := open{asn: s.localASN, holdTime: uint16(s.peer.HoldTime), routerID: s.routerID}
+	if _, err := conn.Write(encodeOpen(local)); err != nil {
+		return open{}, err
+	}
+
+	msg, err := readMessage(conn)
+	if err != nil {
+		return open{}, err
+	}
+	if msg.msgType == msgNotification && len(msg.body) >= 2 {
+		return open{}, notificationError{code: msg.body[0], subcode: msg.body[1]}
+	}
+	if msg.msgType != msgOpen {
+		conn.Write(encodeNotification(errHeader, 0))
+		return open{}, fmt.Errorf("expected an OPEN message, got type %d", msg.msgType)
+	}
+	peerOpen, err := decodeOpen(msg.body)
+	if err != nil {
+		conn.Write(encodeNotification(errOpen, 0))
+		return open{}, err
+	}
+	if peerOpen.asn != s.peer.ASN {
+		conn.Write(encodeNotification(errOpen, subcodeBadPeerAS))
+		return open{}, fmt.Errorf("peer AS %d, expected %d", peerOpen.asn, s.peer.ASN)
+	}
+	if peerOpen.holdTime == 1 || peerOpen.holdTime == 2 {
+		conn.Write(encodeNotification(errOpen, subcodeUnacceptableHold))
+		return open{}, fmt.Errorf("unacceptable hold time %d", peerOpen.holdTime)
+	}
+	if _, err := conn.Write(encodeKeepalive()); err != nil {
+		return open{}, err
+	}
+
+	// the peer confirms the OPEN with a KEEPALIVE
+	msg, err = readMessage(conn)
+	if err != nil {
+		return open{}, err
+	}
+	if msg.msgType == msgNotification && len(msg.body) >= 2 {
+		return open{}, notificationError{code: msg.body[0], subcode: msg.body[1]}
+	}
+	if msg.msgType != msgKeepalive {
+		return open{}, fmt.Errorf("expected a KEEPALIVE message, got type %d", msg.msgType)
+	}
+	return peerOpen, nil
+}
+
+// sync advertises the desired routes that have not been advertised, and
+// withdraws the advertised routes that are no longer desired
+func (s *session) sync(conn net.Conn, params updateParams) error {
+	s.lock.Lock()
+	desired := s.desired
+	s.lock.Unlock()
+	defer s.countRoutes()
+
+	ipv4 := params.nextHop4 != nil
+
+	for addr := range s.advertised {
+		if _, ok := desired[addr]; ok {
+			continue
+		}
+		if _, err := conn.Write(encodeWithdrawal(net.ParseIP(addr))); err != nil {
+			return err
+		}
+		glog.V(2).Infof("bgp peer %s: withdrew %s", s, addr)
+		delete(s.advertised, addr)
+	}
+	for addr, attrs := range desired {
+		if s.advertised[addr] {
+			continue
+		}
+		ip := net.ParseIP(addr)
+		if ip == nil || (ip.To4() != nil) != ipv4 {
+			glog.V(3).Infof("bgp peer %s: %s is not in the address family of the session", s, addr)
+			continue
+		}
+		if _, err := conn.Write(encodeAdvertisement(params, ip, attrs)); err != nil {
+			return err
+		}
+		glog.V(2).Infof("bgp peer %s: advertised %s", s, addr)
+		s.advertised[addr] = true
+	}
+	return nil
+}
+
+// close withdraws every advertised route, and closes the session with a
+// Cease NOTIFICATION
+func (s *session) close(conn net.Conn) {
+	conn.SetWriteDeadline(time.Now().Add(closeTimeout))
+	for addr := range s.advertised {
+		if _, err := conn.Write(encodeWithdrawal(net.ParseIP(addr))); err != nil {
+			glog.Errorf("bgp peer %s: failed to withdraw %s: %v", s, addr, err)
+			return
+		}
+		glog.V(2).Infof("bgp peer %s: withdrew %s", s, addr)
+	}
+	s.advertised = make(map[string]bool)
+	s.countRoutes()
+	conn.Write(encodeNotification(errCease, subcodeAdminShutdown))
+	glog.Infof("bgp peer %s: session closed", s)
+}
+
+func (s *session) countRoutes() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.routes = len(s.advertised)
+}
+
+// status returns the session's state, and the number of routes advertised
+// to the peer
+func (s *session) status() PeerStatus {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	status := PeerStatus{
+		Pool:      s.pool,
+		Address:   s.peer.Address,
+		ASN:       s.peer.ASN,
+		State:     s.state,
+		Routes:    s.routes,
+		LastError: s.lastError,
+	}
+	if s.state == StateEstablished {
+		established := s.established
+		status.Established = &established
+	}
+	return status
+}
@@ -0,0 +1,177 @@
+// Package bgp advertises service addresses (VIPs) as host routes, /32 or
+// /128, to the BGP peers of each address pool.  LBEX only originates routes:
+// it connects to its' peers, and ignores the routes that they advertise.
+package bgp
+
+import (
+	"encoding/json"
+	"net"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// PeerStatus - the state of the session with a peer
+type PeerStatus struct {
+	Pool        string     `json:"pool"`
+	Address     string     `json:"address"`
+	ASN         uint32     `json:"asn"`
+	State       string     `json:"state"`
+	Established *time.Time `json:"established,omitempty"`
+	// Routes - the number of routes advertised to the peer
+	Routes    int    `json:"routes"`
+	LastError string `json:"lastError,omitempty"`
+}
+
+func (p PeerStatus) String() string {
+	j, err := json.Marshal(p)
+	if err != nil {
+		return string("cant't marshal: " + reflect.TypeOf(p).String() + ", to json string, err: " + err.Error())
+	}
+	return string(j)
+}
+
+// route - an address, and the pool it was allocated from
+type route struct {
+	vip  string
+	pool string
+}
+
+// Speaker advertises the addresses of the services to the peers of their'
+// pools, while it is enabled
+type Speaker struct {
+	// sessions - the sessions with the peers of each pool
+	sessions map[string][]*session
+	// attrs - the path attributes of the routes of each pool
+	attrs map[string]attributes
+
+	lock sync.Mutex
+	// routes - the address of each service, by service key
+	routes map[string]route
+	// enabled - whether or not the routes are advertised
+	enabled bool
+}
+
+// NewSpeaker creates a disabled speaker for the configuration
+func NewSpeaker(cfg *Config) *Speaker {
+	s := &Speaker{
+		sessions: make(map[string][]*session),
+		attrs:    make(map[string]attributes),
+		routes:   make(map[string]route),
+	}
+	routerID := net.ParseIP(cfg.RouterID)
+	for pool, poolCfg := range cfg.Pools {
+		communities, _ := parseCommunities(poolCfg.Communities)
+		s.attrs[pool] = attributes{communities: communities, localPref: poolCfg.LocalPref}
+		for _, peer := range poolCfg.Peers {
+			s.sessions[pool] = append(s.sessions[pool], newSession(pool, peer, cfg.LocalASN, routerID))
+		}
+	}
+	return s
+}
+
+// Run maintains the sessions with the peers until stopCh is closed, when
+// every route is withdrawn and the sessions are closed
+func (s *Speaker) Run(stopCh <-chan struct{}) {
+	var wg sync.WaitGroup
+	for _, sessions := range s.sessions {
+		for _, sess := range sessions {
+			wg.Add(1)
+			go func(sess *session) {
+				defer wg.Done()
+				sess.run(stopCh)
+			}(sess)
+		}
+	}
+	wg.Wait()
+}
+
+// Advertise sets the address, from pool, of the service identified by key
+func (s *Speaker) Advertise(key, vip, pool string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	r := route{vip: vip, pool: pool}
+	if s.routes[key] == r {
+		return
+	}
+	if _, ok := s.sessions[pool]; !ok {
+		glog.V(3).Infof("bgp: no peers for pool %q, %s is not advertised", pool, vip)
+	}
+	s.routes[key] = r
+	s.update()
+}
+
+// Withdraw removes the address of the service identified by key
+func (s *Speaker) Withdraw(key string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if _, ok := s.routes[key]; !ok {
+		return
+	}
+	delete(s.routes, key)
+	s.update()
+}
+
+// SetEnabled advertises every address when enabled, e.g. while the data
+// plane is healthy, and withdraws them when disabled
+func (s *Speaker) SetEnabled(enabled bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.enabled == enabled {
+		return
+	}
+	if enabled {
+		glog.Infof("bgp: advertising routes")
+	} else {
+		glog.Warningf("bgp: withdrawing routes")
+	}
+	s.enabled = enabled
+	s.update()
+}
+
+// Status returns the state of the session with each peer, ordered by pool
+// and peer address
+func (s *Speaker) Status() []PeerStatus {
+	status := []PeerStatus{}
+	for _, sessions := range s.sessions {
+		for _, sess := range sessions {
+			status = append(status, sess.status())
+		}
+	}
+	sort.Sort(peerStatusByPool(status))
+	return status
+}
+
+// update sets the desired routes of every session
+func (s *Speaker) update() {
+	desired := make(map[string]map[string]attributes)
+	for pool := range s.sessions {
+		desired[pool] = make(map[string]attributes)
+	}
+	if s.enabled {
+		for _, r := range s.routes {
+			if routes, ok := desired[r.pool]; ok {
+				routes[r.vip] = s.attrs[r.pool]
+			}
+		}
+	}
+	for pool, sessions := range s.sessions {
+		for _, sess := range sessions {
+			sess.setRoutes(desired[pool])
+		}
+	}
+}
+
+type peerStatusByPool []PeerStatus
+
+func (p peerStatusByPool) Len() int      { return len(p) }
+func (p peerStatusByPool) Swap(i, j int) { p[i], p[j] = p[j], p[i] }
+func (p peerStatusByPool) Less(i, j int) bool {
+	if p[i].Pool != p[j].Pool {
+		return p[i].Pool < p[j].Pool
+	}
+	return p[i].Address < p[j].Address
+}
@@ -4,58 +4,132 @@ import (
 	"fmt"
 	"os"
 	"strings"
+	"time"
 
 	"github.com/golang/glog"
 	flag "github.com/spf13/pflag"
 )
 
 type config struct {
-	flagSet         *flag.FlagSet
-	kubeconfig      *string
-	proxy           *string
-	serviceName     *string
-	servicePool     *string
-	strictAffinity  *bool
-	antiAffinity    *bool
-	version         *bool
-	healthCheck     *bool
-	healthCheckPort *int
-	requirePort     *bool
+	flagSet           *flag.FlagSet
+	kubeconfig        *string
+	proxy             *string
+	serviceName       *string
+	servicePool       *string
+	strictAffinity    *bool
+	antiAffinity      *bool
+	version           *bool
+	healthCheck       *bool
+	healthCheckPort   *int
+	requirePort       *bool
+	templateDir       *string
+	backend           *string
+	dryRun            *bool
+	outputDir         *string
+	httpPort          *int
+	trafficMetrics    *bool
+	maxWatchAge       *time.Duration
+	nodeDrainGrace    *time.Duration
+	nodeReadyDelay    *time.Duration
+	nodeSelector      *string
+	adminPort         *int
+	adminToken        *string
+	strictAnnotations *bool
+	vipRanges         *[]string
+	vipConfigMap      *string
+	l2Interface       *string
+	l2Lease           *string
+	bgpConfig         *string
 }
 
 func newConfig() *config {
+	return newConfigForFlagSet(flag.CommandLine)
+}
+
+// newConfigForFlagSet defines LBEX's flags in fs
+func newConfigForFlagSet(fs *flag.FlagSet) *config {
 	return &config{
-		kubeconfig:      flag.String("kubeconfig", "", "absolute path to the kubeconfig file"),
-		proxy:           flag.String("proxy", "", "kubctl proxy server running at the given url"),
-		serviceName:     flag.String("service-name", "", "provide load balancing for the service-name - ONLY"),
-		servicePool:     flag.String("service-pool", "", "provide load balancing for services in --service-pool"),
-		strictAffinity:  flag.Bool("strict-affinity", false, "provide load balancing for services in --service-pool ONLY"),
-		antiAffinity:    flag.Bool("anti-affinity", false, "do not provide load balancing for services in --service-pool"),
-		version:         flag.Bool("version", false, "display version info and exit"),
-		healthCheck:     flag.Bool("health-check", true, "enable health checking for LBEX"),
-		healthCheckPort: flag.Int("health-port", 7331, "health check service port"),
-		requirePort:     flag.Bool("require-port", true, "makes the Service Specification annotation \"loadbalancer.lbex/port\" required"),
+		flagSet:           fs,
+		kubeconfig:        fs.String("kubeconfig", "", "absolute path to the kubeconfig file"),
+		proxy:             fs.String("proxy", "", "kubctl proxy server running at the given url"),
+		serviceName:       fs.String("service-name", "", "provide load balancing for the service-name - ONLY"),
+		servicePool:       fs.String("service-pool", "", "provide load balancing for services in --service-pool"),
+		strictAffinity:    fs.Bool("strict-affinity", false, "provide load balancing for services in --service-pool ONLY"),
+		antiAffinity:      fs.Bool("anti-affinity", false, "do not provide load balancing for services in --service-pool"),
+		version:           fs.Bool("version", false, "display version info and exit"),
+		healthCheck:       fs.Bool("health-check", true, "enable health checking for LBEX"),
+		healthCheckPort:   fs.Int("health-port", 7331, "health check service port"),
+		requirePort:       fs.Bool("require-port", true, "makes the Service Specification annotation \"loadbalancer.lbex/port\" required"),
+		templateDir:       fs.String("template-dir", "", "directory of NGINX template overrides (nginx.conf.tmpl, stream.tmpl, http.tmpl)"),
+		backend:           fs.String("backend", "nginx", "load balancer data plane: nginx, haproxy or proxy"),
+		dryRun:            fs.Bool("dry-run", false, "write configuration to --output-dir, without starting or reloading the data plane"),
+		outputDir:         fs.String("output-dir", "", "directory that --dry-run writes configuration to"),
+		httpPort:          fs.Int("http-port", 7332, "port for the LBEX HTTP endpoints (/metrics, /healthz, /readyz)"),
+		trafficMetrics:    fs.Bool("traffic-metrics", false, "collect per-service traffic metrics from the NGINX stream access log"),
+		adminPort:         fs.Int("admin-port", 0, "port for the read-only admin API, disabled when 0"),
+		adminToken:        fs.String("admin-token", "", "bearer token required by the admin API, if set"),
+		maxWatchAge:       fs.Duration("max-watch-age", 5*time.Minute, "/readyz fails when no API server watch event has been received for this long"),
+		nodeSelector:      fs.String("node-selector", "", "label selector of the nodes that are eligible for node upstreams, unless a service's node-selector annotation overrides it (default all nodes)"),
+		nodeDrainGrace:    fs.Duration("node-drain-grace", time.Minute, "how long a cordoned, NoExecute tainted or excluded node is a backup upstream server before it is removed"),
+		nodeReadyDelay:    fs.Duration("node-ready-delay", 10*time.Second, "how long a change of a node's readiness must last before it is applied to the upstreams"),
+		vipRanges:         fs.StringSlice("vip-range", []string{}, "address pool for LoadBalancer services, [service-pool=]CIDR or first-last, may be repeated"),
+		vipConfigMap:      fs.String("vip-configmap", "kube-system/lbex-vips", "namespace/name of the ConfigMap that address allocations are stored in"),
+		l2Interface:       fs.String("l2-interface", "", "interface that the elected LBEX instance adds the --vip-range addresses to, and announces them on"),
+		l2Lease:           fs.String("l2-lease", "", "namespace/name of the ConfigMap that the L2 leader is elected by (default kube-system/lbex-l2-<service-pool>)"),
+		bgpConfig:         fs.String("bgp-config", "", "YAML or JSON file of the BGP peers that the --vip-range addresses are advertised to"),
+		strictAnnotations: fs.Bool("strict-annotations", false, "reject services with invalid annotation values, rather than using the default values"),
 	}
 }
 
 func (cfg *config) String() string {
 	return fmt.Sprintf("kubeconfig: %s, proxy: %s, service-name: %s, service-pool: %s, strict-affinity: %t, "+
-		"anti-affinity: %t, health-check: %t, health-check-port: %d, require-port: %t",
+		"anti-affinity: %t, health-check: %t, health-check-port: %d, require-port: %t, template-dir: %s, backend: %s, dry-run: %t, output-dir: %s, http-port: %d, traffic-metrics: %t, max-watch-age: %v, node-drain-grace: %v, node-ready-delay: %v, node-selector: %s, admin-port: %d, strict-annotations: %t, vip-range: %v, vip-configmap: %s, l2-interface: %s, l2-lease: %s, bgp-config: %s",
 		*cfg.kubeconfig, *cfg.proxy, *cfg.serviceName, *cfg.servicePool, *cfg.strictAffinity,
-		*cfg.antiAffinity, *cfg.healthCheck, *cfg.healthCheckPort, *cfg.requirePort)
+		*cfg.antiAffinity, *cfg.healthCheck, *cfg.healthCheckPort, *cfg.requirePort, *cfg.templateDir, *cfg.backend, *cfg.dryRun, *cfg.outputDir, *cfg.httpPort, *cfg.trafficMetrics, *cfg.maxWatchAge, *cfg.nodeDrainGrace, *cfg.nodeReadyDelay, *cfg.nodeSelector, *cfg.adminPort, *cfg.strictAnnotations, *cfg.vipRanges, *cfg.vipConfigMap, *cfg.l2Interface, *cfg.l2Lease, *cfg.bgpConfig)
 }
 
 var envSupport = map[string]bool{
-	"kubeconfig":      true,
-	"proxy":           true,
-	"service-name":    true,
-	"service-pool":    true,
-	"strict-affinity": true,
-	"anti-affinity":   true,
-	"version":         false,
-	"health-check":    true,
-	"health-port":     true,
-	"require-port":    true,
+	"kubeconfig":         true,
+	"proxy":              true,
+	"service-name":       true,
+	"service-pool":       true,
+	"strict-affinity":    true,
+	"anti-affinity":      true,
+	"version":            false,
+	"health-check":       true,
+	"health-port":        true,
+	"require-port":       true,
+	"template-dir":       true,
+	"backend":            true,
+	"dry-run":            true,
+	"output-dir":         true,
+	"http-port":          true,
+	"traffic-metrics":    true,
+	"max-watch-age":      true,
+	"node-drain-grace":   true,
+	"node-ready-delay":   true,
+	"node-selector":      true,
+	"admin-port":         true,
+	"admin-token":        true,
+	"strict-annotations": true,
+	"vip-range":          true,
+	"vip-configmap":      true,
+	"l2-interface":       true,
+	"l2-lease":           true,
+	"bgp-config":         true,
+}
+
+// secretFlags - flags whose values are never logged, or included in errors
+var secretFlags = map[string]bool{
+	"admin-token": true,
+}
+
+// displayValue returns the value of the named flag as it may be logged
+func displayValue(name, val string) string {
+	if secretFlags[name] {
+		return "<redacted>"
+	}
+	return val
 }
 
 func variableName(name string) string {
@@ -85,9 +159,14 @@ func (cfg *config) envParse() error {
 				if val != "" {
 					usedEnvKey[key] = true
 					if serr := cfg.flagSet.Set(f.Name, val); serr != nil {
-						err = fmt.Errorf("invalid value %q for %s: %v", val, key, serr)
+						if secretFlags[f.Name] {
+							// the flag's error may quote the value
+							err = fmt.Errorf("invalid value for %s", key)
+						} else {
+							err = fmt.Errorf("invalid value %q for %s: %v", val, key, serr)
+						}
 					}
-					glog.V(3).Infof("recognized and used environment variable %s=%s", key, val)
+					glog.V(3).Infof("recognized and used environment variable %s=%s", key, displayValue(f.Name, val))
 				}
 			}
 		}
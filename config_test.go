@@ -0,0 +1,36 @@
+package main
+
+import (
+	"os"
+	"strings"
+	"testing"
+
+	flag "github.com/spf13/pflag"
+)
+
+func TestEnvParseSecrets(t *testing.T) {
+	os.Setenv("LBEX_ADMIN_TOKEN", "s3cret")
+	defer os.Unsetenv("LBEX_ADMIN_TOKEN")
+	os.Setenv("LBEX_HTTP_PORT", "not-a-port")
+	defer os.Unsetenv("LBEX_HTTP_PORT")
+
+	cfg := newConfigForFlagSet(flag.NewFlagSet("test", flag.ContinueOnError))
+	err := cfg.envParse()
+	if *cfg.adminToken != "s3cret" {
+		t.Errorf("admin token: got %q from the environment", *cfg.adminToken)
+	}
+	// an invalid value of an ordinary flag is quoted
+	if err == nil || !strings.Contains(err.Error(), "not-a-port") {
+		t.Errorf("got error %v, want the invalid value quoted", err)
+	}
+
+	if got := displayValue("admin-token", "s3cret"); strings.Contains(got, "s3cret") {
+		t.Errorf("admin token displayed as %q", got)
+	}
+	if got := displayValue("http-port", "7332"); got != "7332" {
+		t.Errorf("http port displayed as %q, want 7332", got)
+	}
+	if strings.Contains(cfg.String(), "s3cret") {
+		t.Errorf("admin token included in the configuration string")
+	}
+}
@@ -3,13 +3,18 @@ package main
 import (
 	"errors"
 	"fmt"
-	"runtime"
 	"sort"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/golang/glog"
 	"github.com/sostheim/lbex/annotations"
+	"github.com/sostheim/lbex/backend"
+	"github.com/sostheim/lbex/bgp"
+	"github.com/sostheim/lbex/election"
+	"github.com/sostheim/lbex/ipam"
+	"github.com/sostheim/lbex/l2"
 	"github.com/sostheim/lbex/nginx"
 
 	"k8s.io/client-go/kubernetes"
@@ -46,37 +51,61 @@ type lbExController struct {
 	nodesLWC   *lwController
 	nodesStore cache.Store
 	nodesQueue *TaskQueue
+	// drains - when each draining node started to drain
+	drains *nodeDrains
+	// readiness - the readiness of each node applied to the upstreams
+	readiness *nodeReadiness
 
 	stopCh chan struct{}
 
-	cfgtor *nginx.Configurator
-}
+	// the load balancer data plane
+	lb backend.Backend
 
-func newLbExController(clientset *kubernetes.Clientset, cfg *config) *lbExController {
-	// local testing -> no actual NGINX instance
-	cfgType := nginx.StreamCfg
-	if runtime.GOOS == "darwin" {
-		cfgType = nginx.LocalCfg
-	}
+	// allocator of LoadBalancer service addresses, nil without --vip-range
+	vips *ipam.Allocator
+
+	// L2 announcement of the allocated addresses by the elected instance, nil
+	// without --l2-interface
+	announcer *l2.Announcer
+	elector   *election.Elector
 
-	// Create and start the NGINX LoadBalancer
-	ngxc, _ := nginx.NewNginxController(cfgType, "/etc/nginx/", *cfg.healthCheck, *cfg.healthCheckPort)
-	ngxc.Start()
+	// BGP advertisement of the allocated addresses, nil without --bgp-config
+	speaker *bgp.Speaker
 
-	configtor := nginx.NewConfigurator(ngxc)
+	// the goroutines that must stop before LBEX exits
+	running sync.WaitGroup
+
+	// last reported configuration error, and annotation value substitutions,
+	// by service key
+	serviceErrors        map[string]string
+	serviceSubstitutions map[string]string
+	errLock              sync.Mutex
+
+	// last service spec applied to the backend, by service key
+	serviceSpecs map[string]*nginx.ServiceSpec
+	specLock     sync.RWMutex
+}
 
+func newLbExController(clientset *kubernetes.Clientset, cfg *config, lb backend.Backend, vips *ipam.Allocator) *lbExController {
 	// create external loadbalancer controller struct
 	lbexc := lbExController{
 		clientset: clientset,
 		stopCh:    make(chan struct{}),
 		cfg:       cfg,
-		cfgtor:    configtor,
+		lb:        lb,
+		vips:      vips,
+		drains:    newNodeDrains(*cfg.nodeDrainGrace),
+		readiness: newNodeReadiness(*cfg.nodeReadyDelay),
+
+		serviceErrors:        make(map[string]string),
+		serviceSubstitutions: make(map[string]string),
+		serviceSpecs:         make(map[string]*nginx.ServiceSpec),
 	}
-	lbexc.nodesQueue = NewTaskQueue(lbexc.syncNodes)
+	lbexc.nodesQueue = NewTaskQueue("nodes", lbexc.syncNodes)
 	lbexc.nodesLWC = newNodesListWatchControllerForClientset(&lbexc)
-	lbexc.servicesQueue = NewTaskQueue(lbexc.syncServices)
+	lbexc.servicesQueue = NewTaskQueue("services", lbexc.syncServices)
 	lbexc.servicesLWC = newServicesListWatchControllerForClientset(&lbexc)
-	lbexc.endpointsQueue = NewTaskQueue(lbexc.syncEndpoints)
+	lbexc.endpointsQueue = NewTaskQueue("endpoints", lbexc.syncEndpoints)
 	lbexc.endpointsLWC = newEndpointsListWatchControllerForClientset(&lbexc)
 
 	return &lbexc
@@ -94,7 +123,53 @@ func (lbex *lbExController) run() {
 	time.Sleep(5 * time.Second)
 	go lbex.servicesLWC.controller.Run(lbex.stopCh)
 	go lbex.servicesQueue.Run(time.Second, lbex.stopCh)
+	go lbex.releaseStaleVIPs()
+
+	lbex.running.Add(1)
+	go func() {
+		defer lbex.running.Done()
+		lbex.lb.Run(lbex.enqueueAllServices, lbex.stopCh)
+	}()
+
+	if lbex.elector != nil {
+		lbex.running.Add(1)
+		go func() {
+			defer lbex.running.Done()
+			lbex.elector.Run(lbex.stopCh)
+		}()
+	}
+
+	if lbex.speaker != nil {
+		go lbex.advertiseWhileHealthy()
+		lbex.running.Add(1)
+		go func() {
+			defer lbex.running.Done()
+			lbex.speaker.Run(lbex.stopCh)
+		}()
+	}
+}
+
+// shutdown stops the controller, and waits up to timeout for the data plane
+// to stop and for any L2 addresses and BGP routes to be withdrawn
+func (lbex *lbExController) shutdown(timeout time.Duration) {
+	close(lbex.stopCh)
+	done := make(chan struct{})
+	go func() {
+		lbex.running.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		glog.Warningf("shutdown: timed out after %v", timeout)
+	}
+}
 
+// enqueueAllServices queues every known service for a configuration update
+func (lbex *lbExController) enqueueAllServices() {
+	for _, obj := range lbex.servicesStore.List() {
+		lbex.servicesQueue.Enqueue(obj)
+	}
 }
 
 func (lbex *lbExController) enqueuServiceObjects(keys []string) {
@@ -124,28 +199,19 @@ func (lbex *lbExController) syncNodes(obj interface{}) error {
 	affectedServices := []string{}
 	if !exists {
 		glog.V(2).Infof("deleting node: %v\n", key)
-		affectedServices = lbex.cfgtor.DeleteNode(key)
+		lbex.drains.clear(key)
+		lbex.readiness.clear(key)
+		affectedServices = lbex.lb.DeleteNode(key)
 	} else {
-		err = ValidateNodeObjectType(storeObj)
-		if err != nil {
-			glog.V(3).Infof("failed ValidateNodeObjectType(): err: %v", err)
-			return nil
-		}
-		addrs, err := GetNodeAddress(storeObj)
+		node, err := newNode(key, storeObj)
 		if err != nil {
-			glog.V(3).Infof("failed GetNodeAddress(): err: %v", err)
+			glog.V(3).Infof("%v", err)
 			return nil
 		}
-		active := IsNodeScheduleable(storeObj)
-		node := nginx.Node{
-			Name:       key,
-			Hostname:   addrs.Hostname,
-			ExternalIP: addrs.ExternalIP,
-			InternalIP: addrs.InternalIP,
-			Active:     active,
-		}
+		lbex.applyDrainGrace(&node)
+		lbex.applyReadyDelay(&node)
 		glog.V(3).Infof("add/update node: %s", key)
-		affectedServices = lbex.cfgtor.AddOrUpdateNode(node)
+		affectedServices = lbex.lb.AddOrUpdateNode(node)
 	}
 	glog.V(4).Infof("queuing updates for affected services: %v", affectedServices)
 
@@ -157,6 +223,29 @@ func (lbex *lbExController) syncNodes(obj interface{}) error {
 	return nil
 }
 
+// newNode creates the backend's model of the node object
+func newNode(key string, obj interface{}) (nginx.Node, error) {
+	if err := ValidateNodeObjectType(obj); err != nil {
+		return nginx.Node{}, fmt.Errorf("failed ValidateNodeObjectType(): err: %v", err)
+	}
+	addrs, err := GetNodeAddress(obj)
+	if err != nil {
+		return nginx.Node{}, fmt.Errorf("failed GetNodeAddress(): err: %v", err)
+	}
+	return nginx.Node{
+		Name:         key,
+		Hostname:     addrs.Hostname,
+		ExternalIP:   addrs.ExternalIP,
+		InternalIP:   addrs.InternalIP,
+		ExternalIPv6: addrs.ExternalIPv6,
+		InternalIPv6: addrs.InternalIPv6,
+		Labels:       GetNodeLabels(obj),
+		Active:       !IsNodeDraining(obj),
+		Draining:     IsNodeDraining(obj),
+		Ready:        IsNodeReady(obj),
+	}, nil
+}
+
 func (lbex *lbExController) syncServices(obj interface{}) error {
 	if lbex.servicesQueue.IsShuttingDown() {
 		return nil
@@ -175,7 +264,17 @@ func (lbex *lbExController) syncServices(obj interface{}) error {
 	conf := strings.Replace(key, "/", "-", -1)
 	if !exists {
 		glog.V(2).Infof("syncServices: deletion check for service: %v\n", key)
-		lbex.cfgtor.DeleteConfiguration(conf, nginx.StreamCfg)
+		lbex.errLock.Lock()
+		delete(lbex.serviceErrors, key)
+		delete(lbex.serviceSubstitutions, key)
+		lbex.errLock.Unlock()
+		lbex.specLock.Lock()
+		delete(lbex.serviceSpecs, key)
+		lbex.specLock.Unlock()
+		lbex.releaseVIP(key, nil)
+		if err := lbex.lb.DeleteService(key, conf); err != nil {
+			return err
+		}
 	} else {
 		err = ValidateServiceObjectType(storeObj)
 		if err != nil {
@@ -184,45 +283,166 @@ func (lbex *lbExController) syncServices(obj interface{}) error {
 		}
 		service, _ := storeObj.(*v1.Service)
 
-		topo := lbex.getServiceNetworkTopo(key)
-		if topo == nil || len(topo) == 0 {
+		vip, err := lbex.assignVIP(key, service)
+		if err != nil {
+			glog.Errorf("syncServices: %s: %v", key, err)
+			lbex.reportServiceError(service, reasonVIPFailed, err)
+			return err
+		}
+
+		svcSpec, err := lbex.newServiceSpec(key, service)
+		if err != nil {
+			// Not requeued, as for a rejected configuration.  Any current
+			// configuration of the service is left in place.
+			glog.Errorf("syncServices: %s: %v", key, err)
+			lbex.reportServiceError(service, reasonInvalidAnnotations, err)
+			return nil
+		}
+		if svcSpec == nil {
 			glog.V(4).Infof("syncServices: %s: not an lbex managed service", key)
 			return nil
 		}
+		lbex.reportSubstitutions(service, svcSpec.Substitutions)
+		if err := lbex.lb.Capabilities().Check(svcSpec); err != nil {
+			// Not requeued, as for invalid annotations.  Applying the rest of
+			// the service would quietly drop what the backend can't handle.
+			glog.Errorf("syncServices: %s: %s: %v", key, lbex.lb.Name(), err)
+			lbex.reportServiceError(service, reasonUnsupported, err)
+			return nil
+		}
+		svcSpec.ListenAddress = vip
+		glog.V(3).Infof("syncServices: add/update service: %s", key)
+		lbex.specLock.Lock()
+		lbex.serviceSpecs[key] = svcSpec
+		lbex.specLock.Unlock()
+		if err := lbex.lb.AddOrUpdateService(svcSpec); err != nil {
+			glog.Errorf("syncServices: %s: %v", key, err)
+			if backend.IsRejected(err) {
+				// Not requeued: the same spec would only be rejected again, a
+				// change to the service or its' endpoints will trigger a retry.
+				lbex.reportServiceError(service, reasonConfigRejected, err)
+				return nil
+			}
+			lbex.reportServiceError(service, reasonConfigFailed, err)
+			return err
+		}
+		lbex.reportServiceOK(service)
+	}
+	return nil
+}
 
-		val, _ := annotations.GetOptionalStringAnnotation(annotations.LBEXAlgorithmKey, service)
-		algo := nginx.ValidateAlgorithm(val)
-
-		val, _ = annotations.GetOptionalStringAnnotation(annotations.LBEXUpstreamType, service)
-		ups := nginx.ValidateUpstreamType(val)
+// newServiceSpec creates the service model for the backend, from the service's
+// annotations and network topology.  It returns nil if the service is not
+// managed by LBEX.  Invalid annotation values are replaced by their' default
+// values, and listed in the spec's Substitutions, unless --strict-annotations
+// is set, in which case an error is returned.
+func (lbex *lbExController) newServiceSpec(key string, service *v1.Service) (*nginx.ServiceSpec, error) {
+	topo := lbex.getServiceNetworkTopo(key)
+	if topo == nil || len(topo) == 0 {
+		return nil, nil
+	}
 
-		svcSpec := &nginx.ServiceSpec{
-			Service:      service,
-			Key:          key,
-			Algorithm:    algo,
-			ClusterIP:    service.Spec.ClusterIP,
-			ConfigName:   conf,
-			UpstreamType: ups,
+	invalid := annotations.InvalidValues(service, nginx.LintOptions(false, *lbex.cfg.nodeSelector, lbex.vips != nil))
+	if len(invalid) > 0 && *lbex.cfg.strictAnnotations {
+		reasons := []string{}
+		for _, finding := range invalid {
+			reasons = append(reasons, fmt.Sprintf("%s: %q, %s", finding.Key, finding.Value, finding.Message))
 		}
-		for _, elem := range topo {
-			for _, ep := range elem.Endpoints {
-				svcTarget := nginx.Target{
-					ServicePort: ep.ServicePort,
-					NodeIP:      ep.NodeIP,
-					NodeName:    ep.NodeName,
-					NodePort:    ep.NodePort,
-					PortName:    ep.PortName,
-					PodIP:       ep.PodIP,
-					PodPort:     ep.PodPort,
-					Protocol:    ep.Protocol,
-				}
-				svcSpec.Topology = append(svcSpec.Topology, svcTarget)
+		return nil, fmt.Errorf("invalid annotation values: %s", strings.Join(reasons, "; "))
+	}
+
+	val, _ := annotations.GetOptionalStringAnnotation(annotations.LBEXAlgorithmKey, service)
+	algo := nginx.ValidateAlgorithm(val)
+
+	val, _ = annotations.GetOptionalStringAnnotation(annotations.LBEXUpstreamType, service)
+	ups := nginx.ValidateUpstreamType(val)
+
+	nodeSelector := *lbex.cfg.nodeSelector
+	if val, ok := annotations.GetOptionalStringAnnotation(annotations.LBEXNodeSelector, service); ok {
+		nodeSelector = nginx.ValidateNodeSelector(val, nodeSelector)
+	}
+
+	svcSpec := &nginx.ServiceSpec{
+		Service:   service,
+		Key:       key,
+		Algorithm: algo,
+		ClusterIP: service.Spec.ClusterIP,
+		// some-namespace/some-service -> some-namespace-some-service
+		ConfigName:    strings.Replace(key, "/", "-", -1),
+		UpstreamType:  ups,
+		NodeSelector:  nodeSelector,
+		Substitutions: invalid,
+	}
+	for _, elem := range topo {
+		for _, ep := range elem.Endpoints {
+			svcTarget := nginx.Target{
+				ServicePort: ep.ServicePort,
+				NodeIP:      ep.NodeIP,
+				NodeName:    ep.NodeName,
+				NodePort:    ep.NodePort,
+				PortName:    ep.PortName,
+				PodIP:       ep.PodIP,
+				PodPort:     ep.PodPort,
+				Protocol:    ep.Protocol,
 			}
+			svcSpec.Topology = append(svcSpec.Topology, svcTarget)
 		}
-		glog.V(3).Infof("syncServices: add/update service: %s", key)
-		lbex.cfgtor.AddOrUpdateService(svcSpec)
 	}
-	return nil
+	return svcSpec, nil
+}
+
+// reportSubstitutions logs each default value that replaced an invalid
+// annotation value of the service, and records a warning event for them,
+// unless the same substitutions have already been reported.
+func (lbex *lbExController) reportSubstitutions(service *v1.Service, substitutions []annotations.Finding) {
+	key := service.Namespace + "/" + service.Name
+	msgs := []string{}
+	for _, sub := range substitutions {
+		glog.Warningf("service %s: annotation %s has an invalid value: %q, using the default: %s", key, sub.Key, sub.Value, sub.Default)
+		msgs = append(msgs, fmt.Sprintf("%s: invalid value %q replaced by the default: %s", sub.Key, sub.Value, sub.Default))
+	}
+	msg := strings.Join(msgs, "; ")
+
+	lbex.errLock.Lock()
+	last := lbex.serviceSubstitutions[key]
+	if msg == "" {
+		delete(lbex.serviceSubstitutions, key)
+	} else {
+		lbex.serviceSubstitutions[key] = msg
+	}
+	lbex.errLock.Unlock()
+
+	if msg != "" && msg != last {
+		lbex.recordServiceEvent(service, v1.EventTypeWarning, reasonAnnotationDefaulted, msg)
+	}
+}
+
+// reportServiceError records a warning event for the service's failure,
+// unless the same failure has already been reported.
+func (lbex *lbExController) reportServiceError(service *v1.Service, reason string, err error) {
+	key := service.Namespace + "/" + service.Name
+	lbex.errLock.Lock()
+	last, reported := lbex.serviceErrors[key]
+	lbex.serviceErrors[key] = err.Error()
+	lbex.errLock.Unlock()
+
+	if !reported || last != err.Error() {
+		lbex.recordServiceEvent(service, v1.EventTypeWarning, reason, err.Error())
+	}
+}
+
+// reportServiceOK records a normal event for a service that has recovered
+// from a previously reported failure.
+func (lbex *lbExController) reportServiceOK(service *v1.Service) {
+	key := service.Namespace + "/" + service.Name
+	lbex.errLock.Lock()
+	_, reported := lbex.serviceErrors[key]
+	delete(lbex.serviceErrors, key)
+	lbex.errLock.Unlock()
+
+	if reported {
+		lbex.recordServiceEvent(service, v1.EventTypeNormal, reasonConfigured, "load balancer configuration applied")
+	}
 }
 
 func (lbex *lbExController) syncEndpoints(obj interface{}) error {
@@ -372,27 +592,13 @@ func (lbex *lbExController) getServiceNetworkTopo(key string) (targets []Service
 	if err != nil || !exists {
 		return nil
 	}
-	if !lbex.baseCheck(obj) {
+	selection := lbex.selectService(obj)
+	if !selection.Selected {
+		glog.V(4).Infof("getService: service: %s, not selected: %s", key, selection.Reason)
 		return nil
 	}
 	service, _ := obj.(*v1.Service)
-
 	serviceName, _ := GetServiceName(obj)
-	if *lbex.cfg.serviceName != "" && *lbex.cfg.serviceName != serviceName {
-		glog.V(3).Infof("getService: ignoring non-matching service name: %s", serviceName)
-		return nil
-	}
-
-	var pool string
-	if val, ok := annotations.GetOptionalStringAnnotation(annotations.LBEXPoolKey, service); ok {
-		pool = val
-	}
-
-	if lbex.checkAffinity(pool) == false {
-		glog.V(3).Infof("getService: service: %s, with pool selector: %s eliminate by affinity check",
-			serviceName, pool)
-		return nil
-	}
 
 	var host string
 	if val, ok := annotations.GetOptionalStringAnnotation(annotations.LBEXHostKey, service); ok {
@@ -404,7 +610,7 @@ func (lbex *lbExController) getServiceNetworkTopo(key string) (targets []Service
 
 		endpoints = lbex.getEndpoints(service, &servicePort)
 		if len(endpoints) == 0 {
-			glog.V(3).Infof("getService: no endpoints found for service %s, port %+d", service.Name, servicePort)
+			glog.V(3).Infof("getService: no endpoints found for service %s, port %d", service.Name, servicePort.Port)
 			continue
 		}
 		backendPort, _ := GetServicePortTargetPortInt(&servicePort)
@@ -426,6 +632,56 @@ func (lbex *lbExController) getServiceNetworkTopo(key string) (targets []Service
 	return
 }
 
+// serviceSelection - whether or not this LBEX instance load balances a
+// service, and why
+type serviceSelection struct {
+	Key      string
+	Selected bool
+	Pool     string
+	Reason   string
+}
+
+// selectService applies the load balancer class and port annotation checks,
+// --service-name, and the service pool affinity rules to the service
+func (lbex *lbExController) selectService(obj interface{}) serviceSelection {
+	selection := serviceSelection{}
+	selection.Key, _ = keyFunc(obj)
+
+	if filterObject(obj) {
+		selection.Reason = "services in the kube-system namespace are not load balanced"
+		return selection
+	}
+	if !lbex.baseCheck(obj) {
+		selection.Reason = "not an LBEX service: the load balancer class annotation, or a valid port annotation, is missing"
+		return selection
+	}
+	service, _ := obj.(*v1.Service)
+
+	if *lbex.cfg.serviceName != "" && *lbex.cfg.serviceName != service.Name {
+		selection.Reason = "service name does not match --service-name: " + *lbex.cfg.serviceName
+		return selection
+	}
+
+	if val, ok := annotations.GetOptionalStringAnnotation(annotations.LBEXPoolKey, service); ok {
+		selection.Pool = val
+	}
+	if !lbex.checkAffinity(selection.Pool) {
+		rule := "affinity"
+		if *lbex.cfg.strictAffinity {
+			rule = "strict affinity"
+		} else if *lbex.cfg.antiAffinity {
+			rule = "anti-affinity"
+		}
+		selection.Reason = fmt.Sprintf("service pool %q eliminated by the %s rule for --service-pool %q",
+			selection.Pool, rule, *lbex.cfg.servicePool)
+		return selection
+	}
+
+	selection.Selected = true
+	selection.Reason = "selected"
+	return selection
+}
+
 // checkAffinity returns true or false depending on wether the affinity or
 // anti-affinity rules are satisfied.
 func (lbex *lbExController) checkAffinity(pool string) bool {
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/sostheim/lbex/annotations"
+	"github.com/sostheim/lbex/backend"
+	"github.com/sostheim/lbex/ipam"
+	"github.com/sostheim/lbex/nginx"
+	flag "github.com/spf13/pflag"
+
+	v1 "k8s.io/client-go/pkg/api/v1"
+	"k8s.io/client-go/pkg/util/intstr"
+	"k8s.io/client-go/tools/cache"
+)
+
+// newTestController returns a controller driving lb, without a clientset, so
+// that services are synced straight from its' stores
+func newTestController(lb backend.Backend) *lbExController {
+	cfg := newConfigForFlagSet(flag.NewFlagSet("test", flag.ContinueOnError))
+	lbex := &lbExController{
+		cfg:                  cfg,
+		lb:                   lb,
+		drains:               newNodeDrains(*cfg.nodeDrainGrace),
+		readiness:            newNodeReadiness(*cfg.nodeReadyDelay),
+		endpointStore:        cache.NewStore(keyFunc),
+		servicesStore:        cache.NewStore(keyFunc),
+		nodesStore:           cache.NewStore(keyFunc),
+		serviceErrors:        make(map[string]string),
+		serviceSubstitutions: make(map[string]string),
+		serviceSpecs:         make(map[string]*nginx.ServiceSpec),
+	}
+	lbex.servicesQueue = NewTaskQueue("services", lbex.syncServices)
+	return lbex
+}
+
+// addTestService adds the LBEX service ns/web, with the given annotations,
+// and its' endpoints, a pod on node n1 for each of the ports
+func addTestService(t *testing.T, lbex *lbExController, ann map[string]string, ports ...v1.ServicePort) {
+	ann[annotations.LBEXClassKey] = annotations.LBEXClassKeyValue
+	for _, port := range ports {
+		ann[annotations.LBEXPortAnnotationBase+port.Name] = strconv.Itoa(int(port.Port))
+	}
+	service := &v1.Service{
+		ObjectMeta: v1.ObjectMeta{Namespace: "ns", Name: "web", Annotations: ann},
+		Spec: v1.ServiceSpec{
+			Type:      v1.ServiceTypeNodePort,
+			ClusterIP: "10.96.0.10",
+			Ports:     ports,
+		},
+	}
+	node := "n1"
+	subset := v1.EndpointSubset{Addresses: []v1.EndpointAddress{{IP: "10.244.1.5", NodeName: &node}}}
+	for _, port := range ports {
+		subset.Ports = append(subset.Ports, v1.EndpointPort{Name: port.Name, Port: port.TargetPort.IntVal, Protocol: port.Protocol})
+	}
+	endpoints := &v1.Endpoints{
+		ObjectMeta: v1.ObjectMeta{Namespace: "ns", Name: "web"},
+		Subsets:    []v1.EndpointSubset{subset},
+	}
+	if err := lbex.servicesStore.Add(service); err != nil {
+		t.Fatalf("add service: %v", err)
+	}
+	if err := lbex.endpointStore.Add(endpoints); err != nil {
+		t.Fatalf("add endpoints: %v", err)
+	}
+}
+
+var (
+	httpPort = v1.ServicePort{Name: "http", Protocol: v1.ProtocolTCP, Port: 80, TargetPort: intstr.FromInt(8080), NodePort: 30080}
+	dnsPort  = v1.ServicePort{Name: "dns", Protocol: v1.ProtocolUDP, Port: 53, TargetPort: intstr.FromInt(5353), NodePort: 30053}
+)
+
+func TestSyncServicesAddAndDelete(t *testing.T) {
+	recorder := backend.NewRecorder()
+	lbex := newTestController(recorder)
+	addTestService(t, lbex, map[string]string{annotations.LBEXAlgorithmKey: nginx.LeastConnections}, httpPort)
+
+	if err := lbex.syncServices("ns/web"); err != nil {
+		t.Fatalf("sync: %v", err)
+	}
+	svc, ok := recorder.Services["ns/web"]
+	if !ok {
+		t.Fatalf("service not applied to the backend")
+	}
+	if svc.Algorithm != nginx.LeastConnections || svc.ConfigName != "ns-web" || svc.UpstreamType != nginx.DefaultUpstreamType {
+		t.Errorf("got algorithm %s, config name %s, upstream type %s", svc.Algorithm, svc.ConfigName, svc.UpstreamType)
+	}
+	want := []nginx.Target{{
+		ServicePort: 80, NodeName: "n1", NodePort: 30080, PortName: "http",
+		PodIP: "10.244.1.5", PodPort: 8080, Protocol: "TCP",
+	}}
+	if !reflect.DeepEqual(svc.Topology, want) {
+		t.Errorf("topology: got %+v, want %+v", svc.Topology, want)
+	}
+
+	if err := lbex.servicesStore.Delete(svc.Service); err != nil {
+		t.Fatalf("delete service: %v", err)
+	}
+	if err := lbex.syncServices("ns/web"); err != nil {
+		t.Fatalf("sync after delete: %v", err)
+	}
+	if _, ok := recorder.Services["ns/web"]; ok || !reflect.DeepEqual(recorder.Deleted, []string{"ns/web"}) {
+		t.Errorf("service not deleted from the backend, deleted: %v", recorder.Deleted)
+	}
+}
+
+func TestSyncServicesUnsupported(t *testing.T) {
+	recorder := backend.NewRecorder()
+	recorder.Supported.UDP = false
+	recorder.Supported.Algorithms = []string{nginx.RoundRobin, nginx.LeastConnections}
+	lbex := newTestController(recorder)
+	addTestService(t, lbex, map[string]string{annotations.LBEXAlgorithmKey: nginx.LowestLatency}, httpPort, dnsPort)
+
+	if err := lbex.syncServices("ns/web"); err != nil {
+		t.Fatalf("sync: %v", err)
+	}
+	if _, ok := recorder.Services["ns/web"]; ok {
+		t.Errorf("unsupported service applied to the backend")
+	}
+	reported := lbex.serviceErrors["ns/web"]
+	for _, reason := range []string{"algorithm least_time", "UDP port 53"} {
+		if !strings.Contains(reported, reason) {
+			t.Errorf("reported error %q does not include %q", reported, reason)
+		}
+	}
+
+	// once supported, the service is applied and the error is cleared
+	recorder.Supported.UDP = true
+	recorder.Supported.Algorithms = nginx.SupportedAlgorithms
+	if err := lbex.syncServices("ns/web"); err != nil {
+		t.Fatalf("sync: %v", err)
+	}
+	if _, ok := recorder.Services["ns/web"]; !ok {
+		t.Errorf("service not applied to the backend")
+	}
+	if _, ok := lbex.serviceErrors["ns/web"]; ok {
+		t.Errorf("error still reported: %s", lbex.serviceErrors["ns/web"])
+	}
+}
+
+func TestSyncServicesDualStackAddress(t *testing.T) {
+	recorder := backend.NewRecorder()
+	lbex := newTestController(recorder)
+	pools, err := ipam.ParsePools([]string{"192.0.2.1-192.0.2.4"})
+	if err != nil {
+		t.Fatalf("ParsePools: %v", err)
+	}
+	lbex.vips = ipam.NewAllocator(pools, ipam.NewMemoryStore(nil))
+	addTestService(t, lbex, map[string]string{annotations.LBEXDualStack: "true"}, httpPort)
+	obj, _, _ := lbex.servicesStore.GetByKey("ns/web")
+	obj.(*v1.Service).Spec.Type = v1.ServiceTypeLoadBalancer
+
+	if err := lbex.syncServices("ns/web"); err != nil {
+		t.Fatalf("sync: %v", err)
+	}
+	svc, ok := recorder.Services["ns/web"]
+	if !ok {
+		t.Fatalf("service not applied to the backend")
+	}
+	if svc.ListenAddress != "192.0.2.1" {
+		t.Errorf("listen address: got %q, want 192.0.2.1", svc.ListenAddress)
+	}
+	if len(svc.Substitutions) != 1 || svc.Substitutions[0].Key != annotations.LBEXDualStack || svc.Substitutions[0].Default != "false" {
+		t.Errorf("substitutions: got %v, want dual-stack replaced by false", svc.Substitutions)
+	}
+	if reported := lbex.serviceSubstitutions["ns/web"]; !strings.Contains(reported, annotations.LBEXDualStack) {
+		t.Errorf("reported substitutions %q do not include %s", reported, annotations.LBEXDualStack)
+	}
+
+	// rejected in strict annotation mode
+	*lbex.cfg.strictAnnotations = true
+	delete(recorder.Services, "ns/web")
+	if err := lbex.syncServices("ns/web"); err != nil {
+		t.Fatalf("sync: %v", err)
+	}
+	if _, ok := recorder.Services["ns/web"]; ok {
+		t.Errorf("service applied to the backend in strict annotation mode")
+	}
+	if reported := lbex.serviceErrors["ns/web"]; !strings.Contains(reported, annotations.LBEXDualStack) {
+		t.Errorf("reported error %q does not include %s", reported, annotations.LBEXDualStack)
+	}
+}
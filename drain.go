@@ -0,0 +1,90 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+
+	"github.com/sostheim/lbex/nginx"
+)
+
+// nodeDrains tracks when each draining node started to drain, so that it is
+// only removed from the upstreams once its' grace period has passed.  The
+// start of a drain is only known for a node that was seen before it started
+// to drain.  A node that is already draining when it is first seen, e.g. when
+// LBEX restarts part way through a drain, has no grace period, so that a
+// restart never extends a drain.
+type nodeDrains struct {
+	grace time.Duration
+	lock  sync.Mutex
+	since map[string]time.Time
+	// seen - the nodes that have been seen while not draining
+	seen map[string]bool
+}
+
+func newNodeDrains(grace time.Duration) *nodeDrains {
+	return &nodeDrains{
+		grace: grace,
+		since: make(map[string]time.Time),
+		seen:  make(map[string]bool),
+	}
+}
+
+// remaining returns how much of the named node's grace period is left, and
+// whether or not the node has just started to drain
+func (d *nodeDrains) remaining(name string) (time.Duration, bool) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	since, ok := d.since[name]
+	if !ok {
+		if !d.seen[name] {
+			return 0, false
+		}
+		since = time.Now()
+		d.since[name] = since
+	}
+	return d.grace - time.Since(since), !ok
+}
+
+// undrained records that the named node is not draining
+func (d *nodeDrains) undrained(name string) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	delete(d.since, name)
+	d.seen[name] = true
+}
+
+// clear forgets the named node
+func (d *nodeDrains) clear(name string) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	delete(d.since, name)
+	delete(d.seen, name)
+}
+
+// applyDrainGrace keeps a draining node as an upstream candidate, which is
+// rendered as a backup server, until its' grace period has passed, when the
+// node is synced again and removed
+func (lbex *lbExController) applyDrainGrace(node *nginx.Node) {
+	if !node.Draining {
+		lbex.drains.undrained(node.Name)
+		return
+	}
+	remaining, started := lbex.drains.remaining(node.Name)
+	if remaining <= 0 {
+		glog.V(2).Infof("node %s: drain grace period has passed, or it was draining when first seen", node.Name)
+		return
+	}
+	node.Active = true
+	if started {
+		glog.Infof("node %s is draining, it is removed from the upstreams in %v", node.Name, remaining)
+		name := node.Name
+		time.AfterFunc(remaining, func() {
+			obj, exists, err := lbex.nodesStore.GetByKey(name)
+			if err == nil && exists {
+				lbex.nodesQueue.Enqueue(obj)
+			}
+		})
+	}
+}
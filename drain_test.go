@@ -0,0 +1,36 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNodeDrains(t *testing.T) {
+	d := newNodeDrains(time.Minute)
+
+	// draining when first seen, e.g. after a restart
+	if remaining, started := d.remaining("n1"); remaining > 0 || started {
+		t.Errorf("n1 draining when first seen: got %v remaining, started %t, want no grace period", remaining, started)
+	}
+
+	d.undrained("n2")
+	remaining, started := d.remaining("n2")
+	if remaining <= 0 || remaining > time.Minute || !started {
+		t.Errorf("n2 started to drain: got %v remaining, started %t, want the grace period", remaining, started)
+	}
+	if _, started := d.remaining("n2"); started {
+		t.Errorf("n2 still draining: got started")
+	}
+
+	// stops, then starts, draining again
+	d.undrained("n2")
+	if _, started := d.remaining("n2"); !started {
+		t.Errorf("n2 drained again: got not started")
+	}
+
+	// a deleted node is forgotten
+	d.clear("n2")
+	if remaining, _ := d.remaining("n2"); remaining > 0 {
+		t.Errorf("n2 after deletion: got %v remaining, want no grace period", remaining)
+	}
+}
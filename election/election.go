@@ -0,0 +1,230 @@
+// Package election elects a single active LBEX instance, among the instances
+// that share a lease.  The lease is an annotation of a ConfigMap, and changes
+// to it are serialized by the ConfigMap's resource version.
+package election
+
+import (
+	"encoding/json"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+
+	corev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	apierrors "k8s.io/client-go/pkg/api/errors"
+	"k8s.io/client-go/pkg/api/v1"
+	"k8s.io/client-go/pkg/util/wait"
+)
+
+// LeaseAnnotation - the ConfigMap annotation that holds the lease record
+const LeaseAnnotation = "loadbalancer.lbex/leader"
+
+// LeaseRecord - the current holder of the lease, and when it was last renewed
+type LeaseRecord struct {
+	HolderIdentity       string    `json:"holderIdentity"`
+	LeaseDurationSeconds int       `json:"leaseDurationSeconds"`
+	AcquireTime          time.Time `json:"acquireTime"`
+	RenewTime            time.Time `json:"renewTime"`
+}
+
+func (r LeaseRecord) String() string {
+	j, err := json.Marshal(r)
+	if err != nil {
+		return string("cant't marshal: " + reflect.TypeOf(r).String() + ", to json string, err: " + err.Error())
+	}
+	return string(j)
+}
+
+// Callbacks - called when this instance becomes, or stops being, the leader
+type Callbacks struct {
+	OnStartedLeading func()
+	OnStoppedLeading func()
+}
+
+// Elector acquires and renews the lease for its' identity
+type Elector struct {
+	client    corev1.ConfigMapsGetter
+	namespace string
+	name      string
+	identity  string
+
+	// leaseDuration - how long a lease is held without being renewed
+	leaseDuration time.Duration
+	// retryPeriod - how often the lease is renewed, or an attempt is made to
+	// acquire it
+	retryPeriod time.Duration
+	callbacks   Callbacks
+
+	lock sync.Mutex
+	// renewed - the time the lease was last renewed by this instance, zero
+	// when this instance is not the leader
+	renewed time.Time
+	// observed - the last lease record read
+	observed LeaseRecord
+}
+
+// NewElector creates an elector for the lease in the ConfigMap namespace/name.
+// The ConfigMap is created if it does not exist.
+func NewElector(client corev1.ConfigMapsGetter, namespace, name, identity string,
+	leaseDuration, retryPeriod time.Duration, callbacks Callbacks) *Elector {
+	return &Elector{
+		client:        client,
+		namespace:     namespace,
+		name:          name,
+		identity:      identity,
+		leaseDuration: leaseDuration,
+		retryPeriod:   retryPeriod,
+		callbacks:     callbacks,
+	}
+}
+
+// Run tries to acquire, and then renew, the lease until stopCh is closed, when
+// the lease is released if this instance holds it
+func (e *Elector) Run(stopCh <-chan struct{}) {
+	wait.Until(e.tryAcquireOrRenew, e.retryPeriod, stopCh)
+	e.release()
+}
+
+// IsLeader returns true if this instance holds the lease, and renewed it
+// recently enough that no other instance can have acquired it
+func (e *Elector) IsLeader() bool {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	return e.isLeader()
+}
+
+// Leader returns the identity of the current lease holder, as last observed
+func (e *Elector) Leader() string {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	return e.observed.HolderIdentity
+}
+
+func (e *Elector) isLeader() bool {
+	// leadership is given up before the lease expires, so that two instances
+	// never believe they are the leader at the same time
+	return !e.renewed.IsZero() && time.Since(e.renewed) < e.leaseDuration-e.retryPeriod
+}
+
+func (e *Elector) tryAcquireOrRenew() {
+	acquired := e.update()
+
+	e.lock.Lock()
+	wasLeader := !e.renewed.IsZero()
+	if acquired {
+		e.renewed = time.Now()
+	} else if wasLeader && !e.isLeader() {
+		e.renewed = time.Time{}
+	}
+	isLeader := !e.renewed.IsZero()
+	e.lock.Unlock()
+
+	if isLeader && !wasLeader {
+		glog.Infof("%s: became the leader for lease %s/%s", e.identity, e.namespace, e.name)
+		if e.callbacks.OnStartedLeading != nil {
+			e.callbacks.OnStartedLeading()
+		}
+	} else if !isLeader && wasLeader {
+		glog.Warningf("%s: lost the leadership of lease %s/%s", e.identity, e.namespace, e.name)
+		if e.callbacks.OnStoppedLeading != nil {
+			e.callbacks.OnStoppedLeading()
+		}
+	}
+}
+
+// update acquires or renews the lease, returning true on success
+func (e *Elector) update() bool {
+	now := time.Now()
+	cm, err := e.client.ConfigMaps(e.namespace).Get(e.name)
+	if apierrors.IsNotFound(err) {
+		cm = &v1.ConfigMap{ObjectMeta: v1.ObjectMeta{Name: e.name, Namespace: e.namespace}}
+	} else if err != nil {
+		glog.Errorf("failed to get lease %s/%s: %v", e.namespace, e.name, err)
+		return false
+	}
+
+	record := LeaseRecord{}
+	if value, ok := cm.Annotations[LeaseAnnotation]; ok {
+		if err := json.Unmarshal([]byte(value), &record); err != nil {
+			glog.Errorf("invalid lease %s/%s, replacing it: %v", e.namespace, e.name, err)
+			record = LeaseRecord{}
+		}
+	}
+	e.lock.Lock()
+	e.observed = record
+	e.lock.Unlock()
+
+	expires := record.RenewTime.Add(time.Duration(record.LeaseDurationSeconds) * time.Second)
+	if record.HolderIdentity != "" && record.HolderIdentity != e.identity && now.Before(expires) {
+		glog.V(4).Infof("lease %s/%s is held by %s", e.namespace, e.name, record.HolderIdentity)
+		return false
+	}
+
+	if record.HolderIdentity != e.identity {
+		record.AcquireTime = now
+	}
+	record.HolderIdentity = e.identity
+	record.LeaseDurationSeconds = int(e.leaseDuration / time.Second)
+	record.RenewTime = now
+	if err := e.write(cm, record); err != nil {
+		glog.V(2).Infof("failed to acquire or renew lease %s/%s: %v", e.namespace, e.name, err)
+		return false
+	}
+
+	e.lock.Lock()
+	e.observed = record
+	e.lock.Unlock()
+	return true
+}
+
+// release gives up the lease, so that another instance can acquire it
+// without waiting for it to expire
+func (e *Elector) release() {
+	e.lock.Lock()
+	wasLeader := !e.renewed.IsZero()
+	e.renewed = time.Time{}
+	e.lock.Unlock()
+	if !wasLeader {
+		return
+	}
+	if e.callbacks.OnStoppedLeading != nil {
+		e.callbacks.OnStoppedLeading()
+	}
+
+	cm, err := e.client.ConfigMaps(e.namespace).Get(e.name)
+	if err != nil {
+		glog.Errorf("failed to release lease %s/%s: %v", e.namespace, e.name, err)
+		return
+	}
+	record := LeaseRecord{}
+	json.Unmarshal([]byte(cm.Annotations[LeaseAnnotation]), &record)
+	if record.HolderIdentity != e.identity {
+		return
+	}
+	// an expired lease, of the minimum duration, is free to be acquired
+	record.LeaseDurationSeconds = 1
+	record.RenewTime = time.Now().Add(-time.Second)
+	if err := e.write(cm, record); err != nil {
+		glog.Errorf("failed to release lease %s/%s: %v", e.namespace, e.name, err)
+		return
+	}
+	glog.Infof("%s: released lease %s/%s", e.identity, e.namespace, e.name)
+}
+
+func (e *Elector) write(cm *v1.ConfigMap, record LeaseRecord) error {
+	value, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	if cm.Annotations == nil {
+		cm.Annotations = make(map[string]string)
+	}
+	cm.Annotations[LeaseAnnotation] = string(value)
+	if cm.ResourceVersion == "" {
+		_, err = e.client.ConfigMaps(e.namespace).Create(cm)
+	} else {
+		_, err = e.client.ConfigMaps(e.namespace).Update(cm)
+	}
+	return err
+}
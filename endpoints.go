@@ -36,7 +36,7 @@ func newEndpointsListWatchControllerForClientset(lbex *lbExController) *lwContro
 		UpdateFunc: endpointUpdatedFunc(lbex),
 	}
 
-	lbex.endpointStore, lwc.controller = cache.NewInformer(listWatch, &v1.Endpoints{}, resyncPeriod, eventHandler)
+	lbex.endpointStore, lwc.controller = cache.NewInformer(listWatch, &v1.Endpoints{}, resyncPeriod, recordInformerSyncs("endpoints", eventHandler))
 
 	return lwc
 }
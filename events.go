@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/golang/glog"
+
+	"k8s.io/client-go/pkg/api/unversioned"
+	v1 "k8s.io/client-go/pkg/api/v1"
+)
+
+const (
+	// lbexComponent - the event source component name
+	lbexComponent = "lbex"
+
+	// reasonConfigRejected - NGINX rejected the service's generated configuration
+	reasonConfigRejected = "ConfigurationRejected"
+	// reasonConfigFailed - the service's configuration could not be applied
+	reasonConfigFailed = "ConfigurationFailed"
+	// reasonVIPFailed - no load balancer address could be allocated to the
+	// service
+	reasonVIPFailed = "AddressAllocationFailed"
+	// reasonConfigured - the service's configuration was applied
+	reasonConfigured = "Configured"
+	// reasonInvalidAnnotations - the service was rejected for invalid
+	// annotation values, in strict annotation mode
+	reasonInvalidAnnotations = "InvalidAnnotations"
+	// reasonAnnotationDefaulted - default values replaced the service's
+	// invalid annotation values
+	reasonAnnotationDefaulted = "AnnotationDefaulted"
+	// reasonUnsupported - the service requires features that the backend
+	// does not support
+	reasonUnsupported = "UnsupportedByBackend"
+)
+
+// recordServiceEvent posts an event for the service, so that configuration
+// problems are visible with `kubectl describe service`.  Failing to post an
+// event is logged, but otherwise ignored.  A dry run makes no changes to the
+// cluster, so the event is only logged.
+func (lbex *lbExController) recordServiceEvent(service *v1.Service, eventType, reason, message string) {
+	if lbex.clientset == nil || service == nil {
+		return
+	}
+	if *lbex.cfg.dryRun {
+		glog.V(2).Infof("dry run, event %s for service %s/%s: %s", reason, service.Namespace, service.Name, message)
+		return
+	}
+
+	host, _ := os.Hostname()
+	now := unversioned.NewTime(time.Now())
+	event := &v1.Event{
+		ObjectMeta: v1.ObjectMeta{
+			Name:      fmt.Sprintf("%v.%x", service.Name, now.UnixNano()),
+			Namespace: service.Namespace,
+		},
+		InvolvedObject: v1.ObjectReference{
+			Kind:            "Service",
+			Namespace:       service.Namespace,
+			Name:            service.Name,
+			UID:             service.UID,
+			APIVersion:      "v1",
+			ResourceVersion: service.ResourceVersion,
+		},
+		Reason:         reason,
+		Message:        message,
+		Source:         v1.EventSource{Component: lbexComponent, Host: host},
+		FirstTimestamp: now,
+		LastTimestamp:  now,
+		Count:          1,
+		Type:           eventType,
+	}
+
+	if _, err := lbex.clientset.Core().Events(service.Namespace).Create(event); err != nil {
+		glog.Warningf("failed to record event %s for service %s/%s: %v", reason, service.Namespace, service.Name, err)
+	}
+}
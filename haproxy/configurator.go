@@ -0,0 +1,265 @@
+package haproxy
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/golang/glog"
+	"github.com/sostheim/lbex/nginx"
+)
+
+const (
+	// DefaultConfigFile - the HAProxy configuration file
+	DefaultConfigFile = "/etc/haproxy/haproxy.cfg"
+	defaultPidFile    = "/var/run/haproxy.pid"
+	defaultSocket     = "/var/run/haproxy.sock"
+)
+
+// balanceModes - maps nginx.SupportedAlgorithms onto HAProxy balance modes
+// https://cbonte.github.io/haproxy-dconv/1.8/configuration.html#4-balance
+var balanceModes = map[string]string{
+	"":                     "roundrobin",
+	nginx.RoundRobin:       "roundrobin",
+	nginx.LeastConnections: "leastconn",
+	nginx.SourceIPHash:     "source",
+}
+
+// SupportedAlgorithms - the subset of nginx.SupportedAlgorithms that map
+// directly on to an HAProxy balance mode.  HAProxy has no latency based
+// algorithm, services that require least_time are rejected by the controller.
+var SupportedAlgorithms = []string{
+	nginx.RoundRobin,
+	nginx.LeastConnections,
+	nginx.SourceIPHash,
+}
+
+// sections - the HAProxy sections generated for a single service
+type sections struct {
+	frontends []Frontend
+	backends  []Backend
+}
+
+// Configurator renders HAProxy frontends and backends from the service model.
+// The upstreams for each service are generated by an nginx.Configurator, so
+// the node, pod and cluster-ip upstream types resolve to exactly the same
+// servers for both data planes.
+type Configurator struct {
+	ctl      *Controller
+	model    *nginx.Configurator
+	config   Config
+	services map[string]sections
+	lock     sync.Mutex
+}
+
+// NewConfigurator creates a new Configurator
+func NewConfigurator(ctl *Controller, healthCheck bool, healthPort int) *Configurator {
+	return &Configurator{
+		ctl:   ctl,
+		model: nginx.NewConfigurator(nil),
+		config: Config{
+			PidFile:        defaultPidFile,
+			StatsSocket:    defaultSocket,
+			MaxConn:        4096,
+			ConnectTimeout: "60s",
+			ClientTimeout:  "10m",
+			ServerTimeout:  "10m",
+			HealthStatus:   healthCheck,
+			HealthPort:     healthPort,
+		},
+		services: make(map[string]sections),
+	}
+}
+
+// Start writes the initial configuration and starts HAProxy
+func (cfgtor *Configurator) Start() error {
+	cfgtor.lock.Lock()
+	defer cfgtor.lock.Unlock()
+	cfg := cfgtor.config
+	return cfgtor.ctl.Start(&cfg)
+}
+
+// State returns the node and service upstream state
+func (cfgtor *Configurator) State() *nginx.State {
+	return cfgtor.model.State()
+}
+
+// AddOrUpdateNode - add, update (including removing) the node from the set of
+// upstream candidates, returns the keys of the services that are affected.
+func (cfgtor *Configurator) AddOrUpdateNode(node nginx.Node) []string {
+	return cfgtor.model.AddOrUpdateNode(node)
+}
+
+// DeleteNode - removes the node (if it exists) from the set of upstream
+// candidates, returns the keys of the services that are affected.
+func (cfgtor *Configurator) DeleteNode(name string) []string {
+	return cfgtor.model.DeleteNode(name)
+}
+
+// AddOrUpdateService renders the service's frontends and backends, and commits
+// the complete configuration.  If HAProxy rejects it the service's previous
+// sections are retained.
+func (cfgtor *Configurator) AddOrUpdateService(svc *nginx.ServiceSpec) error {
+	streamCfg := cfgtor.model.GenerateStreamConfig(svc)
+
+	cfgtor.lock.Lock()
+	defer cfgtor.lock.Unlock()
+
+	previous, existed := cfgtor.services[svc.Key]
+	cfgtor.services[svc.Key] = generateSections(svc.ConfigName, streamCfg)
+
+	if err := cfgtor.commit(); err != nil {
+		if existed {
+			cfgtor.services[svc.Key] = previous
+		} else {
+			delete(cfgtor.services, svc.Key)
+		}
+		return err
+	}
+	return nil
+}
+
+// DeleteService removes the service's frontends and backends, and commits the
+// complete configuration
+func (cfgtor *Configurator) DeleteService(key, name string) error {
+	cfgtor.model.State().RemoveService(key)
+
+	cfgtor.lock.Lock()
+	defer cfgtor.lock.Unlock()
+
+	if _, ok := cfgtor.services[key]; !ok {
+		return nil
+	}
+	delete(cfgtor.services, key)
+	return cfgtor.commit()
+}
+
+// ServiceConfig returns the service's current frontends and backends
+func (cfgtor *Configurator) ServiceConfig(key, name string) (string, error) {
+	cfgtor.lock.Lock()
+	defer cfgtor.lock.Unlock()
+
+	svc, ok := cfgtor.services[key]
+	if !ok {
+		return "", fmt.Errorf("no configuration for service: %s", key)
+	}
+	content, err := cfgtor.ctl.RenderSections(&Config{Frontends: svc.frontends, Backends: svc.backends})
+	return string(content), err
+}
+
+// Validate checks the current configuration file
+func (cfgtor *Configurator) Validate() error {
+	return cfgtor.ctl.Validate()
+}
+
+// Reload seamlessly reloads HAProxy
+func (cfgtor *Configurator) Reload() error {
+	return cfgtor.ctl.Reload(cfgtor.config.PidFile)
+}
+
+// Healthy returns nil if the HAProxy master process is running
+func (cfgtor *Configurator) Healthy() error {
+	return cfgtor.ctl.Healthy(cfgtor.config.PidFile)
+}
+
+// ReloadStats returns the reload counters
+func (cfgtor *Configurator) ReloadStats() nginx.ReloadStats {
+	return cfgtor.ctl.ReloadStats()
+}
+
+// commit must be called with the lock held
+func (cfgtor *Configurator) commit() error {
+	cfg := cfgtor.config
+
+	keys := make([]string, 0, len(cfgtor.services))
+	for key := range cfgtor.services {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		cfg.Frontends = append(cfg.Frontends, cfgtor.services[key].frontends...)
+		cfg.Backends = append(cfg.Backends, cfgtor.services[key].backends...)
+	}
+
+	if err := cfgtor.ctl.Write(&cfg); err != nil {
+		return err
+	}
+	if err := cfgtor.ctl.Reload(cfg.PidFile); err != nil {
+		return fmt.Errorf("error reloading haproxy: %v", err)
+	}
+	return nil
+}
+
+// generateSections converts the stream configuration model for a service in
+// to HAProxy frontends and backends.  HAProxy has no UDP support, services with
+// UDP ports are rejected by the controller, so any UDP server here is an error.
+func generateSections(name string, streamCfg nginx.StreamNginxConfig) sections {
+	upstreams := make(map[string]nginx.StreamUpstream)
+	for _, upstream := range streamCfg.Upstreams {
+		upstreams[upstream.Name] = upstream
+	}
+
+	var result sections
+	for _, server := range streamCfg.Servers {
+		if server.Listen.UDP {
+			glog.Errorf("haproxy does not support UDP, skipping: %s port %s", name, server.Listen.Port)
+			continue
+		}
+		upstream, ok := upstreams[server.ProxyPassAddress]
+		if !ok {
+			glog.Warningf("no upstream %s for: %s port %s", server.ProxyPassAddress, name, server.Listen.Port)
+			continue
+		}
+
+		sectionName := upstream.Name
+		result.frontends = append(result.frontends, Frontend{
+			Name:    sectionName,
+			Bind:    bindAddress(server.Listen),
+			Backend: sectionName,
+		})
+		result.backends = append(result.backends, Backend{
+			Name:        sectionName,
+			Balance:     balanceMode(upstream.Algorithm),
+			Passthrough: server.ProxyPassthrough,
+			Servers:     generateServers(upstream.UpstreamServers),
+		})
+	}
+	return result
+}
+
+// bindAddress returns the bind address and port of the listener, all IPv4
+// addresses when the address is empty, and all IPv4 and IPv6 addresses for a
+// dual stack listener
+func bindAddress(listen nginx.StreamListen) string {
+	if listen.DualStack {
+		return net.JoinHostPort("::", listen.Port) + " v4v6"
+	}
+	return net.JoinHostPort(listen.Address, listen.Port)
+}
+
+func generateServers(upstreamServers []nginx.StreamUpstreamServer) []Server {
+	servers := make([]Server, 0, len(upstreamServers))
+	for i, us := range upstreamServers {
+		servers = append(servers, Server{
+			Name:    "srv" + strconv.Itoa(i),
+			Address: us.Address,
+			Weight:  us.Weight,
+			Backup:  us.Backup,
+			Down:    us.Down,
+		})
+	}
+	return servers
+}
+
+// balanceMode returns the HAProxy balance mode for an nginx algorithm
+func balanceMode(algorithm string) string {
+	mode, ok := balanceModes[strings.ToLower(algorithm)]
+	if !ok {
+		glog.Warningf("unsupported algorithm: %s, using roundrobin", algorithm)
+		return "roundrobin"
+	}
+	return mode
+}
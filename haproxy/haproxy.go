@@ -0,0 +1,333 @@
+package haproxy
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"embed"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"text/template"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/sostheim/lbex/nginx"
+)
+
+const (
+	configTemplateName = "haproxy.cfg.tmpl"
+	stagingSuffix      = ".staging"
+)
+
+// defaultTemplate - the HAProxy configuration template compiled in to the binary
+//
+//go:embed haproxy.cfg.tmpl
+var defaultTemplate embed.FS
+
+// Config describes the complete HAProxy configuration file
+type Config struct {
+	PidFile        string
+	StatsSocket    string
+	MaxConn        int
+	ConnectTimeout string
+	ClientTimeout  string
+	ServerTimeout  string
+	HealthStatus   bool
+	HealthPort     int
+	Frontends      []Frontend
+	Backends       []Backend
+}
+
+// Frontend describes an HAProxy frontend (a listener)
+// https://cbonte.github.io/haproxy-dconv/1.8/configuration.html#4
+type Frontend struct {
+	Name    string
+	Bind    string
+	Backend string
+}
+
+// Backend describes an HAProxy backend (an upstream group)
+type Backend struct {
+	Name        string
+	Balance     string
+	Passthrough bool
+	Servers     []Server
+}
+
+// Server describes a server line in an HAProxy backend
+type Server struct {
+	Name    string
+	Address string
+	Weight  string
+	Backup  bool
+	Down    bool
+}
+
+// Controller writes HAProxy's configuration file, starts and reloads HAProxy
+type Controller struct {
+	configFile string
+	local      bool
+	dryRun     bool
+	tmpl       *template.Template
+
+	lock sync.Mutex
+	// sha256 of the last configuration written
+	hash [sha256.Size]byte
+	// incremented by each configuration written
+	generation uint64
+	// the generation of the last successful reload
+	reloaded uint64
+	stats    nginx.ReloadStats
+}
+
+// NewController creates an HAProxy controller for the configuration file
+// configFile.  When local is true HAProxy is neither run nor configured, and
+// the generated configuration is only logged.  For a dry run the configuration
+// file is written, but HAProxy is never run, and the configuration is not
+// checked.
+func NewController(configFile string, local, dryRun bool) (*Controller, error) {
+	tmpl, err := template.New(configTemplateName).ParseFS(defaultTemplate, configTemplateName)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse template %s: %v", configTemplateName, err)
+	}
+	return &Controller{
+		configFile: configFile,
+		local:      local,
+		dryRun:     dryRun,
+		tmpl:       tmpl,
+	}, nil
+}
+
+// Start starts HAProxy in master-worker mode, so that reloads are seamless
+func (ctl *Controller) Start(cfg *Config) error {
+	if err := ctl.Write(cfg); err != nil {
+		return err
+	}
+	if ctl.local || ctl.dryRun {
+		glog.V(3).Info("Starting haproxy")
+		return nil
+	}
+	if err := shellOut("haproxy -W -D -f " + ctl.configFile + " -p " + cfg.PidFile); err != nil {
+		return fmt.Errorf("failed to start haproxy: %v", err)
+	}
+
+	// HAProxy is running the current configuration
+	ctl.lock.Lock()
+	defer ctl.lock.Unlock()
+	ctl.reloaded = ctl.generation
+	return nil
+}
+
+// Render returns the configuration file content for cfg
+func (ctl *Controller) Render(cfg *Config) ([]byte, error) {
+	var content bytes.Buffer
+	if err := ctl.tmpl.Execute(&content, cfg); err != nil {
+		return nil, fmt.Errorf("failed to execute template %v: %v", configTemplateName, err)
+	}
+	return content.Bytes(), nil
+}
+
+// RenderSections renders only the frontends and backends of cfg
+func (ctl *Controller) RenderSections(cfg *Config) ([]byte, error) {
+	var content bytes.Buffer
+	if err := ctl.tmpl.ExecuteTemplate(&content, "sections", cfg); err != nil {
+		return nil, fmt.Errorf("failed to execute template %v: %v", configTemplateName, err)
+	}
+	return content.Bytes(), nil
+}
+
+// Write renders cfg to a staging file, checks it with `haproxy -c`, and only
+// then atomically replaces the current configuration file.  An
+// InvalidConfigError is returned if HAProxy rejects the configuration, in
+// which case the current configuration file is unchanged.  Nothing is written
+// if the rendered configuration is unchanged.
+func (ctl *Controller) Write(cfg *Config) error {
+	content, err := ctl.Render(cfg)
+	if err != nil {
+		return err
+	}
+
+	hash := sha256.Sum256(content)
+	ctl.lock.Lock()
+	unchanged := ctl.generation > 0 && hash == ctl.hash
+	ctl.lock.Unlock()
+	if unchanged {
+		if _, err := os.Stat(ctl.configFile); err == nil || ctl.local {
+			glog.V(3).Infof("configuration unchanged, skipping write: %v", ctl.configFile)
+			return nil
+		}
+	}
+
+	if err := ctl.write(content); err != nil {
+		return err
+	}
+
+	ctl.lock.Lock()
+	defer ctl.lock.Unlock()
+	ctl.hash = hash
+	ctl.generation++
+	return nil
+}
+
+func (ctl *Controller) write(content []byte) error {
+	if glog.V(2) {
+		glog.Infof("writing HAProxy configuration to: %v\n%s", ctl.configFile, content)
+	}
+	if ctl.local {
+		return nil
+	}
+
+	staging := ctl.configFile + stagingSuffix
+	if err := ioutil.WriteFile(staging, content, 0644); err != nil {
+		return fmt.Errorf("failed to write %v: %v", staging, err)
+	}
+	if ctl.dryRun {
+		glog.V(3).Infof("dry run, not checking: %v", staging)
+	} else if err := shellOut("haproxy -c -f " + staging); err != nil {
+		os.Remove(staging)
+		return &InvalidConfigError{Err: err}
+	}
+	if err := os.Rename(staging, ctl.configFile); err != nil {
+		os.Remove(staging)
+		return fmt.Errorf("failed to rename %v to %v: %v", staging, ctl.configFile, err)
+	}
+	return nil
+}
+
+// Validate checks the current configuration file
+func (ctl *Controller) Validate() error {
+	if ctl.local || ctl.dryRun {
+		return nil
+	}
+	if err := shellOut("haproxy -c -f " + ctl.configFile); err != nil {
+		return fmt.Errorf("invalid haproxy configuration detected: %v", err)
+	}
+	return nil
+}
+
+// Reload signals the HAProxy master process to reload, unless the
+// configuration is unchanged since the last successful reload.  New workers
+// take over the listening sockets, and old workers finish their existing
+// connections.
+func (ctl *Controller) Reload(pidFile string) error {
+	ctl.lock.Lock()
+	generation := ctl.generation
+	if generation == ctl.reloaded {
+		ctl.stats.Skipped++
+		ctl.lock.Unlock()
+		glog.V(3).Info("Reload: configuration unchanged, skipping reload")
+		return nil
+	}
+	ctl.lock.Unlock()
+
+	start := time.Now()
+	err := ctl.reload(pidFile)
+
+	ctl.lock.Lock()
+	defer ctl.lock.Unlock()
+	ctl.stats.DurationSeconds += time.Since(start).Seconds()
+	if err != nil {
+		ctl.stats.Failed++
+		ctl.stats.LastError = err.Error()
+		return err
+	}
+	ctl.reloaded = generation
+	ctl.stats.Applied++
+	ctl.stats.LastError = ""
+	return nil
+}
+
+// ReloadStats returns the reload counters
+func (ctl *Controller) ReloadStats() nginx.ReloadStats {
+	ctl.lock.Lock()
+	defer ctl.lock.Unlock()
+	return ctl.stats
+}
+
+func (ctl *Controller) reload(pidFile string) error {
+	if ctl.local || ctl.dryRun {
+		glog.V(3).Info("Reload: Reloading haproxy")
+		return nil
+	}
+	pid, err := readPid(pidFile)
+	if err != nil {
+		return fmt.Errorf("Reload: %v", err)
+	}
+	if err := syscall.Kill(pid, syscall.SIGUSR2); err != nil {
+		return fmt.Errorf("Reload: failed to signal haproxy master process %d: %v", pid, err)
+	}
+	return nil
+}
+
+// Healthy returns nil if the HAProxy master process is running
+func (ctl *Controller) Healthy(pidFile string) error {
+	if ctl.local || ctl.dryRun {
+		return nil
+	}
+	pid, err := readPid(pidFile)
+	if err != nil {
+		return err
+	}
+	if err := syscall.Kill(pid, 0); err != nil {
+		return fmt.Errorf("haproxy master process %d is not running: %v", pid, err)
+	}
+	return nil
+}
+
+func readPid(pidFile string) (int, error) {
+	content, err := ioutil.ReadFile(pidFile)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read haproxy pid file: %v", err)
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(content)))
+	if err != nil {
+		return 0, fmt.Errorf("invalid haproxy pid file content %q: %v", content, err)
+	}
+	return pid, nil
+}
+
+// InvalidConfigError - HAProxy rejected a generated configuration
+type InvalidConfigError struct {
+	Err error
+}
+
+func (e *InvalidConfigError) Error() string {
+	return fmt.Sprintf("haproxy configuration rejected, previous configuration retained: %v", e.Err)
+}
+
+// Rejected - the configuration was rejected, retrying it unchanged won't help
+func (e *InvalidConfigError) Rejected() bool {
+	return true
+}
+
+func shellOut(cmd string) (err error) {
+	var stdout bytes.Buffer
+	var stderr bytes.Buffer
+
+	glog.V(3).Infof("executing %s", cmd)
+
+	command := exec.Command("sh", "-c", cmd)
+	command.Stdout = &stdout
+	command.Stderr = &stderr
+
+	if err = command.Run(); err != nil {
+		return fmt.Errorf("Command %v stdout: %q\nstderr: %q\nfinished with error: %v", cmd,
+			stdout.String(), stderr.String(), err)
+	}
+	return nil
+}
+
+func (c Config) String() string {
+	j, err := json.Marshal(c)
+	if err != nil {
+		return string("cant't marshal: " + reflect.TypeOf(c).String() + ", to json string, err: " + err.Error())
+	}
+	return string(j)
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"k8s.io/client-go/pkg/api/meta"
+)
+
+// watchTracker records the time of each informer's last event from the API
+// server, as distinct from the informer's periodic resync of its' local store
+type watchTracker struct {
+	lock sync.Mutex
+	last map[string]time.Time
+}
+
+var watchEvents = &watchTracker{last: make(map[string]time.Time)}
+
+func (wt *watchTracker) observed(informer string) {
+	wt.lock.Lock()
+	defer wt.lock.Unlock()
+	wt.last[informer] = time.Now()
+}
+
+// latest returns the time of the most recent event of any informer
+func (wt *watchTracker) latest() time.Time {
+	wt.lock.Lock()
+	defer wt.lock.Unlock()
+	latest := time.Time{}
+	for _, t := range wt.last {
+		if t.After(latest) {
+			latest = t
+		}
+	}
+	return latest
+}
+
+// isWatchEvent returns false for an update that is a resync, i.e. the object
+// is unchanged
+func isWatchEvent(oldObj, newObj interface{}) bool {
+	oldMeta, err := meta.Accessor(oldObj)
+	if err != nil {
+		return true
+	}
+	newMeta, err := meta.Accessor(newObj)
+	if err != nil {
+		return true
+	}
+	return oldMeta.GetResourceVersion() != newMeta.GetResourceVersion()
+}
+
+// healthCheck is the result of a single readiness check
+type healthCheck struct {
+	name string
+	err  error
+}
+
+// readinessChecks checks that the informers have synced, that the last reload
+// succeeded, that the data plane is running, and that the API server watches
+// are receiving events.
+func (lbex *lbExController) readinessChecks() []healthCheck {
+	checks := []healthCheck{}
+
+	var err error
+	for _, informer := range []struct {
+		name string
+		lwc  *lwController
+	}{
+		{"nodes", lbex.nodesLWC},
+		{"services", lbex.servicesLWC},
+		{"endpoints", lbex.endpointsLWC},
+	} {
+		if !informer.lwc.controller.HasSynced() {
+			err = fmt.Errorf("%s informer has not synced", informer.name)
+			break
+		}
+	}
+	checks = append(checks, healthCheck{name: "informers", err: err})
+
+	err = nil
+	if stats := lbex.lb.ReloadStats(); stats.LastError != "" {
+		err = fmt.Errorf("last reload failed: %s", stats.LastError)
+	}
+	checks = append(checks, healthCheck{name: "reload", err: err})
+
+	checks = append(checks, healthCheck{name: "dataplane", err: lbex.lb.Healthy()})
+
+	err = nil
+	if latest := watchEvents.latest(); latest.IsZero() {
+		err = fmt.Errorf("no watch events received")
+	} else if age := time.Since(latest); age > *lbex.cfg.maxWatchAge {
+		err = fmt.Errorf("last watch event was %v ago", age.Truncate(time.Second))
+	}
+	checks = append(checks, healthCheck{name: "watch", err: err})
+
+	return checks
+}
+
+// healthz - LBEX is live if it is serving HTTP requests
+func healthz(w http.ResponseWriter, r *http.Request) {
+	w.Write([]byte("ok\n"))
+}
+
+// readyz - LBEX is ready if every readiness check passes, the result of each
+// check is listed in the response
+func (lbex *lbExController) readyz(w http.ResponseWriter, r *http.Request) {
+	body := ""
+	ready := true
+	for _, check := range lbex.readinessChecks() {
+		if check.err != nil {
+			ready = false
+			body += fmt.Sprintf("[-]%s failed: %v\n", check.name, check.err)
+		} else {
+			body += fmt.Sprintf("[+]%s ok\n", check.name)
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if !ready {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		body += "readyz check failed\n"
+	} else {
+		body += "readyz check passed\n"
+	}
+	w.Write([]byte(body))
+}
@@ -0,0 +1,248 @@
+package ipam
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+
+	"github.com/golang/glog"
+)
+
+// maxAttempts - the number of times an allocation is retried when another
+// writer saves the allocations concurrently
+const maxAttempts = 5
+
+// Allocator allocates addresses from the pools, and records the allocations
+// in the store
+type Allocator struct {
+	pools Pools
+	store Store
+
+	// the allocations as last loaded from, or saved to, the store
+	lock   sync.Mutex
+	cache  map[string]string
+	loaded bool
+}
+
+// NewAllocator creates an allocator of the pools' addresses
+func NewAllocator(pools Pools, store Store) *Allocator {
+	return &Allocator{pools: pools, store: store, cache: make(map[string]string)}
+}
+
+// Pools returns the allocator's address pools
+func (a *Allocator) Pools() Pools {
+	return a.pools
+}
+
+// Allocate returns the address of the service identified by key, allocating
+// an address from the named pool if the service does not have one from that
+// pool already.  A requested address, e.g. the service's loadBalancerIP, is
+// allocated if it is in the pool and free, and is an error otherwise.
+func (a *Allocator) Allocate(key, pool, requested string) (string, error) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	var want net.IP
+	if requested != "" {
+		if want = net.ParseIP(requested); want == nil {
+			return "", fmt.Errorf("requested address %q is not an IP address", requested)
+		}
+		if !a.pools.Contains(pool, want) {
+			return "", fmt.Errorf("requested address %s is not in the address pool %q", requested, pool)
+		}
+	}
+	if len(a.pools[pool]) == 0 {
+		return "", fmt.Errorf("no address pool %q is configured", pool)
+	}
+
+	// the service's current allocation is still valid
+	if a.loaded {
+		if ip, ok := a.cache[key]; ok && a.valid(ip, pool, want) {
+			return ip, nil
+		}
+	}
+
+	for attempt := 0; attempt < maxAttempts; attempt++ {
+		allocations, version, err := a.load()
+		if err != nil {
+			return "", err
+		}
+		if ip, ok := allocations[key]; ok && a.valid(ip, pool, want) {
+			return ip, nil
+		}
+
+		used := make(map[string]string)
+		for owner, ip := range allocations {
+			if owner != key {
+				used[net.ParseIP(ip).String()] = owner
+			}
+		}
+
+		var ip net.IP
+		if want != nil {
+			if owner, ok := used[want.String()]; ok {
+				return "", fmt.Errorf("requested address %s is allocated to %s", requested, owner)
+			}
+			ip = want
+		} else if ip = a.free(pool, used); ip == nil {
+			return "", fmt.Errorf("no free address in the address pool %q", pool)
+		}
+
+		if previous, ok := allocations[key]; ok {
+			glog.V(2).Infof("service %s: replacing address %s, no longer valid for pool %q", key, previous, pool)
+		}
+		allocations[key] = ip.String()
+		if err := a.save(allocations, version); err != nil {
+			if err == ErrConflict {
+				glog.V(3).Infof("service %s: %v, retrying", key, err)
+				continue
+			}
+			return "", err
+		}
+		glog.V(2).Infof("service %s: allocated address %s from pool %q", key, ip, pool)
+		return ip.String(), nil
+	}
+	return "", fmt.Errorf("failed to allocate an address after %d attempts: %v", maxAttempts, ErrConflict)
+}
+
+// Release releases the address of the service identified by key, if it has
+// one
+func (a *Allocator) Release(key string) error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	if a.loaded {
+		if _, ok := a.cache[key]; !ok {
+			return nil
+		}
+	}
+
+	for attempt := 0; attempt < maxAttempts; attempt++ {
+		allocations, version, err := a.load()
+		if err != nil {
+			return err
+		}
+		ip, ok := allocations[key]
+		if !ok {
+			return nil
+		}
+		delete(allocations, key)
+		if err := a.save(allocations, version); err != nil {
+			if err == ErrConflict {
+				continue
+			}
+			return err
+		}
+		glog.V(2).Infof("service %s: released address %s", key, ip)
+		return nil
+	}
+	return fmt.Errorf("failed to release the address after %d attempts: %v", maxAttempts, ErrConflict)
+}
+
+// Lookup returns the address of the service identified by key, as last
+// loaded from the store
+func (a *Allocator) Lookup(key string) (string, bool) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	ip, ok := a.cache[key]
+	return ip, ok
+}
+
+// Allocated returns the number of addresses allocated from each of the
+// allocator's pools, as last loaded from the store
+func (a *Allocator) Allocated() map[string]int {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	allocated := make(map[string]int)
+	for _, name := range a.pools.Names() {
+		allocated[name] = 0
+	}
+	for _, ip := range a.cache {
+		addr := net.ParseIP(ip)
+		for name := range a.pools {
+			if a.pools.Contains(name, addr) {
+				allocated[name]++
+			}
+		}
+	}
+	return allocated
+}
+
+// Allocations returns every allocation in the store, by service key
+func (a *Allocator) Allocations() (map[string]string, error) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	allocations, _, err := a.load()
+	return allocations, err
+}
+
+// PoolOf returns the name of the pool that contains the address
+func (a *Allocator) PoolOf(ip string) (string, bool) {
+	addr := net.ParseIP(ip)
+	for _, name := range a.pools.Names() {
+		if a.pools.Contains(name, addr) {
+			return name, true
+		}
+	}
+	return "", false
+}
+
+// valid returns true if ip is in the pool, and is the wanted address if any
+func (a *Allocator) valid(ip, pool string, want net.IP) bool {
+	addr := net.ParseIP(ip)
+	if want != nil && !want.Equal(addr) {
+		return false
+	}
+	return a.pools.Contains(pool, addr)
+}
+
+// free returns the first address of the pool that is not used
+func (a *Allocator) free(pool string, used map[string]string) net.IP {
+	ranges := append([]Range{}, a.pools[pool]...)
+	sort.Sort(rangeByFirst(ranges))
+	for _, r := range ranges {
+		// at most len(used) addresses of the range are in use
+		ip := r.First
+		for i := 0; i <= len(used) && r.Contains(ip); i++ {
+			if _, ok := used[ip.String()]; !ok {
+				return ip
+			}
+			ip = next(ip)
+		}
+	}
+	return nil
+}
+
+func (a *Allocator) load() (map[string]string, string, error) {
+	allocations, version, err := a.store.Load()
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to load address allocations: %v", err)
+	}
+	a.cache, a.loaded = copyAllocations(allocations), true
+	return allocations, version, nil
+}
+
+func (a *Allocator) save(allocations map[string]string, version string) error {
+	if err := a.store.Save(allocations, version); err != nil {
+		if err == ErrConflict {
+			return err
+		}
+		return fmt.Errorf("failed to save address allocations: %v", err)
+	}
+	a.cache = copyAllocations(allocations)
+	return nil
+}
+
+type rangeByFirst []Range
+
+func (r rangeByFirst) Len() int {
+	return len(r)
+}
+func (r rangeByFirst) Swap(i, j int) {
+	r[i], r[j] = r[j], r[i]
+}
+func (r rangeByFirst) Less(i, j int) bool {
+	return bytes.Compare(r[i].First, r[j].First) < 0
+}
@@ -0,0 +1,130 @@
+package ipam
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// racingStore is a memory store that another writer saves to between each of
+// the first conflicts loads and saves, so that those saves conflict
+type racingStore struct {
+	Store
+	conflicts int
+	writes    int
+}
+
+func (r *racingStore) Save(allocations map[string]string, version string) error {
+	if r.writes < r.conflicts {
+		r.writes++
+		current, currentVersion, _ := r.Store.Load()
+		current["other/svc"+strconv.Itoa(r.writes)] = "10.0.0." + strconv.Itoa(r.writes)
+		if err := r.Store.Save(current, currentVersion); err != nil {
+			return err
+		}
+	}
+	return r.Store.Save(allocations, version)
+}
+
+func newTestAllocator(t *testing.T, store Store) *Allocator {
+	pools, err := ParsePools([]string{"10.0.0.1-10.0.0.4", "blue=10.1.0.0/30"})
+	if err != nil {
+		t.Fatalf("ParsePools: %v", err)
+	}
+	return NewAllocator(pools, store)
+}
+
+func TestAllocate(t *testing.T) {
+	a := newTestAllocator(t, NewMemoryStore(nil))
+
+	tests := []struct {
+		key, pool, requested string
+		want                 string
+		err                  string
+	}{
+		{key: "ns/a", want: "10.0.0.1"},
+		{key: "ns/b", want: "10.0.0.2"},
+		// an existing allocation is stable
+		{key: "ns/a", want: "10.0.0.1"},
+		{key: "ns/c", pool: "blue", want: "10.1.0.1"},
+		{key: "ns/d", requested: "10.0.0.4", want: "10.0.0.4"},
+		{key: "ns/e", requested: "10.0.0.2", err: "is allocated to ns/b"},
+		{key: "ns/e", requested: "10.1.0.1", err: "is not in the address pool"},
+		{key: "ns/e", requested: "not-an-ip", err: "is not an IP address"},
+		{key: "ns/e", pool: "green", err: "no address pool"},
+		{key: "ns/e", want: "10.0.0.3"},
+		{key: "ns/f", err: "no free address"},
+		// a change of pool replaces the allocation
+		{key: "ns/a", pool: "blue", want: "10.1.0.2"},
+		// a change of requested address replaces the allocation
+		{key: "ns/b", requested: "10.0.0.1", want: "10.0.0.1"},
+	}
+	for i, test := range tests {
+		got, err := a.Allocate(test.key, test.pool, test.requested)
+		switch {
+		case test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)):
+			t.Errorf("%d: %s: got error %v, want %q", i, test.key, err, test.err)
+		case test.err == "" && err != nil:
+			t.Errorf("%d: %s: unexpected error: %v", i, test.key, err)
+		case got != test.want:
+			t.Errorf("%d: %s: got address %q, want %q", i, test.key, got, test.want)
+		}
+	}
+
+	if ip, ok := a.Lookup("ns/c"); !ok || ip != "10.1.0.1" {
+		t.Errorf("lookup ns/c: got %q %t, want 10.1.0.1", ip, ok)
+	}
+	if got := a.Allocated(); got[""] != 3 || got["blue"] != 2 {
+		t.Errorf("allocated: got %v, want 3 and blue 2", got)
+	}
+}
+
+func TestAllocateConflictRetry(t *testing.T) {
+	store := &racingStore{Store: NewMemoryStore(nil), conflicts: 2}
+	a := newTestAllocator(t, store)
+
+	// the other writer takes 10.0.0.1, then 10.0.0.2, while ns/a allocates
+	got, err := a.Allocate("ns/a", "", "")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got != "10.0.0.3" {
+		t.Errorf("got %s, want 10.0.0.3", got)
+	}
+	allocations, err := a.Allocations()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(allocations) != 3 || allocations["ns/a"] != "10.0.0.3" {
+		t.Errorf("allocations: got %v, want those of both writers", allocations)
+	}
+}
+
+func TestAllocateConflictExhausted(t *testing.T) {
+	store := &racingStore{Store: NewMemoryStore(nil), conflicts: maxAttempts}
+	pools, _ := ParsePools([]string{"10.0.0.1-10.0.0.9"})
+	a := NewAllocator(pools, store)
+
+	if _, err := a.Allocate("ns/a", "", ""); err == nil || !strings.Contains(err.Error(), "attempts") {
+		t.Errorf("got error %v, want failure after %d attempts", err, maxAttempts)
+	}
+}
+
+func TestRelease(t *testing.T) {
+	a := newTestAllocator(t, NewMemoryStore(map[string]string{"ns/a": "10.0.0.1"}))
+
+	if err := a.Release("ns/a"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, ok := a.Lookup("ns/a"); ok {
+		t.Errorf("ns/a still has an address after release")
+	}
+	// releasing an unknown service is not an error
+	if err := a.Release("ns/unknown"); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	// the released address is allocated again
+	if got, _ := a.Allocate("ns/b", "", ""); got != "10.0.0.1" {
+		t.Errorf("got %s, want the released 10.0.0.1", got)
+	}
+}
@@ -0,0 +1,157 @@
+// Package ipam allocates load balancer addresses (VIPs) to services, from
+// address pools configured per service pool.  Allocations are persisted in a
+// Store, so that they survive restarts, and are shared by every LBEX instance
+// that uses the same store.
+package ipam
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+)
+
+// Range - an inclusive range of IPv4 or IPv6 addresses
+type Range struct {
+	First net.IP
+	Last  net.IP
+}
+
+// ParseRange parses a CIDR, e.g. 192.168.10.0/24, or a range of addresses,
+// e.g. 192.168.10.10-192.168.10.20.  The network and broadcast addresses of an
+// IPv4 CIDR of /30 or larger are not included.
+func ParseRange(s string) (Range, error) {
+	s = strings.TrimSpace(s)
+	if strings.Contains(s, "/") {
+		ip, ipNet, err := net.ParseCIDR(s)
+		if err != nil {
+			return Range{}, fmt.Errorf("invalid address range %q: %v", s, err)
+		}
+		if !ip.Equal(ipNet.IP) {
+			return Range{}, fmt.Errorf("invalid address range %q: not a network address, did you mean %s?", s, ipNet)
+		}
+		r := Range{First: ipNet.IP, Last: make(net.IP, len(ipNet.IP))}
+		for i := range ipNet.IP {
+			r.Last[i] = ipNet.IP[i] | ^ipNet.Mask[i]
+		}
+		if ones, bits := ipNet.Mask.Size(); bits == 32 && ones <= 30 {
+			r.First, r.Last = next(r.First), prev(r.Last)
+		}
+		return r.normalize(), nil
+	}
+
+	bounds := strings.SplitN(s, "-", 2)
+	if len(bounds) != 2 {
+		return Range{}, fmt.Errorf("invalid address range %q: must be a CIDR, or first-last", s)
+	}
+	r := Range{First: net.ParseIP(strings.TrimSpace(bounds[0])), Last: net.ParseIP(strings.TrimSpace(bounds[1]))}
+	if r.First == nil || r.Last == nil {
+		return Range{}, fmt.Errorf("invalid address range %q: invalid address", s)
+	}
+	if isIPv4(r.First) != isIPv4(r.Last) {
+		return Range{}, fmt.Errorf("invalid address range %q: mixed address families", s)
+	}
+	r = r.normalize()
+	if bytes.Compare(r.First, r.Last) > 0 {
+		return Range{}, fmt.Errorf("invalid address range %q: first address is after the last", s)
+	}
+	return r, nil
+}
+
+// normalize uses the 16 byte form of both addresses, so that they compare
+func (r Range) normalize() Range {
+	return Range{First: r.First.To16(), Last: r.Last.To16()}
+}
+
+// Contains returns true if the address is in the range
+func (r Range) Contains(ip net.IP) bool {
+	ip = ip.To16()
+	if ip == nil || isIPv4(ip) != isIPv4(r.First) {
+		return false
+	}
+	return bytes.Compare(ip, r.First) >= 0 && bytes.Compare(ip, r.Last) <= 0
+}
+
+func (r Range) String() string {
+	return r.First.String() + "-" + r.Last.String()
+}
+
+// Pools - the address ranges of each service pool, by pool name.  The pool
+// named "" is used by services that have no service pool annotation.
+type Pools map[string][]Range
+
+// ParsePools parses address pool entries, each of the form [pool=]range, where
+// range is as for ParseRange.  A pool may have any number of entries.
+func ParsePools(entries []string) (Pools, error) {
+	pools := Pools{}
+	for _, entry := range entries {
+		pool, ranges := "", entry
+		if i := strings.Index(entry, "="); i >= 0 {
+			pool, ranges = strings.TrimSpace(entry[:i]), entry[i+1:]
+		}
+		r, err := ParseRange(ranges)
+		if err != nil {
+			return nil, err
+		}
+		for name, existing := range pools {
+			for _, other := range existing {
+				if r.Contains(other.First) || r.Contains(other.Last) || other.Contains(r.First) {
+					return nil, fmt.Errorf("address range %s of pool %q overlaps %s of pool %q", r, pool, other, name)
+				}
+			}
+		}
+		pools[pool] = append(pools[pool], r)
+	}
+	return pools, nil
+}
+
+// Contains returns true if the address is in one of the pool's ranges
+func (p Pools) Contains(pool string, ip net.IP) bool {
+	for _, r := range p[pool] {
+		if r.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Names returns the names of the pools, sorted
+func (p Pools) Names() []string {
+	names := []string{}
+	for name := range p {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func isIPv4(ip net.IP) bool {
+	return ip.To4() != nil
+}
+
+// next returns the address after ip
+func next(ip net.IP) net.IP {
+	n := make(net.IP, len(ip))
+	copy(n, ip)
+	for i := len(n) - 1; i >= 0; i-- {
+		n[i]++
+		if n[i] != 0 {
+			break
+		}
+	}
+	return n
+}
+
+// prev returns the address before ip
+func prev(ip net.IP) net.IP {
+	p := make(net.IP, len(ip))
+	copy(p, ip)
+	for i := len(p) - 1; i >= 0; i-- {
+		p[i]--
+		if p[i] != 0xff {
+			break
+		}
+	}
+	return p
+}
@@ -0,0 +1,123 @@
+package ipam
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+
+	corev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	apierrors "k8s.io/client-go/pkg/api/errors"
+	"k8s.io/client-go/pkg/api/v1"
+)
+
+// ErrConflict - the allocations were saved by another writer since they were
+// loaded
+var ErrConflict = errors.New("address allocations were modified concurrently")
+
+// Store persists address allocations, by service key
+type Store interface {
+	// Load returns the allocations, and their' version
+	Load() (map[string]string, string, error)
+	// Save replaces the allocations, if they are still at version, and
+	// returns ErrConflict otherwise
+	Save(allocations map[string]string, version string) error
+}
+
+// memoryStore - a Store that is not persisted, for dry runs and rendering
+type memoryStore struct {
+	lock        sync.Mutex
+	allocations map[string]string
+	version     int
+}
+
+// NewMemoryStore creates a Store that is not persisted, with the initial
+// allocations
+func NewMemoryStore(allocations map[string]string) Store {
+	return &memoryStore{allocations: copyAllocations(allocations)}
+}
+
+func (m *memoryStore) Load() (map[string]string, string, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return copyAllocations(m.allocations), strconv.Itoa(m.version), nil
+}
+
+func (m *memoryStore) Save(allocations map[string]string, version string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if version != strconv.Itoa(m.version) {
+		return ErrConflict
+	}
+	m.allocations = copyAllocations(allocations)
+	m.version++
+	return nil
+}
+
+// ConfigMapStore persists allocations in a ConfigMap.  Each data key is the
+// service's namespace and name, joined by a '.', since a ConfigMap key can not
+// contain a '/', and the value is the address.  Concurrent writers are
+// detected by the ConfigMap's resource version.
+type ConfigMapStore struct {
+	client    corev1.ConfigMapsGetter
+	namespace string
+	name      string
+}
+
+// NewConfigMapStore creates a Store backed by the ConfigMap namespace/name,
+// which is created when allocations are first saved
+func NewConfigMapStore(client corev1.ConfigMapsGetter, namespace, name string) *ConfigMapStore {
+	return &ConfigMapStore{client: client, namespace: namespace, name: name}
+}
+
+// Load returns the allocations in the ConfigMap, no allocations if it does not
+// exist
+func (c *ConfigMapStore) Load() (map[string]string, string, error) {
+	cm, err := c.client.ConfigMaps(c.namespace).Get(c.name)
+	if apierrors.IsNotFound(err) {
+		return map[string]string{}, "", nil
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	allocations := make(map[string]string)
+	for key, ip := range cm.Data {
+		allocations[strings.Replace(key, ".", "/", 1)] = ip
+	}
+	return allocations, cm.ResourceVersion, nil
+}
+
+// Save writes the allocations to the ConfigMap, creating it when version is
+// empty
+func (c *ConfigMapStore) Save(allocations map[string]string, version string) error {
+	cm := &v1.ConfigMap{
+		ObjectMeta: v1.ObjectMeta{
+			Name:            c.name,
+			Namespace:       c.namespace,
+			ResourceVersion: version,
+		},
+		Data: make(map[string]string),
+	}
+	for key, ip := range allocations {
+		cm.Data[strings.Replace(key, "/", ".", 1)] = ip
+	}
+
+	var err error
+	if version == "" {
+		_, err = c.client.ConfigMaps(c.namespace).Create(cm)
+	} else {
+		_, err = c.client.ConfigMaps(c.namespace).Update(cm)
+	}
+	if apierrors.IsConflict(err) || apierrors.IsAlreadyExists(err) {
+		return ErrConflict
+	}
+	return err
+}
+
+func copyAllocations(allocations map[string]string) map[string]string {
+	c := make(map[string]string, len(allocations))
+	for key, ip := range allocations {
+		c[key] = ip
+	}
+	return c
+}
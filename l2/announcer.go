@@ -0,0 +1,175 @@
+// Package l2 announces service addresses (VIPs) on the local network, by
+// adding them to an interface of the host and sending gratuitous ARP (IPv4)
+// or unsolicited neighbor advertisements (IPv6), so that the address moves to
+// the active LBEX instance's host.
+package l2
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+const (
+	// announceCount - the number of announcements sent for each address, in
+	// case any are lost
+	announceCount = 3
+	// announceInterval - the time between announcements of an address
+	announceInterval = time.Second
+)
+
+// Announcer adds the addresses of the services to the interface while it is
+// active, and removes them when it is deactivated
+type Announcer struct {
+	iface string
+
+	lock sync.Mutex
+	// vips - the address of each service, by service key
+	vips map[string]string
+	// active - whether or not this instance should hold the addresses
+	active bool
+	// assigned - the addresses that have been added to the interface
+	assigned map[string]bool
+}
+
+// NewAnnouncer creates an inactive announcer for the named interface
+func NewAnnouncer(iface string) (*Announcer, error) {
+	if err := checkSupport(); err != nil {
+		return nil, err
+	}
+	if _, err := net.InterfaceByName(iface); err != nil {
+		return nil, fmt.Errorf("invalid L2 interface %q: %v", iface, err)
+	}
+	return &Announcer{
+		iface:    iface,
+		vips:     make(map[string]string),
+		assigned: make(map[string]bool),
+	}, nil
+}
+
+// Announce sets the address of the service identified by key
+func (a *Announcer) Announce(key, vip string) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if a.vips[key] == vip {
+		return
+	}
+	a.vips[key] = vip
+	a.reconcile()
+}
+
+// Withdraw removes the address of the service identified by key
+func (a *Announcer) Withdraw(key string) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if _, ok := a.vips[key]; !ok {
+		return
+	}
+	delete(a.vips, key)
+	a.reconcile()
+}
+
+// Activate adds every service address to the interface, and announces them,
+// e.g. when this instance becomes the leader
+func (a *Announcer) Activate() {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	glog.Infof("L2 announcements active on %s", a.iface)
+	a.active = true
+	a.reconcile()
+}
+
+// Deactivate removes every service address from the interface, e.g. when
+// this instance is no longer the leader, or is shutting down
+func (a *Announcer) Deactivate() {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	glog.Infof("L2 announcements inactive on %s", a.iface)
+	a.active = false
+	a.reconcile()
+}
+
+// Active returns true while the announcer holds the addresses
+func (a *Announcer) Active() bool {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	return a.active
+}
+
+// Assigned returns the addresses that have been added to the interface
+func (a *Announcer) Assigned() []string {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	addrs := []string{}
+	for addr := range a.assigned {
+		addrs = append(addrs, addr)
+	}
+	sort.Strings(addrs)
+	return addrs
+}
+
+// reconcile adds and announces the wanted addresses that are not assigned,
+// and removes the assigned addresses that are no longer wanted
+func (a *Announcer) reconcile() {
+	wanted := make(map[string]bool)
+	if a.active {
+		for _, vip := range a.vips {
+			wanted[vip] = true
+		}
+	}
+
+	for addr := range a.assigned {
+		if wanted[addr] {
+			continue
+		}
+		if err := delAddress(a.iface, net.ParseIP(addr)); err != nil {
+			glog.Errorf("failed to remove %s from %s: %v", addr, a.iface, err)
+			continue
+		}
+		glog.V(2).Infof("removed %s from %s", addr, a.iface)
+		delete(a.assigned, addr)
+	}
+
+	for addr := range wanted {
+		if a.assigned[addr] {
+			continue
+		}
+		ip := net.ParseIP(addr)
+		if ip == nil {
+			glog.Errorf("invalid L2 address: %q", addr)
+			continue
+		}
+		if err := addAddress(a.iface, ip); err != nil {
+			glog.Errorf("failed to add %s to %s: %v", addr, a.iface, err)
+			continue
+		}
+		glog.V(2).Infof("added %s to %s", addr, a.iface)
+		a.assigned[addr] = true
+		go a.announce(ip)
+	}
+}
+
+// announce sends announceCount announcements of the address, while it is
+// still assigned
+func (a *Announcer) announce(ip net.IP) {
+	for i := 0; i < announceCount; i++ {
+		if i > 0 {
+			time.Sleep(announceInterval)
+		}
+		a.lock.Lock()
+		assigned := a.assigned[ip.String()]
+		a.lock.Unlock()
+		if !assigned {
+			return
+		}
+		if err := sendAnnouncement(a.iface, ip); err != nil {
+			glog.Errorf("failed to announce %s on %s: %v", ip, a.iface, err)
+			return
+		}
+	}
+	glog.V(3).Infof("announced %s on %s", ip, a.iface)
+}
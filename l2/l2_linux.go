@@ -0,0 +1,216 @@
+//go:build linux
+// +build linux
+
+package l2
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"syscall"
+	"unsafe"
+)
+
+// netlink messages are in the host's byte order
+var nativeEndian binary.ByteOrder
+
+func init() {
+	i := uint16(1)
+	if *(*byte)(unsafe.Pointer(&i)) == 1 {
+		nativeEndian = binary.LittleEndian
+	} else {
+		nativeEndian = binary.BigEndian
+	}
+}
+
+const (
+	// ifaFlagNoDAD - IFA_F_NODAD, an IPv6 address is usable without duplicate
+	// address detection
+	ifaFlagNoDAD = 0x02
+
+	// ndpNeighborAdvertisement - the ICMPv6 neighbor advertisement type
+	ndpNeighborAdvertisement = 136
+	// ndpOverride - the neighbor advertisement override flag
+	ndpOverride = 0x20
+	// ndpTargetLinkLayerAddress - the target link-layer address option type
+	ndpTargetLinkLayerAddress = 2
+)
+
+func checkSupport() error {
+	return nil
+}
+
+// addAddress adds ip, as a host address, to the interface
+func addAddress(iface string, ip net.IP) error {
+	err := addressRequest(syscall.RTM_NEWADDR, syscall.NLM_F_CREATE|syscall.NLM_F_EXCL, iface, ip)
+	if err == syscall.EEXIST {
+		return nil
+	}
+	return err
+}
+
+// delAddress removes ip from the interface
+func delAddress(iface string, ip net.IP) error {
+	err := addressRequest(syscall.RTM_DELADDR, 0, iface, ip)
+	if err == syscall.EADDRNOTAVAIL {
+		return nil
+	}
+	return err
+}
+
+// addressRequest sends an RTM_NEWADDR or RTM_DELADDR request for ip on the
+// interface, and waits for the kernel's acknowledgement
+func addressRequest(msgType, flags int, iface string, ip net.IP) error {
+	ifi, err := net.InterfaceByName(iface)
+	if err != nil {
+		return err
+	}
+
+	family, prefixLen, ifaFlags, addr := syscall.AF_INET, 32, 0, ip.To4()
+	if addr == nil {
+		family, prefixLen, ifaFlags, addr = syscall.AF_INET6, 128, ifaFlagNoDAD, ip.To16()
+	}
+
+	// struct ifaddrmsg
+	body := make([]byte, syscall.SizeofIfAddrmsg)
+	body[0] = byte(family)
+	body[1] = byte(prefixLen)
+	body[2] = byte(ifaFlags)
+	body[3] = syscall.RT_SCOPE_UNIVERSE
+	nativeEndian.PutUint32(body[4:], uint32(ifi.Index))
+	body = append(body, routeAttr(syscall.IFA_LOCAL, addr)...)
+	body = append(body, routeAttr(syscall.IFA_ADDRESS, addr)...)
+
+	// struct nlmsghdr
+	msg := make([]byte, syscall.NLMSG_HDRLEN, syscall.NLMSG_HDRLEN+len(body))
+	nativeEndian.PutUint32(msg[0:], uint32(syscall.NLMSG_HDRLEN+len(body)))
+	nativeEndian.PutUint16(msg[4:], uint16(msgType))
+	nativeEndian.PutUint16(msg[6:], uint16(syscall.NLM_F_REQUEST|syscall.NLM_F_ACK|flags))
+	nativeEndian.PutUint32(msg[8:], 1)
+	msg = append(msg, body...)
+
+	fd, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_RAW|syscall.SOCK_CLOEXEC, syscall.NETLINK_ROUTE)
+	if err != nil {
+		return fmt.Errorf("netlink socket: %v", err)
+	}
+	defer syscall.Close(fd)
+	if err := syscall.Bind(fd, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK}); err != nil {
+		return fmt.Errorf("netlink bind: %v", err)
+	}
+	if err := syscall.Sendto(fd, msg, 0, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK}); err != nil {
+		return fmt.Errorf("netlink send: %v", err)
+	}
+
+	buf := make([]byte, syscall.Getpagesize())
+	for {
+		n, _, err := syscall.Recvfrom(fd, buf, 0)
+		if err != nil {
+			return fmt.Errorf("netlink receive: %v", err)
+		}
+		msgs, err := syscall.ParseNetlinkMessage(buf[:n])
+		if err != nil {
+			return fmt.Errorf("netlink parse: %v", err)
+		}
+		for _, m := range msgs {
+			if m.Header.Type != syscall.NLMSG_ERROR {
+				continue
+			}
+			if len(m.Data) < 4 {
+				return fmt.Errorf("netlink: short error message")
+			}
+			// an error code of 0 acknowledges the request
+			if errno := int32(nativeEndian.Uint32(m.Data[0:4])); errno != 0 {
+				return syscall.Errno(-errno)
+			}
+			return nil
+		}
+	}
+}
+
+// routeAttr encodes a struct rtattr, padded to the netlink alignment
+func routeAttr(attrType int, data []byte) []byte {
+	length := syscall.SizeofRtAttr + len(data)
+	attr := make([]byte, (length+syscall.RTA_ALIGNTO-1) & ^(syscall.RTA_ALIGNTO-1))
+	nativeEndian.PutUint16(attr[0:], uint16(length))
+	nativeEndian.PutUint16(attr[2:], uint16(attrType))
+	copy(attr[syscall.SizeofRtAttr:], data)
+	return attr
+}
+
+// sendAnnouncement sends a gratuitous ARP for an IPv4 address, or an
+// unsolicited neighbor advertisement for an IPv6 address, from the interface
+func sendAnnouncement(iface string, ip net.IP) error {
+	ifi, err := net.InterfaceByName(iface)
+	if err != nil {
+		return err
+	}
+	if len(ifi.HardwareAddr) != 6 {
+		return fmt.Errorf("interface %s has no ethernet address", iface)
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return sendGratuitousARP(ifi, ip4)
+	}
+	return sendNeighborAdvertisement(ifi, ip.To16())
+}
+
+func htons(v uint16) uint16 {
+	return v<<8 | v>>8
+}
+
+// sendGratuitousARP broadcasts an ARP request for ip, from ip, so that
+// neighbors update their ARP cache entry for ip to the interface's address
+func sendGratuitousARP(ifi *net.Interface, ip net.IP) error {
+	fd, err := syscall.Socket(syscall.AF_PACKET, syscall.SOCK_DGRAM|syscall.SOCK_CLOEXEC, int(htons(syscall.ETH_P_ARP)))
+	if err != nil {
+		return fmt.Errorf("packet socket: %v", err)
+	}
+	defer syscall.Close(fd)
+
+	pkt := make([]byte, 28)
+	binary.BigEndian.PutUint16(pkt[0:], 1)      // hardware type: ethernet
+	binary.BigEndian.PutUint16(pkt[2:], 0x0800) // protocol type: IPv4
+	pkt[4] = 6                                  // hardware address length
+	pkt[5] = 4                                  // protocol address length
+	binary.BigEndian.PutUint16(pkt[6:], 1)      // operation: request
+	copy(pkt[8:], ifi.HardwareAddr)             // sender hardware address
+	copy(pkt[14:], ip)                          // sender protocol address
+	copy(pkt[24:], ip)                          // target protocol address
+
+	to := &syscall.SockaddrLinklayer{
+		Protocol: htons(syscall.ETH_P_ARP),
+		Ifindex:  ifi.Index,
+		Halen:    6,
+		Addr:     [8]byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff},
+	}
+	return syscall.Sendto(fd, pkt, 0, to)
+}
+
+// sendNeighborAdvertisement sends an unsolicited neighbor advertisement for
+// ip, with the override flag, to all nodes.  The kernel fills in the ICMPv6
+// checksum of raw ICMPv6 sockets.
+func sendNeighborAdvertisement(ifi *net.Interface, ip net.IP) error {
+	fd, err := syscall.Socket(syscall.AF_INET6, syscall.SOCK_RAW|syscall.SOCK_CLOEXEC, syscall.IPPROTO_ICMPV6)
+	if err != nil {
+		return fmt.Errorf("icmpv6 socket: %v", err)
+	}
+	defer syscall.Close(fd)
+	// neighbor discovery messages must have a hop limit of 255
+	if err := syscall.SetsockoptInt(fd, syscall.IPPROTO_IPV6, syscall.IPV6_MULTICAST_HOPS, 255); err != nil {
+		return fmt.Errorf("icmpv6 hop limit: %v", err)
+	}
+	if err := syscall.SetsockoptInt(fd, syscall.IPPROTO_IPV6, syscall.IPV6_MULTICAST_IF, ifi.Index); err != nil {
+		return fmt.Errorf("icmpv6 interface: %v", err)
+	}
+
+	msg := make([]byte, 32)
+	msg[0] = ndpNeighborAdvertisement
+	msg[4] = ndpOverride
+	copy(msg[8:], ip)
+	msg[24] = ndpTargetLinkLayerAddress
+	msg[25] = 1 // option length, in units of 8 bytes
+	copy(msg[26:], ifi.HardwareAddr)
+
+	to := &syscall.SockaddrInet6{ZoneId: uint32(ifi.Index)}
+	copy(to.Addr[:], net.IPv6linklocalallnodes)
+	return syscall.Sendto(fd, msg, 0, to)
+}
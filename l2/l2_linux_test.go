@@ -0,0 +1,90 @@
+//go:build linux
+// +build linux
+
+package l2
+
+import (
+	"net"
+	"os"
+	"runtime"
+	"syscall"
+	"testing"
+)
+
+// inNetns runs fn on a thread of its' own in a new network namespace, so
+// that the host's interfaces are untouched.  The thread is never unlocked, so
+// it exits with the goroutine rather than returning to the host namespace.
+func inNetns(t *testing.T, fn func()) {
+	if os.Geteuid() != 0 {
+		t.Skip("network namespaces require root")
+	}
+	unshared := make(chan error)
+	done := make(chan bool)
+	go func() {
+		defer close(done)
+		runtime.LockOSThread()
+		err := syscall.Unshare(syscall.CLONE_NEWNET)
+		unshared <- err
+		if err == nil {
+			fn()
+		}
+	}()
+	if err := <-unshared; err != nil {
+		t.Skipf("unshare: %v", err)
+	}
+	<-done
+}
+
+// hasAddress returns true if ip is assigned to the interface
+func hasAddress(t *testing.T, iface string, ip net.IP) bool {
+	ifi, err := net.InterfaceByName(iface)
+	if err != nil {
+		t.Errorf("interface %s: %v", iface, err)
+		return false
+	}
+	addrs, err := ifi.Addrs()
+	if err != nil {
+		t.Errorf("addresses of %s: %v", iface, err)
+		return false
+	}
+	for _, addr := range addrs {
+		if ipnet, ok := addr.(*net.IPNet); ok && ipnet.IP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestAddDelAddress(t *testing.T) {
+	inNetns(t, func() {
+		for _, addr := range []string{"192.0.2.10", "2001:db8::10"} {
+			ip := net.ParseIP(addr)
+			if err := addAddress("lo", ip); err != nil {
+				t.Errorf("add %s: %v", addr, err)
+				continue
+			}
+			if !hasAddress(t, "lo", ip) {
+				t.Errorf("%s not assigned after add", addr)
+			}
+			// adding an assigned address is not an error
+			if err := addAddress("lo", ip); err != nil {
+				t.Errorf("add %s again: %v", addr, err)
+			}
+
+			if err := delAddress("lo", ip); err != nil {
+				t.Errorf("delete %s: %v", addr, err)
+			}
+			if hasAddress(t, "lo", ip) {
+				t.Errorf("%s still assigned after delete", addr)
+			}
+			// removing an unassigned address is not an error
+			if err := delAddress("lo", ip); err != nil {
+				t.Errorf("delete %s again: %v", addr, err)
+			}
+		}
+
+		if err := addAddress("no-such-interface", net.ParseIP("192.0.2.10")); err == nil {
+			t.Errorf("add to a missing interface: got no error")
+		}
+	})
+}
@@ -0,0 +1,27 @@
+//go:build !linux
+// +build !linux
+
+package l2
+
+import (
+	"errors"
+	"net"
+)
+
+var errNotSupported = errors.New("L2 announcements are only supported on Linux")
+
+func checkSupport() error {
+	return errNotSupported
+}
+
+func addAddress(iface string, ip net.IP) error {
+	return errNotSupported
+}
+
+func delAddress(iface string, ip net.IP) error {
+	return errNotSupported
+}
+
+func sendAnnouncement(iface string, ip net.IP) error {
+	return errNotSupported
+}
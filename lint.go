@@ -0,0 +1,102 @@
+package main
+
+import (
+	"encoding/json"
+	goflag "flag"
+	"fmt"
+	"os"
+	"sort"
+
+	flag "github.com/spf13/pflag"
+
+	"github.com/sostheim/lbex/annotations"
+	"github.com/sostheim/lbex/nginx"
+
+	v1 "k8s.io/client-go/pkg/api/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+const lintUsage = `Usage: lbex lint [flags] FILE...
+
+Checks the LBEX annotations of the Services in the YAML or JSON manifest FILEs
+(e.g. kubectl get services -o yaml), and prints the findings for each Service
+as JSON.  The exit status is 1 if there is any error.
+
+`
+
+// lintResult - the findings for a single service
+type lintResult struct {
+	Service  string                `json:"service"`
+	Findings []annotations.Finding `json:"findings"`
+}
+
+// runLint runs the lint subcommand, returning the process exit code
+func runLint(args []string) int {
+	fs := flag.NewFlagSet("lint", flag.ExitOnError)
+	fs.AddGoFlagSet(goflag.CommandLine)
+	cfg := newConfigForFlagSet(fs)
+	fs.Usage = func() {
+		fmt.Fprint(os.Stderr, lintUsage)
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return 2
+	}
+
+	lbex := &lbExController{
+		cfg:           cfg,
+		servicesStore: cache.NewStore(keyFunc),
+		endpointStore: cache.NewStore(keyFunc),
+		nodesStore:    cache.NewStore(keyFunc),
+	}
+	for _, filename := range fs.Args() {
+		if err := lbex.loadManifest(filename); err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			return 1
+		}
+	}
+
+	status := 0
+	opts := nginx.LintOptions(*cfg.requirePort, *cfg.nodeSelector, len(*cfg.vipRanges) > 0)
+	results := []lintResult{}
+	keys := lbex.servicesStore.ListKeys()
+	sort.Strings(keys)
+	for _, key := range keys {
+		obj, _, _ := lbex.servicesStore.GetByKey(key)
+		service := obj.(*v1.Service)
+		if !isLBEXService(service) {
+			continue
+		}
+		findings := annotations.Lint(service, opts)
+		for _, finding := range findings {
+			if finding.Severity == annotations.SeverityError {
+				status = 1
+			}
+		}
+		results = append(results, lintResult{Service: key, Findings: findings})
+	}
+
+	j, err := json.MarshalIndent(results, "", "  ")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return 1
+	}
+	fmt.Println(string(j))
+	return status
+}
+
+// isLBEXService returns true for a service with the LBEX class annotation, or
+// any annotation that appears to be intended for LBEX
+func isLBEXService(service *v1.Service) bool {
+	for key, value := range service.GetAnnotations() {
+		if key == annotations.LBEXClassKey && value == annotations.LBEXClassKeyValue {
+			return true
+		}
+		if annotations.IsLBEXKey(key) {
+			return true
+		}
+	}
+	return false
+}
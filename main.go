@@ -3,14 +3,22 @@ package main
 import (
 	goflag "flag"
 	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
 	"time"
 
 	"github.com/blang/semver"
 	"github.com/golang/glog"
+	"github.com/sostheim/lbex/accesslog"
+	"github.com/sostheim/lbex/metrics"
 	flag "github.com/spf13/pflag"
 
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/pkg/api/unversioned"
+	"k8s.io/client-go/pkg/labels"
 	"k8s.io/client-go/pkg/util/wait"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
@@ -27,6 +35,9 @@ var LbexGitCommit string
 
 var lbexCfg *config
 
+// shutdownTimeout - the longest time to wait for the controller to stop
+const shutdownTimeout = 10 * time.Second
+
 func init() {
 	go wait.Until(glog.Flush, 10*time.Second, wait.NeverStop)
 	lbexCfg = newConfig()
@@ -64,6 +75,15 @@ func byProxy() *rest.Config {
 	}
 }
 
+// serveHTTP serves LBEX's own HTTP endpoints
+func serveHTTP(port int, lbex *lbExController) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics.DefaultRegistry)
+	mux.HandleFunc("/healthz", healthz)
+	mux.HandleFunc("/readyz", lbex.readyz)
+	glog.Errorf("HTTP server exited: %v", http.ListenAndServe(":"+strconv.Itoa(port), mux))
+}
+
 func displayVersion() {
 	semVer, err := semver.Make(LbexMajorMinorPatch + "-" + LbexType + "+git.sha." + LbexGitCommit)
 	if err != nil {
@@ -73,6 +93,15 @@ func displayVersion() {
 }
 
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "render":
+			os.Exit(runRender(os.Args[2:]))
+		case "lint":
+			os.Exit(runLint(os.Args[2:]))
+		}
+	}
+
 	flag.CommandLine.AddGoFlagSet(goflag.CommandLine)
 	flag.Parse()
 
@@ -84,6 +113,9 @@ func main() {
 		displayVersion()
 		return
 	}
+	if _, err := labels.Parse(*lbexCfg.nodeSelector); err != nil {
+		glog.Fatalf("invalid --node-selector: %v", err)
+	}
 	// creates the config, in preference order, for:
 	// 1 - the proxy URL, if present as an argument
 	// 2 - kubeconfig, if present as an argument
@@ -107,12 +139,46 @@ func main() {
 		panic(err.Error())
 	}
 
+	// create and start the load balancer data plane
+	lb, err := newBackend(lbexCfg)
+	if err != nil {
+		glog.Fatalf("failed to create backend: %v", err)
+	}
+	if err := lb.Start(); err != nil {
+		glog.Fatalf("failed to start %s backend: %v", lb.Name(), err)
+	}
+
+	// the work queue metrics must be registered before the controller's
+	// queues are created
+	metrics.RegisterWorkqueueMetrics(metrics.DefaultRegistry)
+	accesslog.RegisterMetrics(metrics.DefaultRegistry)
+
 	// services/endpoint controller
 	glog.V(3).Infof("main(): staring controllers")
-	lbex := newLbExController(clientset, lbexCfg)
+	vips, err := newVIPAllocator(lbexCfg, clientset)
+	if err != nil {
+		glog.Fatalf("failed to create the address allocator: %v", err)
+	}
+	lbex := newLbExController(clientset, lbexCfg, lb, vips)
+	if err := lbex.enableL2(); err != nil {
+		glog.Fatalf("failed to enable L2 announcements: %v", err)
+	}
+	if err := lbex.enableBGP(); err != nil {
+		glog.Fatalf("failed to enable BGP advertisements: %v", err)
+	}
+	lbex.registerMetrics(metrics.DefaultRegistry)
+	go serveHTTP(*lbexCfg.httpPort, lbex)
+	if *lbexCfg.adminPort != 0 {
+		go serveAdmin(*lbexCfg.adminPort, *lbexCfg.adminToken, lbex)
+	}
 	lbex.run()
 
-	for {
-		time.Sleep(15 * time.Second)
-	}
+	// on shutdown, the data plane is stopped, and L2 addresses and BGP routes
+	// are withdrawn
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
+	sig := <-signals
+	glog.Infof("received %v, shutting down", sig)
+	lbex.shutdown(shutdownTimeout)
+	glog.Flush()
 }
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"sort"
+	"time"
+
+	"github.com/sostheim/lbex/bgp"
+	"github.com/sostheim/lbex/metrics"
+	"github.com/sostheim/lbex/nginx"
+
+	"k8s.io/client-go/tools/cache"
+)
+
+var (
+	queueLastProcessed = metrics.NewGaugeVec("lbex_workqueue_last_processed_timestamp_seconds",
+		"Time that the work queue last finished processing an item.", "queue")
+	informerLastSync = metrics.NewGaugeVec("lbex_informer_last_sync_timestamp_seconds",
+		"Time of the informer's last add, update (including periodic resync) or delete notification.", "informer")
+)
+
+// recordInformerSyncs wraps the informer's event handler, recording the time
+// of each notification, and of each event from the API server
+func recordInformerSyncs(informer string, handler cache.ResourceEventHandlerFuncs) cache.ResourceEventHandlerFuncs {
+	synced := func() {
+		informerLastSync.With(informer).Set(float64(time.Now().Unix()))
+	}
+	return cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			synced()
+			watchEvents.observed(informer)
+			handler.OnAdd(obj)
+		},
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			synced()
+			if isWatchEvent(oldObj, newObj) {
+				watchEvents.observed(informer)
+			}
+			handler.OnUpdate(oldObj, newObj)
+		},
+		DeleteFunc: func(obj interface{}) {
+			synced()
+			watchEvents.observed(informer)
+			handler.OnDelete(obj)
+		},
+	}
+}
+
+// registerMetrics registers the controller's and the backend's metrics.  The
+// values that are derived from the controller's state are collected when the
+// metrics are scraped.
+func (lbex *lbExController) registerMetrics(r *metrics.Registry) {
+	name := lbex.lb.Name()
+
+	r.MustRegister(
+		queueLastProcessed,
+		informerLastSync,
+
+		metrics.NewCounterFunc("lbex_reloads_total",
+			"Total number of data plane reloads, by result: applied, skipped (configuration unchanged) or failed.",
+			[]string{"backend", "result"}, func() []metrics.Sample {
+				stats := lbex.lb.ReloadStats()
+				return []metrics.Sample{
+					{LabelValues: []string{name, "applied"}, Value: float64(stats.Applied)},
+					{LabelValues: []string{name, "failed"}, Value: float64(stats.Failed)},
+					{LabelValues: []string{name, "skipped"}, Value: float64(stats.Skipped)},
+				}
+			}),
+
+		metrics.NewSummaryFunc("lbex_reload_duration_seconds",
+			"Time spent in applied and failed data plane reloads.",
+			[]string{"backend"}, func() []metrics.SummarySample {
+				stats := lbex.lb.ReloadStats()
+				return []metrics.SummarySample{{
+					LabelValues: []string{name},
+					Sum:         stats.DurationSeconds,
+					Count:       stats.Applied + stats.Failed,
+				}}
+			}),
+
+		metrics.NewGaugeFunc("lbex_backend_up",
+			"Whether or not the data plane is running (1) or not (0).",
+			[]string{"backend"}, func() []metrics.Sample {
+				up := 0.0
+				if lbex.lb.Healthy() == nil {
+					up = 1
+				}
+				return []metrics.Sample{{LabelValues: []string{name}, Value: up}}
+			}),
+
+		metrics.NewGaugeFunc("lbex_services",
+			"Number of services with a generated configuration.",
+			nil, func() []metrics.Sample {
+				return []metrics.Sample{{Value: float64(len(lbex.lb.State().ServiceSummaries()))}}
+			}),
+
+		metrics.NewGaugeFunc("lbex_service_listeners",
+			"Number of listeners generated for the service.",
+			[]string{"service"}, func() []metrics.Sample {
+				return lbex.serviceSamples(func(s nginx.ServiceSummary) int { return s.Listeners })
+			}),
+
+		metrics.NewGaugeFunc("lbex_service_upstream_servers",
+			"Number of upstream servers generated for the service.",
+			[]string{"service"}, func() []metrics.Sample {
+				return lbex.serviceSamples(func(s nginx.ServiceSummary) int { return s.UpstreamServers })
+			}),
+
+		metrics.NewGaugeFunc("lbex_nodes",
+			"Number of cluster nodes, by state: active (schedulable and ready), not_ready or inactive (draining).",
+			[]string{"state"}, func() []metrics.Sample {
+				active, notReady, inactive := 0, 0, 0
+				for _, obj := range lbex.nodesStore.List() {
+					switch {
+					case IsNodeDraining(obj):
+						inactive++
+					case !IsNodeReady(obj):
+						notReady++
+					default:
+						active++
+					}
+				}
+				return []metrics.Sample{
+					{LabelValues: []string{"active"}, Value: float64(active)},
+					{LabelValues: []string{"not_ready"}, Value: float64(notReady)},
+					{LabelValues: []string{"inactive"}, Value: float64(inactive)},
+				}
+			}),
+
+		metrics.NewGaugeFunc("lbex_vip_allocations",
+			"Number of LoadBalancer service addresses allocated from the --vip-range pool.",
+			[]string{"pool"}, func() []metrics.Sample {
+				samples := []metrics.Sample{}
+				if lbex.vips == nil {
+					return samples
+				}
+				allocated := lbex.vips.Allocated()
+				for _, pool := range lbex.vips.Pools().Names() {
+					samples = append(samples, metrics.Sample{LabelValues: []string{pool}, Value: float64(allocated[pool])})
+				}
+				return samples
+			}),
+
+		metrics.NewGaugeFunc("lbex_l2_active",
+			"Whether or not this instance holds the L2 lease, and announces the addresses (1) or not (0).",
+			[]string{"interface"}, func() []metrics.Sample {
+				if lbex.announcer == nil {
+					return []metrics.Sample{}
+				}
+				active := 0.0
+				if lbex.announcer.Active() {
+					active = 1
+				}
+				return []metrics.Sample{{LabelValues: []string{*lbex.cfg.l2Interface}, Value: active}}
+			}),
+
+		metrics.NewGaugeFunc("lbex_bgp_session_up",
+			"Whether or not the session with the BGP peer is established (1) or not (0).",
+			[]string{"pool", "peer"}, func() []metrics.Sample {
+				samples := []metrics.Sample{}
+				if lbex.speaker == nil {
+					return samples
+				}
+				for _, status := range lbex.speaker.Status() {
+					up := 0.0
+					if status.State == bgp.StateEstablished {
+						up = 1
+					}
+					samples = append(samples, metrics.Sample{LabelValues: []string{status.Pool, status.Address}, Value: up})
+				}
+				return samples
+			}),
+
+		metrics.NewGaugeFunc("lbex_bgp_advertised_routes",
+			"Number of routes advertised to the BGP peer.",
+			[]string{"pool", "peer"}, func() []metrics.Sample {
+				samples := []metrics.Sample{}
+				if lbex.speaker == nil {
+					return samples
+				}
+				for _, status := range lbex.speaker.Status() {
+					samples = append(samples, metrics.Sample{LabelValues: []string{status.Pool, status.Address}, Value: float64(status.Routes)})
+				}
+				return samples
+			}),
+	)
+}
+
+// serviceSamples returns one sample per service, ordered by service key
+func (lbex *lbExController) serviceSamples(value func(nginx.ServiceSummary) int) []metrics.Sample {
+	summaries := lbex.lb.State().ServiceSummaries()
+	keys := make([]string, 0, len(summaries))
+	for key := range summaries {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	samples := make([]metrics.Sample, 0, len(keys))
+	for _, key := range keys {
+		samples = append(samples, metrics.Sample{LabelValues: []string{key}, Value: float64(value(summaries[key]))})
+	}
+	return samples
+}
@@ -0,0 +1,438 @@
+// Package metrics implements the small subset of Prometheus metric types that
+// LBEX needs, exposed in the Prometheus text exposition format.
+// https://prometheus.io/docs/instrumenting/exposition_formats/
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	counterType = "counter"
+	gaugeType   = "gauge"
+	summaryType = "summary"
+
+	contentType = "text/plain; version=0.0.4; charset=utf-8"
+)
+
+// Family is a named set of metrics of one type, distinguished by label values
+type Family interface {
+	// Name returns the metric name
+	Name() string
+	// write writes the family in the text exposition format
+	write(w io.Writer)
+}
+
+// Registry is a set of metric families
+type Registry struct {
+	lock     sync.RWMutex
+	families map[string]Family
+}
+
+// NewRegistry creates an empty Registry
+func NewRegistry() *Registry {
+	return &Registry{families: make(map[string]Family)}
+}
+
+// DefaultRegistry - the registry served by LBEX's /metrics endpoint
+var DefaultRegistry = NewRegistry()
+
+// MustRegister adds the families to the registry, it panics if a family of
+// the same name is already registered.
+func (r *Registry) MustRegister(families ...Family) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	for _, f := range families {
+		if _, exists := r.families[f.Name()]; exists {
+			panic("metrics: duplicate metric name: " + f.Name())
+		}
+		r.families[f.Name()] = f
+	}
+}
+
+// Write writes every family, ordered by name
+func (r *Registry) Write(w io.Writer) error {
+	r.lock.RLock()
+	names := make([]string, 0, len(r.families))
+	for name := range r.families {
+		names = append(names, name)
+	}
+	r.lock.RUnlock()
+	sort.Strings(names)
+
+	bw := bufio.NewWriter(w)
+	for _, name := range names {
+		r.lock.RLock()
+		f := r.families[name]
+		r.lock.RUnlock()
+		f.write(bw)
+	}
+	return bw.Flush()
+}
+
+// ServeHTTP serves the registry's metrics
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", contentType)
+	r.Write(w)
+}
+
+// desc is the description common to every family
+type desc struct {
+	name       string
+	help       string
+	labelNames []string
+}
+
+func (d *desc) Name() string {
+	return d.name
+}
+
+func (d *desc) writeHeader(w io.Writer, typ string) {
+	help := strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(d.help)
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", d.name, help, d.name, typ)
+}
+
+// labels returns the formatted label set for labelValues, plus any extra
+// label pairs (name, value, ...)
+func (d *desc) labels(labelValues []string, extra ...string) string {
+	pairs := []string{}
+	for i, name := range d.labelNames {
+		value := ""
+		if i < len(labelValues) {
+			value = labelValues[i]
+		}
+		pairs = append(pairs, name+`="`+escapeLabel(value)+`"`)
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		pairs = append(pairs, extra[i]+`="`+escapeLabel(extra[i+1])+`"`)
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func escapeLabel(value string) string {
+	return strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`).Replace(value)
+}
+
+func formatValue(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// labelIndex returns the index of the named label, or -1
+func (d *desc) labelIndex(name string) int {
+	for i, labelName := range d.labelNames {
+		if labelName == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// labelKey joins label values in to a map key
+func labelKey(labelValues []string) string {
+	return strings.Join(labelValues, "\xff")
+}
+
+// Value is a single counter or gauge value
+type Value struct {
+	lock  sync.Mutex
+	value float64
+}
+
+// Inc adds 1
+func (v *Value) Inc() {
+	v.Add(1)
+}
+
+// Dec subtracts 1, it must only be used for gauges
+func (v *Value) Dec() {
+	v.Add(-1)
+}
+
+// Add adds delta, which must not be negative for counters
+func (v *Value) Add(delta float64) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	v.value += delta
+}
+
+// Set sets the value, it must only be used for gauges
+func (v *Value) Set(value float64) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	v.value = value
+}
+
+// Get returns the current value
+func (v *Value) Get() float64 {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	return v.value
+}
+
+// valueVec is a counter or gauge family
+type valueVec struct {
+	desc
+	typ string
+
+	lock   sync.Mutex
+	values map[string]*Value
+	labels map[string][]string
+}
+
+func newValueVec(typ, name, help string, labelNames []string) *valueVec {
+	return &valueVec{
+		desc:   desc{name: name, help: help, labelNames: labelNames},
+		typ:    typ,
+		values: make(map[string]*Value),
+		labels: make(map[string][]string),
+	}
+}
+
+// With returns the value for labelValues, creating it if necessary
+func (vv *valueVec) With(labelValues ...string) *Value {
+	key := labelKey(labelValues)
+	vv.lock.Lock()
+	defer vv.lock.Unlock()
+	v, ok := vv.values[key]
+	if !ok {
+		v = &Value{}
+		vv.values[key] = v
+		vv.labels[key] = append([]string{}, labelValues...)
+	}
+	return v
+}
+
+// Delete removes the value for labelValues
+func (vv *valueVec) Delete(labelValues ...string) {
+	key := labelKey(labelValues)
+	vv.lock.Lock()
+	defer vv.lock.Unlock()
+	delete(vv.values, key)
+	delete(vv.labels, key)
+}
+
+// DeleteMatching removes every value whose label name has value
+func (vv *valueVec) DeleteMatching(name, value string) {
+	i := vv.labelIndex(name)
+	if i < 0 {
+		return
+	}
+	vv.lock.Lock()
+	defer vv.lock.Unlock()
+	for key, labelValues := range vv.labels {
+		if i < len(labelValues) && labelValues[i] == value {
+			delete(vv.values, key)
+			delete(vv.labels, key)
+		}
+	}
+}
+
+func (vv *valueVec) write(w io.Writer) {
+	vv.lock.Lock()
+	defer vv.lock.Unlock()
+	vv.writeHeader(w, vv.typ)
+	keys := make([]string, 0, len(vv.values))
+	for key := range vv.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		fmt.Fprintf(w, "%s%s %s\n", vv.name, vv.desc.labels(vv.labels[key]), formatValue(vv.values[key].Get()))
+	}
+}
+
+// CounterVec is a family of counters
+type CounterVec struct {
+	*valueVec
+}
+
+// NewCounterVec creates a counter family
+func NewCounterVec(name, help string, labelNames ...string) *CounterVec {
+	return &CounterVec{newValueVec(counterType, name, help, labelNames)}
+}
+
+// GaugeVec is a family of gauges
+type GaugeVec struct {
+	*valueVec
+}
+
+// NewGaugeVec creates a gauge family
+func NewGaugeVec(name, help string, labelNames ...string) *GaugeVec {
+	return &GaugeVec{newValueVec(gaugeType, name, help, labelNames)}
+}
+
+// Summary accumulates the sum and count of observations.  Quantiles are not
+// calculated.
+type Summary struct {
+	lock  sync.Mutex
+	sum   float64
+	count uint64
+}
+
+// Observe adds an observation
+func (s *Summary) Observe(v float64) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.sum += v
+	s.count++
+}
+
+func (s *Summary) get() (float64, uint64) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.sum, s.count
+}
+
+// SummaryVec is a family of summaries
+type SummaryVec struct {
+	desc
+
+	lock      sync.Mutex
+	summaries map[string]*Summary
+	labels    map[string][]string
+}
+
+// NewSummaryVec creates a summary family
+func NewSummaryVec(name, help string, labelNames ...string) *SummaryVec {
+	return &SummaryVec{
+		desc:      desc{name: name, help: help, labelNames: labelNames},
+		summaries: make(map[string]*Summary),
+		labels:    make(map[string][]string),
+	}
+}
+
+// With returns the summary for labelValues, creating it if necessary
+func (sv *SummaryVec) With(labelValues ...string) *Summary {
+	key := labelKey(labelValues)
+	sv.lock.Lock()
+	defer sv.lock.Unlock()
+	s, ok := sv.summaries[key]
+	if !ok {
+		s = &Summary{}
+		sv.summaries[key] = s
+		sv.labels[key] = append([]string{}, labelValues...)
+	}
+	return s
+}
+
+// DeleteMatching removes every summary whose label name has value
+func (sv *SummaryVec) DeleteMatching(name, value string) {
+	i := sv.labelIndex(name)
+	if i < 0 {
+		return
+	}
+	sv.lock.Lock()
+	defer sv.lock.Unlock()
+	for key, labelValues := range sv.labels {
+		if i < len(labelValues) && labelValues[i] == value {
+			delete(sv.summaries, key)
+			delete(sv.labels, key)
+		}
+	}
+}
+
+func (sv *SummaryVec) write(w io.Writer) {
+	sv.lock.Lock()
+	defer sv.lock.Unlock()
+	sv.writeHeader(w, summaryType)
+	keys := make([]string, 0, len(sv.summaries))
+	for key := range sv.summaries {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		sum, count := sv.summaries[key].get()
+		labels := sv.desc.labels(sv.labels[key])
+		fmt.Fprintf(w, "%s_sum%s %s\n", sv.name, labels, formatValue(sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", sv.name, labels, count)
+	}
+}
+
+// Sample is a single value of a FuncVec
+type Sample struct {
+	LabelValues []string
+	Value       float64
+}
+
+// FuncVec is a counter or gauge family whose values are collected from a
+// function at the time of each scrape
+type FuncVec struct {
+	desc
+	typ     string
+	collect func() []Sample
+}
+
+// NewGaugeFunc creates a gauge family that is collected by calling collect
+func NewGaugeFunc(name, help string, labelNames []string, collect func() []Sample) *FuncVec {
+	return &FuncVec{
+		desc:    desc{name: name, help: help, labelNames: labelNames},
+		typ:     gaugeType,
+		collect: collect,
+	}
+}
+
+// NewCounterFunc creates a counter family that is collected by calling collect
+func NewCounterFunc(name, help string, labelNames []string, collect func() []Sample) *FuncVec {
+	return &FuncVec{
+		desc:    desc{name: name, help: help, labelNames: labelNames},
+		typ:     counterType,
+		collect: collect,
+	}
+}
+
+func (fv *FuncVec) write(w io.Writer) {
+	fv.writeHeader(w, fv.typ)
+	for _, s := range fv.collect() {
+		fmt.Fprintf(w, "%s%s %s\n", fv.name, fv.desc.labels(s.LabelValues), formatValue(s.Value))
+	}
+}
+
+// SummarySample is a single value of a SummaryFuncVec
+type SummarySample struct {
+	LabelValues []string
+	Sum         float64
+	Count       uint64
+}
+
+// SummaryFuncVec is a summary family whose values are collected from a
+// function at the time of each scrape
+type SummaryFuncVec struct {
+	desc
+	collect func() []SummarySample
+}
+
+// NewSummaryFunc creates a summary family that is collected by calling collect
+func NewSummaryFunc(name, help string, labelNames []string, collect func() []SummarySample) *SummaryFuncVec {
+	return &SummaryFuncVec{
+		desc:    desc{name: name, help: help, labelNames: labelNames},
+		collect: collect,
+	}
+}
+
+func (sf *SummaryFuncVec) write(w io.Writer) {
+	sf.writeHeader(w, summaryType)
+	for _, s := range sf.collect() {
+		labels := sf.desc.labels(s.LabelValues)
+		fmt.Fprintf(w, "%s_sum%s %s\n", sf.name, labels, formatValue(s.Sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", sf.name, labels, s.Count)
+	}
+}
@@ -0,0 +1,50 @@
+package metrics
+
+import (
+	"k8s.io/kubernetes/pkg/util/workqueue"
+)
+
+// workqueue metric families, labelled by queue name
+var (
+	queueDepth = NewGaugeVec("lbex_workqueue_depth",
+		"Current depth of the work queue.", "queue")
+	queueAdds = NewCounterVec("lbex_workqueue_adds_total",
+		"Total number of items added to the work queue.", "queue")
+	queueLatency = NewSummaryVec("lbex_workqueue_queue_latency_microseconds",
+		"How long an item stays in the work queue before being processed.", "queue")
+	queueWorkDuration = NewSummaryVec("lbex_workqueue_work_duration_microseconds",
+		"How long processing an item from the work queue takes.", "queue")
+	queueRetries = NewCounterVec("lbex_workqueue_retries_total",
+		"Total number of items requeued after a processing error.", "queue")
+)
+
+// workqueueProvider implements workqueue.MetricsProvider
+type workqueueProvider struct{}
+
+func (workqueueProvider) NewDepthMetric(name string) workqueue.GaugeMetric {
+	return queueDepth.With(name)
+}
+
+func (workqueueProvider) NewAddsMetric(name string) workqueue.CounterMetric {
+	return queueAdds.With(name)
+}
+
+func (workqueueProvider) NewLatencyMetric(name string) workqueue.SummaryMetric {
+	return queueLatency.With(name)
+}
+
+func (workqueueProvider) NewWorkDurationMetric(name string) workqueue.SummaryMetric {
+	return queueWorkDuration.With(name)
+}
+
+func (workqueueProvider) NewRetriesMetric(name string) workqueue.CounterMetric {
+	return queueRetries.With(name)
+}
+
+// RegisterWorkqueueMetrics registers the work queue metric families with the
+// registry, and sets them as the provider for all named work queues.  It must
+// be called before any named work queue is created.
+func RegisterWorkqueueMetrics(r *Registry) {
+	r.MustRegister(queueDepth, queueAdds, queueLatency, queueWorkDuration, queueRetries)
+	workqueue.SetProvider(workqueueProvider{})
+}
@@ -3,6 +3,8 @@ package nginx
 import (
 	"errors"
 	"fmt"
+	"net"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -12,102 +14,56 @@ import (
 	"k8s.io/client-go/pkg/api"
 	v1 "k8s.io/client-go/pkg/api/v1"
 	"k8s.io/client-go/pkg/apis/extensions/v1beta1"
+	"k8s.io/client-go/pkg/labels"
 )
 
 const emptyHost = ""
 const udpProto = "udp"
 
+// placeholderStreamUpstreamServer - the server of an upstream that has none
+var placeholderStreamUpstreamServer = StreamUpstreamServer{Address: "127.0.0.1:1", Down: true}
+
 // SingleDefaultPortName - provide a default name for a port that doesn't required one
 const SingleDefaultPortName = "unnamed"
 
-var (
-	// map node names (key) to Node type
-	nodes = make(map[string]Node)
-
-	// map service key to nodes that populate the services upstream
-	serviceUpstreamNodes = make(map[string][]Node)
-
-	// map service key to the target that populate the services upstream
-	serviceUpstreamTarget = make(map[string][]Target)
-
-	// Why aren't these two maps combined in to a map of []inerface{} types
-	// so we can just insert either Nodes or Targets against the same key?
-	// See this discussion: https://github.com/golang/go/wiki/InterfaceSlice
-)
-
 // Configurator transforms an Ingress or Service resource into NGINX Configuration
 type Configurator struct {
 	ngxc   *NginxController
 	config *HTTPContext
+	state  *State
 	lock   sync.Mutex
+	// hosts - checks that node hostnames resolve
+	hosts *hostResolver
 }
 
-// NewConfigurator creates a new Configurator
+// NewConfigurator creates a new Configurator.  ngxc may be nil when the
+// Configurator is only used to generate configuration (GenerateStreamConfig).
 func NewConfigurator(ngxc *NginxController) *Configurator {
 	return &Configurator{
 		ngxc:   ngxc,
 		config: NewDefaultHTTPContext(),
+		state:  NewState(),
+		hosts:  newHostResolver(),
 	}
 }
 
-func serviceListByNodeAddress(address string) (list []string) {
-	// TODO: should probably replace this nested loop search with a reverse map -> service keys
-	for svc, upstreamNodes := range serviceUpstreamNodes {
-		for _, node := range upstreamNodes {
-			if node.InternalIP == address || node.ExternalIP == address {
-				list = append(list, svc)
-				break
-			}
-		}
-	}
-	return
-}
-
-func serviceListByNodeName(name string) (list []string) {
-	// TODO: should probably replace this nested loop search with a reverse map -> service keys
-	for svc, upstreamNodes := range serviceUpstreamNodes {
-		for _, node := range upstreamNodes {
-			if node.Name == name {
-				list = append(list, svc)
-				break
-			}
-		}
-	}
-	return
+// State returns the Configurator's node and service upstream state
+func (cfgtor *Configurator) State() *State {
+	return cfgtor.state
 }
 
-// AddOrUpdateNode - add, update (including removing) the node from the set of upstream candidates
+// AddOrUpdateNode - add, update (including removing) the node from the set of
+// upstream candidates, returns the keys of the services that are affected.
 func (cfgtor *Configurator) AddOrUpdateNode(node Node) []string {
 	cfgtor.lock.Lock()
 	defer cfgtor.lock.Unlock()
-
-	services := []string{}
-	elem, ok := nodes[node.Name]
-	if !ok {
-		glog.V(4).Infof("add new node: %v", node)
-		nodes[node.Name] = node
-	} else {
-		if node.Active {
-			glog.V(4).Infof("update existing active node: %v", node)
-			nodes[node.Name] = node
-			if elem.InternalIP != node.InternalIP {
-				services = serviceListByNodeAddress(elem.InternalIP)
-			}
-			if elem.ExternalIP != node.ExternalIP {
-				services = append(services, serviceListByNodeAddress(elem.ExternalIP)...)
-			}
-		} else {
-			glog.V(4).Infof("update (delete) existing inactive node: %v", node)
-			delete(nodes, node.Name)
-			services = serviceListByNodeName(node.Name)
-		}
-	}
-	return services
+	return cfgtor.state.UpdateNode(node)
 }
 
-// DeleteNode - removes the node (if it exists) from the nodeIPAddresses slice
+// DeleteNode - removes the node (if it exists) from the set of upstream
+// candidates, returns the keys of the services that are affected.
 func (cfgtor *Configurator) DeleteNode(key string) []string {
-	node, ok := nodes[key]
+	node, ok := cfgtor.state.Node(key)
 	if ok {
 		node.Active = false
 		return cfgtor.AddOrUpdateNode(node)
@@ -132,16 +88,24 @@ func (cfgtor *Configurator) AddOrUpdateIngress(name string, ingEx *IngressEx) er
 	cfgtor.lock.Lock()
 	defer cfgtor.lock.Unlock()
 
-	pems := cfgtor.updateCertificates(ingEx)
+	pems, err := cfgtor.updateCertificates(ingEx)
+	if err != nil {
+		return err
+	}
 	nginxCfg := cfgtor.generateNginxIngressCfg(ingEx, pems)
-	cfgtor.ngxc.AddOrUpdateHTTPConfiguration(name, nginxCfg)
+	if err := cfgtor.ngxc.AddOrUpdateHTTPConfiguration(name, nginxCfg); err != nil {
+		return err
+	}
 	if err := cfgtor.ngxc.Reload(); err != nil {
-		glog.Errorf("error on reload adding or updating ingress %q: %q", name, err)
+		return fmt.Errorf("error on reload adding or updating ingress %q: %v", name, err)
 	}
 	return nil
 }
 
-// AddOrUpdateService adds or updates NGINX configuration for an Service object
+// AddOrUpdateService adds or updates NGINX configuration for an Service object.
+// If NGINX rejects the generated configuration the service's last good
+// configuration is retained, the service is quarantined until a valid
+// configuration is generated for it, and an InvalidConfigError is returned.
 func (cfgtor *Configurator) AddOrUpdateService(svc *ServiceSpec) error {
 	if cfgtor.ngxc.cfgType != StreamCfg && cfgtor.ngxc.cfgType != StreamHTTPCfg {
 		return errors.New("addOrUpdateService: I'm sorry Dave, I'm afraid I can't do that")
@@ -151,14 +115,17 @@ func (cfgtor *Configurator) AddOrUpdateService(svc *ServiceSpec) error {
 	defer cfgtor.lock.Unlock()
 
 	nginxCfg := cfgtor.generateStreamNginxConfig(svc)
-	cfgtor.ngxc.AddOrUpdateStream(svc.ConfigName, nginxCfg)
+	if err := cfgtor.ngxc.AddOrUpdateStream(svc.ConfigName, nginxCfg); err != nil {
+		// the service's previous configuration is still in place, nothing to reload
+		return err
+	}
 	if err := cfgtor.ngxc.Reload(); err != nil {
-		glog.Errorf("error on reload adding or updating service %q: %q", svc.ConfigName, err)
+		return fmt.Errorf("error on reload adding or updating service %q: %v", svc.ConfigName, err)
 	}
 	return nil
 }
 
-func (cfgtor *Configurator) updateCertificates(ingEx *IngressEx) map[string]string {
+func (cfgtor *Configurator) updateCertificates(ingEx *IngressEx) (map[string]string, error) {
 	pems := make(map[string]string)
 
 	for _, tls := range ingEx.Ingress.Spec.TLS {
@@ -179,7 +146,10 @@ func (cfgtor *Configurator) updateCertificates(ingEx *IngressEx) map[string]stri
 		}
 
 		name := ingEx.Ingress.Namespace + "-" + secretName
-		pemFileName := cfgtor.ngxc.AddOrUpdateCertAndKey(name, string(cert), string(key))
+		pemFileName, err := cfgtor.ngxc.AddOrUpdateCertAndKey(name, string(cert), string(key))
+		if err != nil {
+			return nil, err
+		}
 
 		for _, host := range tls.Hosts {
 			pems[host] = pemFileName
@@ -189,7 +159,7 @@ func (cfgtor *Configurator) updateCertificates(ingEx *IngressEx) map[string]stri
 		}
 	}
 
-	return pems
+	return pems, nil
 }
 
 func (cfgtor *Configurator) generateNginxIngressCfg(ingEx *IngressEx, pems map[string]string) HTTPNginxConfig {
@@ -310,6 +280,15 @@ func (cfgtor *Configurator) generateNginxIngressCfg(ingEx *IngressEx, pems map[s
 	return HTTPNginxConfig{Upstreams: upstreamMapToSlice(upstreams), Servers: servers}
 }
 
+// GenerateStreamConfig generates the stream configuration model for the
+// service, and updates the service's upstream state, without writing or
+// applying the configuration.
+func (cfgtor *Configurator) GenerateStreamConfig(svc *ServiceSpec) StreamNginxConfig {
+	cfgtor.lock.Lock()
+	defer cfgtor.lock.Unlock()
+	return cfgtor.generateStreamNginxConfig(svc)
+}
+
 func (cfgtor *Configurator) generateStreamNginxConfig(svc *ServiceSpec) (svcConfig StreamNginxConfig) {
 	glog.V(4).Infof("create StreamNginxConfig for svc: %s, spec: %s", svc.Key, svc)
 
@@ -317,13 +296,33 @@ func (cfgtor *Configurator) generateStreamNginxConfig(svc *ServiceSpec) (svcConf
 		svcConfig.Resolver = val
 	}
 
+	val, _ := annotations.GetOptionalStringAnnotation(annotations.LBEXNodeSet, svc.Service)
+	set := ValidateNodeSet(val)
+
+	val, _ = annotations.GetOptionalStringAnnotation(annotations.LBEXNodeAddressType, svc.Service)
+	addressTypes := ValidateNodeAddressTypes(val)
+
+	val, _ = annotations.GetOptionalStringAnnotation(annotations.LBEXIPFamily, svc.Service)
+	family := ValidateIPFamily(val)
+
+	// dual stack listeners are on all addresses, not on a single service
+	// address, the controller reports the annotation as a substitution
+	dualStack, _ := annotations.GetOptionalBoolAnnotation(annotations.LBEXDualStack, svc.Service)
+	if dualStack && svc.ListenAddress != "" {
+		glog.V(3).Infof("service %s: dual stack listeners are not supported with load balancer address %s", svc.Key, svc.ListenAddress)
+		dualStack = false
+	}
+
 	upstreams := make(map[string]*StreamUpstream)
+	upstreamNodes := []string{}
 
 	for _, target := range svc.Topology {
 		var upstream StreamUpstream
 		switch svc.UpstreamType {
 		case HostNode:
-			upstream = cfgtor.createNodesStreamUpstream(svc, target)
+			var members []string
+			upstream, members = cfgtor.createNodesStreamUpstream(svc, target, set, addressTypes, family, svcConfig.Resolver)
+			upstreamNodes = append(upstreamNodes, members...)
 		case Pod:
 			upstream = cfgtor.createPodStreamUpstream(svc, target)
 		case ClusterIP:
@@ -361,12 +360,16 @@ func (cfgtor *Configurator) generateStreamNginxConfig(svc *ServiceSpec) (svcConf
 
 			server := StreamServer{
 				Listen: StreamListen{
-					Port: strconv.Itoa(listenPort),
-					UDP:  strings.EqualFold(target.Protocol, udpProto),
+					Address:   svc.ListenAddress,
+					Port:      strconv.Itoa(listenPort),
+					UDP:       strings.EqualFold(target.Protocol, udpProto),
+					DualStack: dualStack,
 				},
 				ProxyProtocol:    false,
 				ProxyPassthrough: passThrough,
 				ProxyPassAddress: upstream.Name,
+				Service:          svc.Key,
+				PortName:         target.PortName,
 			}
 			svcConfig.Servers = append(svcConfig.Servers, server)
 		} else {
@@ -375,9 +378,23 @@ func (cfgtor *Configurator) generateStreamNginxConfig(svc *ServiceSpec) (svcConf
 		}
 	}
 
+	summary := ServiceSummary{Listeners: len(svcConfig.Servers)}
 	for _, up := range upstreams {
+		summary.UpstreamServers += len(up.UpstreamServers)
+		if len(up.UpstreamServers) == 0 {
+			// NGINX rejects an upstream without servers, e.g. when every node
+			// has been excluded, so the service's connections are refused
+			glog.Warningf("service %s: upstream %s has no servers", svc.Key, up.Name)
+			up.UpstreamServers = []StreamUpstreamServer{placeholderStreamUpstreamServer}
+		}
+		promoteBackups(up)
 		svcConfig.Upstreams = append(svcConfig.Upstreams, *up)
 	}
+	sortStreamConfig(&svcConfig)
+
+	cfgtor.state.SetServiceUpstreams(svc.Key, upstreamNodes, svc.Topology,
+		svc.UpstreamType == HostNode && set == All)
+	cfgtor.state.SetServiceSummary(svc.Key, summary)
 
 	glog.V(4).Infof("created StreamNginxConfig: %s", svcConfig)
 
@@ -582,8 +599,12 @@ func (cfgtor *Configurator) createUpstream(ingEx *IngressEx, name string, backen
 	if exists {
 		var upsServers []UpstreamServer
 		for _, endp := range endps {
-			addressport := strings.Split(endp, ":")
-			upsServers = append(upsServers, UpstreamServer{addressport[0], addressport[1]})
+			address, port, err := net.SplitHostPort(endp)
+			if err != nil {
+				glog.Warningf("invalid endpoint %q of %s: %v", endp, name, err)
+				continue
+			}
+			upsServers = append(upsServers, UpstreamServer{address, port})
 		}
 		if len(upsServers) > 0 {
 			ups.UpstreamServers = upsServers
@@ -593,70 +614,123 @@ func (cfgtor *Configurator) createUpstream(ingEx *IngressEx, name string, backen
 }
 
 func (cfgtor *Configurator) createClusterStreamUpstream(spec *ServiceSpec, target Target) StreamUpstream {
-	serviceUpstreamTarget[spec.Key] = append(serviceUpstreamTarget[spec.Key], target)
 	return StreamUpstream{
 		Name: getNameForStreamUpstream(spec.Service, target.PortName),
 		UpstreamServers: []StreamUpstreamServer{
-			{Address: spec.ClusterIP + ":" + strconv.Itoa(target.ServicePort)}},
+			{Address: net.JoinHostPort(spec.ClusterIP, strconv.Itoa(target.ServicePort))}},
 	}
 }
 
 func (cfgtor *Configurator) createPodStreamUpstream(spec *ServiceSpec, target Target) StreamUpstream {
-	serviceUpstreamTarget[spec.Key] = append(serviceUpstreamTarget[spec.Key], target)
 	return StreamUpstream{
 		Name: getNameForStreamUpstream(spec.Service, target.PortName),
 		UpstreamServers: []StreamUpstreamServer{
-			{Address: target.PodIP + ":" + strconv.Itoa(target.PodPort)}},
+			{Address: net.JoinHostPort(target.PodIP, strconv.Itoa(target.PodPort))}},
 	}
 }
 
-func (cfgtor *Configurator) createNodesStreamUpstream(spec *ServiceSpec, target Target) StreamUpstream {
-	val, _ := annotations.GetOptionalStringAnnotation(annotations.LBEXNodeSet, spec.Service)
-	set := ValidateNodeSet(val)
-
-	val, _ = annotations.GetOptionalStringAnnotation(annotations.LBEXNodeAddressType, spec.Service)
-	addressType := ValidateNodeAddressType(val)
-
+// createNodesStreamUpstream returns the upstream for the target, and the names
+// of the nodes that are members of the upstream.  Only nodes that match the
+// service's node selector are candidates.  Nodes without an address of
+// any of the address types are excluded, nodes that are not ready are marked
+// down, and draining nodes are backup servers.
+func (cfgtor *Configurator) createNodesStreamUpstream(spec *ServiceSpec, target Target, set string, addressTypes []string, family, resolver string) (StreamUpstream, []string) {
 	su := StreamUpstream{
 		Name: getNameForStreamUpstream(spec.Service, target.PortName),
 	}
-	glog.V(4).Infof("node set: %s, address type: %s, stream name: %s", set, addressType, su.Name)
+	glog.V(4).Infof("node set: %s, address types: %v, family: %s, node selector: %q, stream name: %s",
+		set, addressTypes, family, spec.NodeSelector, su.Name)
+
+	selector, err := labels.Parse(spec.NodeSelector)
+	if err != nil {
+		glog.Warningf("service %s: invalid node selector %q, using all nodes: %v", spec.Key, spec.NodeSelector, err)
+		selector = labels.Everything()
+	}
 
+	var nodes []Node
 	switch set {
 	case Host:
-		node, ok := nodes[target.NodeName]
+		node, ok := cfgtor.state.Node(target.NodeName)
 		if !ok {
 			glog.Warningf("no nodes map entry found for: %s", target.NodeName)
 			break
 		}
-		su.UpstreamServers = append(su.UpstreamServers,
-			StreamUpstreamServer{Address: formatAddress(addressType, &node, &target)})
-		serviceUpstreamNodes[spec.Key] = []Node{node}
+		nodes = append(nodes, node)
 
 	case All:
-		upstreamNodes := []Node{}
-		for _, node := range nodes {
-			su.UpstreamServers = append(su.UpstreamServers,
-				StreamUpstreamServer{Address: formatAddress(addressType, &node, &target)})
-			upstreamNodes = append(upstreamNodes, node)
-		}
-		serviceUpstreamNodes[spec.Key] = upstreamNodes
+		nodes = cfgtor.state.Nodes()
 
 	default:
 		glog.Warningf("hit a switch case DEFAULT <---> %s", set)
 	}
-	return su
+
+	members := []string{}
+	for i := range nodes {
+		if !selector.Matches(labels.Set(nodes[i].Labels)) {
+			glog.V(4).Infof("service %s: node %s does not match the node selector", spec.Key, nodes[i].Name)
+			continue
+		}
+		address, ok := cfgtor.formatAddress(addressTypes, family, resolver, &nodes[i], &target)
+		if !ok {
+			glog.Warningf("service %s: node %s has no usable %s address of type: %s, excluded from upstream %s",
+				spec.Key, nodes[i].Name, family, strings.Join(addressTypes, ","), su.Name)
+			continue
+		}
+		su.UpstreamServers = append(su.UpstreamServers, StreamUpstreamServer{
+			Address: address,
+			Down:    !nodes[i].Ready,
+			// NGINX does not support backup servers with the hash algorithm, so
+			// a draining node remains a regular server until it is removed
+			Backup: nodes[i].Draining && nodes[i].Ready && spec.Algorithm != SourceIPHash,
+		})
+		members = append(members, nodes[i].Name)
+	}
+	return su, members
 }
 
-func formatAddress(addrType string, node *Node, target *Target) string {
-	var address string
-	if addrType == Internal {
-		address = node.InternalIP + ":" + strconv.Itoa(target.NodePort)
-	} else {
-		address = node.ExternalIP + ":" + strconv.Itoa(target.NodePort)
+// formatAddress returns the node's address of the first of the address types
+// that the node has, in the IP family, with the target's node port.  A
+// hostname is only used if it resolves.  ok is false if the node has none of
+// the address types.
+func (cfgtor *Configurator) formatAddress(addrTypes []string, family, resolver string, node *Node, target *Target) (address string, ok bool) {
+	for _, addrType := range addrTypes {
+		var host string
+		switch {
+		case addrType == Hostname:
+			if node.Hostname != "" && cfgtor.hosts.resolves(node.Hostname, resolver) {
+				host = node.Hostname
+			}
+		case addrType == Internal && family == IPv6:
+			host = node.InternalIPv6
+		case addrType == Internal:
+			host = node.InternalIP
+		case family == IPv6:
+			host = node.ExternalIPv6
+		default:
+			host = node.ExternalIP
+		}
+		if host == "" {
+			continue
+		}
+		address = net.JoinHostPort(host, strconv.Itoa(target.NodePort))
+		glog.V(4).Infof("formatted address: %s", address)
+		return address, true
+	}
+	return "", false
+}
+
+// promoteBackups makes every server of an upstream that only has backup
+// servers, e.g. when every node is draining, a regular server, as NGINX
+// rejects an upstream without any
+func promoteBackups(up *StreamUpstream) {
+	for _, server := range up.UpstreamServers {
+		if !server.Backup {
+			return
+		}
+	}
+	for i := range up.UpstreamServers {
+		up.UpstreamServers[i].Backup = false
 	}
-	glog.V(4).Infof("formatted address: %s", address)
-	return address
 }
 
 func pathOrDefault(path string) string {
@@ -685,30 +759,43 @@ func upstreamMapToSlice(upstreams map[string]Upstream) []Upstream {
 	for _, ups := range upstreams {
 		result = append(result, ups)
 	}
+	sort.Sort(upstreamByName(result))
 	return result
 }
 
 // DeleteConfiguration deletes NGINX configuration for an Ingress Resource or Service LoadBalancer
-func (cfgtor *Configurator) DeleteConfiguration(name string, cfgType Configuration) {
+func (cfgtor *Configurator) DeleteConfiguration(name string, cfgType Configuration) error {
 	cfgtor.lock.Lock()
 	defer cfgtor.lock.Unlock()
 
+	var err error
 	switch cfgType {
 	case StreamCfg:
-		cfgtor.ngxc.DeleteStreamConfiguration(name)
+		err = cfgtor.ngxc.DeleteStreamConfiguration(name)
 	case HTTPCfg:
-		cfgtor.ngxc.DeleteHTTPConfiguration(name)
+		err = cfgtor.ngxc.DeleteHTTPConfiguration(name)
 	case StreamHTTPCfg:
-		cfgtor.ngxc.DeleteStreamConfiguration(name)
-		cfgtor.ngxc.DeleteHTTPConfiguration(name)
+		err = cfgtor.ngxc.DeleteStreamConfiguration(name)
+		if herr := cfgtor.ngxc.DeleteHTTPConfiguration(name); err == nil {
+			err = herr
+		}
 	default:
 		glog.Warningf("hit a switch case DEFAULT <---> %v", cfgType)
 	}
-	delete(serviceUpstreamNodes, name)
-	delete(serviceUpstreamTarget, name)
+	if err != nil {
+		return err
+	}
 	if err := cfgtor.ngxc.Reload(); err != nil {
-		glog.Errorf("error on reload, removing configuration: %q: %q", name, err)
+		return fmt.Errorf("error on reload, removing configuration: %q: %v", name, err)
 	}
+	return nil
+}
+
+// DeleteService deletes the NGINX configuration and upstream state for the
+// Service LoadBalancer identified by key, with configuration name name.
+func (cfgtor *Configurator) DeleteService(key, name string) error {
+	cfgtor.state.RemoveService(key)
+	return cfgtor.DeleteConfiguration(name, StreamCfg)
 }
 
 // UpdateIngressEndpoints updates endpoints in NGINX configuration for an Ingress resource
@@ -716,8 +803,7 @@ func (cfgtor *Configurator) UpdateIngressEndpoints(name string, ingEx *IngressEx
 	if cfgtor.ngxc.cfgType != HTTPCfg && cfgtor.ngxc.cfgType != StreamHTTPCfg {
 		return errors.New("updateIngressEndpoints: I'm sorry Dave, I'm afraid I can't do that")
 	}
-	cfgtor.AddOrUpdateIngress(name, ingEx)
-	return nil
+	return cfgtor.AddOrUpdateIngress(name, ingEx)
 }
 
 // UpdateServiceEndpoints updates endpoints in NGINX configuration for a Service
@@ -725,8 +811,7 @@ func (cfgtor *Configurator) UpdateServiceEndpoints(svc *ServiceSpec) error {
 	if cfgtor.ngxc.cfgType != StreamCfg && cfgtor.ngxc.cfgType != StreamHTTPCfg {
 		return errors.New("updateServiceEndpoints: I'm sorry Dave, I'm afraid I can't do that")
 	}
-	cfgtor.AddOrUpdateService(svc)
-	return nil
+	return cfgtor.AddOrUpdateService(svc)
 }
 
 // UpdateMainConfigHTTPContext updates NGINX Configuration parameters
@@ -745,6 +830,5 @@ func (cfgtor *Configurator) UpdateMainConfigHTTPContext(config *HTTPContext) err
 		SSLDHParam:                config.MainServerSSLDHParam,
 		SSLPreferServerCiphers:    config.MainServerSSLPreferServerCiphers,
 	}
-	cfgtor.ngxc.UpdateMainConfigFile()
-	return nil
+	return cfgtor.ngxc.UpdateMainConfigFile()
 }
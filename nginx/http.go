@@ -1,12 +1,13 @@
 package nginx
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
+	"net"
 	"os"
 	"path"
 	"reflect"
-	"text/template"
 
 	"github.com/golang/glog"
 )
@@ -26,6 +27,18 @@ type Upstream struct {
 	UpstreamServers []UpstreamServer
 }
 
+type upstreamByName []Upstream
+
+func (u upstreamByName) Len() int {
+	return len(u)
+}
+func (u upstreamByName) Swap(i, j int) {
+	u[i], u[j] = u[j], u[i]
+}
+func (u upstreamByName) Less(i, j int) bool {
+	return u[i].Name < u[j].Name
+}
+
 // UpstreamServer describes a server in an NGINX upstream (context http::upstream)
 // http://nginx.org/en/docs/http/ngx_http_upstream_module.html#server
 type UpstreamServer struct {
@@ -33,6 +46,11 @@ type UpstreamServer struct {
 	Port    string
 }
 
+// HostPort returns the server's address (bracketed for IPv6) and port
+func (us UpstreamServer) HostPort() string {
+	return net.JoinHostPort(us.Address, us.Port)
+}
+
 // Server describes an NGINX server
 // http://nginx.org/en/docs/http/ngx_http_core_module.html
 type Server struct {
@@ -87,23 +105,25 @@ func NewUpstreamWithDefaultServer(name string) Upstream {
 
 // DeleteHTTPConfiguration deletes the configuration file, which corresponds for the
 // specified HTTP resource / service load balancer from NGINX conf directory
-func (ngxc *NginxController) DeleteHTTPConfiguration(name string) {
+func (ngxc *NginxController) DeleteHTTPConfiguration(name string) error {
 	filename := ngxc.getHTTPConfigFileName(name)
 	glog.V(3).Infof("deleting %v", filename)
 
 	if ngxc.cfgType != LocalCfg {
-		if err := os.Remove(filename); err != nil {
-			glog.Warningf("Failed to delete %v: %v", filename, err)
+		if err := os.Remove(filename); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to delete %v: %v", filename, err)
 		}
+		ngxc.removed(filename)
 	}
+	return nil
 }
 
 // AddOrUpdateHTTPConfiguration creates or updates a configuration file with
 // the specified configuration for the specified HTTP Configuration
-func (ngxc *NginxController) AddOrUpdateHTTPConfiguration(name string, config HTTPNginxConfig) {
+func (ngxc *NginxController) AddOrUpdateHTTPConfiguration(name string, config HTTPNginxConfig) error {
 	glog.V(3).Infof("Updating NGINX configuration for HTTP Context: %v", name)
 	filename := ngxc.getHTTPConfigFileName(name)
-	ngxc.templateHTTP(config, filename)
+	return ngxc.templateHTTP(config, filename)
 }
 
 // AddOrUpdateDHParam creates the servers dhparam.pem file
@@ -126,44 +146,24 @@ func (ngxc *NginxController) AddOrUpdateDHParam(dhparam string) (string, error)
 
 // AddOrUpdateCertAndKey creates a .pem file wth the cert and the key with the
 // specified name
-func (ngxc *NginxController) AddOrUpdateCertAndKey(name string, cert string, key string) string {
+func (ngxc *NginxController) AddOrUpdateCertAndKey(name string, cert string, key string) (string, error) {
 	pemFileName := ngxc.nginxCertsPath + "/" + name + ".pem"
 
 	if ngxc.cfgType != LocalCfg {
-		pem, err := os.Create(pemFileName)
-		if err != nil {
-			glog.Fatalf("Couldn't create pem file %v: %v", pemFileName, err)
-		}
-		defer pem.Close()
-
-		_, err = pem.WriteString(key)
-		if err != nil {
-			glog.Fatalf("Couldn't write to pem file %v: %v", pemFileName, err)
-		}
-
-		_, err = pem.WriteString("\n")
-		if err != nil {
-			glog.Fatalf("Couldn't write to pem file %v: %v", pemFileName, err)
-		}
-
-		_, err = pem.WriteString(cert)
-		if err != nil {
-			glog.Fatalf("Couldn't write to pem file %v: %v", pemFileName, err)
+		if err := replaceFile(pemFileName, []byte(key+"\n"+cert)); err != nil {
+			return pemFileName, fmt.Errorf("couldn't write pem file %v: %v", pemFileName, err)
 		}
 	}
 
-	return pemFileName
+	return pemFileName, nil
 }
 
 func (ngxc *NginxController) getHTTPConfigFileName(name string) string {
 	return path.Join(ngxc.nginxConfdPath, name+".http.conf")
 }
 
-func (ngxc *NginxController) templateHTTP(config HTTPNginxConfig, filename string) {
-	tmpl, err := template.New("http.tmpl").ParseFiles("http.tmpl")
-	if err != nil {
-		glog.Fatalf("failed to parse HTTP template file: %v", err)
-	}
+func (ngxc *NginxController) templateHTTP(config HTTPNginxConfig, filename string) error {
+	tmpl := ngxc.Templates().HTTP
 
 	if glog.V(3) {
 		glog.Infof("writing NGINX HTTP configuration to %v", filename)
@@ -171,16 +171,13 @@ func (ngxc *NginxController) templateHTTP(config HTTPNginxConfig, filename strin
 	}
 
 	if ngxc.cfgType != LocalCfg {
-		w, err := os.Create(filename)
-		if err != nil {
-			glog.Fatalf("failed to open %v: %v", filename, err)
-		}
-		defer w.Close()
-
-		if err := tmpl.Execute(w, config); err != nil {
-			glog.Fatalf("failed to write template %v", err)
+		var content bytes.Buffer
+		if err := tmpl.Execute(&content, config); err != nil {
+			return fmt.Errorf("failed to execute template %v: %v", httpTemplateName, err)
 		}
+		return ngxc.writeConfigFile(filename, content.Bytes())
 	}
+	return nil
 }
 
 func (h HTTPNginxConfig) String() string {
@@ -8,12 +8,14 @@ import (
 	"os/exec"
 	"path"
 	"reflect"
-	"text/template"
+	"sync"
+	"syscall"
+	"time"
 
 	"github.com/golang/glog"
 )
 
-const mainConfFilename = "/etc/nginx/nginx.conf"
+const mainConfFilename = "nginx.conf"
 
 // Configuration Type for NGINX Server
 type Configuration uint8
@@ -31,10 +33,21 @@ const (
 
 // NginxController Updates NGINX configuration, starts and reloads NGINX
 type NginxController struct {
+	nginxConfPath  string
 	nginxConfdPath string
 	nginxCertsPath string
-	cfgType        Configuration
-	mainCfg        *NginxMainConfig
+	dryRun         bool
+	// streamAccessLog - the access_log destination for stream servers
+	streamAccessLog string
+	cfgType         Configuration
+	mainCfg         *NginxMainConfig
+	templates       *Templates
+	tmplLock        sync.RWMutex
+	quarantined     map[string]error
+	qLock           sync.RWMutex
+	changes         changeTracker
+	changeLock      sync.Mutex
+	proc            *process
 }
 
 // NginxMainConfig describe the main NGINX configuration file
@@ -87,19 +100,44 @@ type NginxMainHTTPConfig struct {
 	SSLDHParam             string
 }
 
-// NewNginxController creates a NGINX controller
-func NewNginxController(cfgType Configuration, nginxConfPath string, healthCheck bool, healthPort int) (*NginxController, error) {
+// NewNginxController creates a NGINX controller.  The embedded default
+// templates are used, except where overridden by a template of the same name
+// in templateDir (if not empty).  For a dry run, the configuration files are
+// written to nginxConfPath, but NGINX is never validated, started or reloaded.
+// When streamAccessLog is not empty, each stream server's access log is sent to
+// that destination.
+func NewNginxController(cfgType Configuration, nginxConfPath string, dryRun bool, templateDir, streamAccessLog string, healthCheck bool, healthPort int) (*NginxController, error) {
+	tmpls, err := NewTemplates(templateDir)
+	if err != nil {
+		return nil, err
+	}
+
 	ngxc := NginxController{
-		nginxConfdPath: path.Join(nginxConfPath, "conf.d"),
-		nginxCertsPath: path.Join(nginxConfPath, "ssl"),
-		cfgType:        cfgType,
-		mainCfg:        nil,
+		nginxConfPath:   nginxConfPath,
+		nginxConfdPath:  path.Join(nginxConfPath, "conf.d"),
+		nginxCertsPath:  path.Join(nginxConfPath, "ssl"),
+		dryRun:          dryRun,
+		streamAccessLog: streamAccessLog,
+		cfgType:         cfgType,
+		mainCfg:         nil,
+		templates:       tmpls,
+		quarantined:     make(map[string]error),
+		changes:         newChangeTracker(),
+	}
+
+	if dryRun {
+		glog.Infof("dry run: writing NGINX configuration to: %s", nginxConfPath)
+		if err := createDir(ngxc.nginxConfdPath); err != nil {
+			return nil, err
+		}
 	}
 
 	if cfgType != LocalCfg {
+		// NGINX runs in the foreground as a supervised child process, and its'
+		// error log is captured in to LBEX's log
 		cfg := &NginxMainConfig{
-			Daemon:          true,
-			ErrorLogFile:    "/var/log/nginx/error.log",
+			Daemon:          false,
+			ErrorLogFile:    "stderr",
 			ErrorLogLevel:   "warn",
 			PidFile:         "/var/run/nginx.pid",
 			User:            "root",
@@ -115,7 +153,9 @@ func NewNginxController(cfgType Configuration, nginxConfPath string, healthCheck
 			cfg.DefaultStreamContext = true
 			cfg.DefaultHTTPContext = false
 		case HTTPCfg:
-			createDir(ngxc.nginxCertsPath)
+			if err := createDir(ngxc.nginxCertsPath); err != nil {
+				return nil, err
+			}
 			cfg.DefaultStreamContext = false
 			cfg.DefaultHTTPContext = true
 			cfg.HTTPContext.ServerNamesHashMaxSize = NewDefaultHTTPContext().MainServerNamesHashMaxSize
@@ -125,18 +165,55 @@ func NewNginxController(cfgType Configuration, nginxConfPath string, healthCheck
 		cfg.HTTPContext.HealthPort = healthPort
 
 		ngxc.mainCfg = cfg
-		ngxc.UpdateMainConfigFile()
+		if err := ngxc.UpdateMainConfigFile(); err != nil {
+			return nil, err
+		}
 	}
 	return &ngxc, nil
 }
 
-// Reload reloads NGINX
+// SetTemplates replaces the current set of templates
+func (ngxc *NginxController) SetTemplates(tmpls *Templates) {
+	ngxc.tmplLock.Lock()
+	defer ngxc.tmplLock.Unlock()
+	ngxc.templates = tmpls
+}
+
+// Templates returns the current set of templates
+func (ngxc *NginxController) Templates() *Templates {
+	ngxc.tmplLock.RLock()
+	defer ngxc.tmplLock.RUnlock()
+	return ngxc.templates
+}
+
+// Reload reloads NGINX, unless no configuration file has changed since the
+// last successful reload
 func (ngxc *NginxController) Reload() error {
+	pending, generation := ngxc.reloadPending()
+	if !pending {
+		glog.V(3).Info("Reload: configuration unchanged, skipping reload")
+		ngxc.reloadSkipped()
+		return nil
+	}
+	start := time.Now()
+	err := ngxc.reload()
+	ngxc.reloadDone(generation, time.Since(start), err)
+	return err
+}
+
+func (ngxc *NginxController) reload() error {
+	if ngxc.dryRun {
+		glog.V(3).Info("Reload: dry run, not reloading nginx")
+		return nil
+	}
 	if ngxc.cfgType != LocalCfg {
-		if err := shellOut("nginx -t"); err != nil {
-			return fmt.Errorf("Reload: Invalid nginx configuration detected, not reloading: %s", err)
+		if err := ngxc.Validate(); err != nil {
+			return fmt.Errorf("Reload: not reloading: %s", err)
+		}
+		if ngxc.proc == nil {
+			return fmt.Errorf("Reload: nginx has not been started")
 		}
-		if err := shellOut("nginx -s reload"); err != nil {
+		if err := ngxc.proc.signal(syscall.SIGHUP); err != nil {
 			return fmt.Errorf("Reload: Reloading NGINX failed: %s", err)
 		}
 	} else {
@@ -145,21 +222,41 @@ func (ngxc *NginxController) Reload() error {
 	return nil
 }
 
-// Start starts NGINX
-func (ngxc *NginxController) Start() {
+// Start starts NGINX as a supervised child process, which is restarted if it
+// exits unexpectedly
+func (ngxc *NginxController) Start() error {
+	if ngxc.dryRun {
+		glog.V(3).Info("dry run, not starting nginx")
+		return nil
+	}
 	if ngxc.cfgType != LocalCfg {
-		if err := shellOut("nginx"); err != nil {
-			glog.Fatalf("Failed to start nginx: %v", err)
-		}
-	} else {
-		glog.V(3).Info("Starting nginx")
+		ngxc.proc = newProcess(ngxc.started)
+		return ngxc.proc.start()
+	}
+	glog.V(3).Info("Starting nginx")
+	return nil
+}
+
+// Stop gracefully shuts NGINX down
+func (ngxc *NginxController) Stop() {
+	if ngxc.proc != nil {
+		ngxc.proc.stop()
 	}
 }
 
-func createDir(path string) {
-	if err := os.Mkdir(path, os.ModeDir); err != nil {
-		glog.Fatalf("Couldn't create directory %v: %v", path, err)
+// Healthy returns nil if NGINX is running, otherwise the reason it is not
+func (ngxc *NginxController) Healthy() error {
+	if ngxc.proc == nil {
+		return nil
 	}
+	return ngxc.proc.status()
+}
+
+func createDir(path string) error {
+	if err := os.MkdirAll(path, 0755); err != nil {
+		return fmt.Errorf("couldn't create directory %v: %v", path, err)
+	}
+	return nil
 }
 
 func shellOut(cmd string) (err error) {
@@ -185,31 +282,29 @@ func shellOut(cmd string) (err error) {
 	return nil
 }
 
-// UpdateMainConfigFile update the main NGINX configuration file
-func (ngxc *NginxController) UpdateMainConfigFile() {
-	tmpl, err := template.New("nginx.conf.tmpl").ParseFiles("nginx.conf.tmpl")
-	if err != nil {
-		glog.Fatalf("Failed to parse the main config template file: %v", err)
-	}
+// UpdateMainConfigFile update the main NGINX configuration file.  The file is
+// replaced atomically, so on error the previous configuration remains intact.
+func (ngxc *NginxController) UpdateMainConfigFile() error {
+	tmpl := ngxc.Templates().Main
+	filename := path.Join(ngxc.nginxConfPath, mainConfFilename)
 
 	if glog.V(2) {
-		glog.Infof("Writing NGINX conf to %v", mainConfFilename)
+		glog.Infof("Writing NGINX conf to %v", filename)
 		tmpl.Execute(os.Stdout, ngxc.mainCfg)
 	}
 
 	if ngxc.cfgType != LocalCfg {
-		w, err := os.Create(mainConfFilename)
-		if err != nil {
-			glog.Fatalf("Failed to open %v: %v", mainConfFilename, err)
+		var content bytes.Buffer
+		if err := tmpl.Execute(&content, ngxc.mainCfg); err != nil {
+			return fmt.Errorf("failed to execute template %v: %v", mainTemplateName, err)
 		}
-		defer w.Close()
-
-		if err := tmpl.Execute(w, ngxc.mainCfg); err != nil {
-			glog.Fatalf("Failed to write template %v", err)
+		if err := ngxc.writeConfigFile(filename, content.Bytes()); err != nil {
+			return err
 		}
 	}
 
 	glog.V(3).Infof("The main NGINX configuration file had been updated")
+	return nil
 }
 
 func (n NginxMainConfig) String() string {
@@ -5,13 +5,24 @@ import (
 	"reflect"
 )
 
-// Node models a k8s worker node's id and addresses
+// Node models a k8s worker node's id and addresses, the IPv4 and IPv6
+// addresses of each type
 type Node struct {
-	Name       string
-	Hostname   string
-	ExternalIP string
-	InternalIP string
-	Active     bool
+	Name         string
+	Hostname     string
+	ExternalIP   string
+	InternalIP   string
+	ExternalIPv6 string
+	InternalIPv6 string
+	Active       bool
+	// Labels - the node's labels, that node selectors are matched against
+	Labels map[string]string `json:",omitempty"`
+	// Draining - the node is cordoned, or otherwise excluded, an active
+	// draining node is a backup server in the upstreams
+	Draining bool
+	// Ready - the node is ready, and its' network is available, a node that
+	// is not ready is marked down in the upstreams
+	Ready bool
 }
 
 func (n Node) String() string {
@@ -21,3 +32,22 @@ func (n Node) String() string {
 	}
 	return string(j)
 }
+
+// sameAddresses returns true if the nodes' addresses are all the same
+func (n Node) sameAddresses(other Node) bool {
+	return n.Hostname == other.Hostname &&
+		n.ExternalIP == other.ExternalIP && n.InternalIP == other.InternalIP &&
+		n.ExternalIPv6 == other.ExternalIPv6 && n.InternalIPv6 == other.InternalIPv6
+}
+
+type nodeByName []Node
+
+func (n nodeByName) Len() int {
+	return len(n)
+}
+func (n nodeByName) Swap(i, j int) {
+	n[i], n[j] = n[j], n[i]
+}
+func (n nodeByName) Less(i, j int) bool {
+	return n[i].Name < n[j].Name
+}
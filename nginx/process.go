@@ -0,0 +1,203 @@
+package nginx
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+const (
+	// restartBackoffMin - the delay before the first restart of NGINX
+	restartBackoffMin = time.Second
+	// restartBackoffMax - restart delays double up to this limit
+	restartBackoffMax = time.Minute
+	// stableRunTime - NGINX running for at least this long resets the delay
+	stableRunTime = time.Minute
+)
+
+// process supervises NGINX as a foreground (daemon off) child process.  The
+// process's output is copied to the log, and the process is restarted, with
+// exponential backoff, whenever it exits unexpectedly.
+type process struct {
+	lock     sync.Mutex
+	cmd      *exec.Cmd
+	running  bool
+	stopping bool
+	exitErr  error
+	restarts int
+
+	// onStart is called each time NGINX has been (re)started, and so has
+	// loaded the current configuration
+	onStart func()
+}
+
+func newProcess(onStart func()) *process {
+	return &process{onStart: onStart}
+}
+
+// start starts NGINX, and supervises it in the background.  Only the initial
+// start's failure is returned.
+func (p *process) start() error {
+	cmd, done, err := p.spawn()
+	if err != nil {
+		return err
+	}
+	go p.supervise(cmd, done)
+	return nil
+}
+
+// spawn starts a single NGINX process, the returned channel is closed when
+// the process has exited.
+func (p *process) spawn() (*exec.Cmd, chan struct{}, error) {
+	cmd := exec.Command("nginx")
+	// NGINX runs in its' own process group, so that any workers orphaned by
+	// the master process exiting can be cleaned up
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+
+	// os.Pipe rather than cmd.StdoutPipe, so that Wait doesn't wait for
+	// output from orphaned workers
+	stdout, stdoutW, err := os.Pipe()
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to start nginx: %v", err)
+	}
+	stderr, stderrW, err := os.Pipe()
+	if err != nil {
+		stdout.Close()
+		stdoutW.Close()
+		return nil, nil, fmt.Errorf("failed to start nginx: %v", err)
+	}
+	cmd.Stdout = stdoutW
+	cmd.Stderr = stderrW
+
+	err = cmd.Start()
+	stdoutW.Close()
+	stderrW.Close()
+	if err != nil {
+		stdout.Close()
+		stderr.Close()
+		return nil, nil, fmt.Errorf("failed to start nginx: %v", err)
+	}
+	glog.V(2).Infof("started nginx, pid: %d", cmd.Process.Pid)
+
+	p.lock.Lock()
+	p.cmd = cmd
+	p.running = true
+	p.exitErr = nil
+	p.lock.Unlock()
+	if p.onStart != nil {
+		p.onStart()
+	}
+
+	go logOutput(stdout, false)
+	go logOutput(stderr, true)
+
+	done := make(chan struct{})
+	go func() {
+		err := cmd.Wait()
+		p.lock.Lock()
+		p.running = false
+		p.exitErr = err
+		p.lock.Unlock()
+		// clean up any remaining workers
+		syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+		close(done)
+	}()
+	return cmd, done, nil
+}
+
+func (p *process) supervise(cmd *exec.Cmd, done chan struct{}) {
+	backoff := restartBackoffMin
+	for {
+		started := time.Now()
+		<-done
+
+		p.lock.Lock()
+		stopping, exitErr := p.stopping, p.exitErr
+		p.lock.Unlock()
+		if stopping {
+			glog.V(2).Infof("nginx exited: %v", exitErr)
+			return
+		}
+		glog.Errorf("nginx, pid: %d, exited unexpectedly: %v", cmd.Process.Pid, exitErr)
+
+		if time.Since(started) >= stableRunTime {
+			backoff = restartBackoffMin
+		}
+		for {
+			glog.Warningf("restarting nginx in %v", backoff)
+			time.Sleep(backoff)
+			if backoff *= 2; backoff > restartBackoffMax {
+				backoff = restartBackoffMax
+			}
+
+			p.lock.Lock()
+			stopping := p.stopping
+			p.lock.Unlock()
+			if stopping {
+				return
+			}
+
+			var err error
+			if cmd, done, err = p.spawn(); err == nil {
+				p.lock.Lock()
+				p.restarts++
+				p.lock.Unlock()
+				break
+			}
+			glog.Errorf("%v", err)
+		}
+	}
+}
+
+// signal sends sig to the running NGINX master process
+func (p *process) signal(sig syscall.Signal) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if !p.running {
+		return fmt.Errorf("nginx is not running: %v", p.exitErr)
+	}
+	return p.cmd.Process.Signal(sig)
+}
+
+// stop gracefully shuts NGINX down, and stops supervising it
+func (p *process) stop() {
+	p.lock.Lock()
+	p.stopping = true
+	p.lock.Unlock()
+	if err := p.signal(syscall.SIGQUIT); err != nil {
+		glog.V(3).Infof("stop: %v", err)
+	}
+}
+
+// status returns nil if NGINX is running, otherwise the reason it is not
+func (p *process) status() error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if !p.running {
+		if p.exitErr != nil {
+			return fmt.Errorf("nginx is not running, last exit: %v", p.exitErr)
+		}
+		return fmt.Errorf("nginx is not running")
+	}
+	return nil
+}
+
+// logOutput copies each line of NGINX's output to the log
+func logOutput(r io.ReadCloser, stderr bool) {
+	defer r.Close()
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		if stderr {
+			glog.Warningf("nginx: %s", scanner.Text())
+		} else {
+			glog.Infof("nginx: %s", scanner.Text())
+		}
+	}
+}
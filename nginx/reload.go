@@ -0,0 +1,137 @@
+package nginx
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"os"
+	"reflect"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// ReloadStats counts data plane reloads: applied, skipped because the
+// configuration was unchanged since the last reload, and failed.
+// DurationSeconds is the total time spent in applied and failed reloads, and
+// LastError is the error of the last reload, empty if it succeeded.
+type ReloadStats struct {
+	Applied         uint64
+	Skipped         uint64
+	Failed          uint64
+	DurationSeconds float64
+	LastError       string
+}
+
+// changeTracker records the content hash of each configuration file written,
+// so that writing identical content, and reloading when nothing has been
+// written, can be skipped.
+type changeTracker struct {
+	// map filename to the sha256 of its' last written content
+	hashes map[string][sha256.Size]byte
+	// incremented by each change to a configuration file
+	generation uint64
+	// the generation of the last successful reload
+	reloaded uint64
+	stats    ReloadStats
+}
+
+func newChangeTracker() changeTracker {
+	return changeTracker{
+		hashes: make(map[string][sha256.Size]byte),
+	}
+}
+
+// unchanged returns true if content is identical to filename's last written
+// content, and the file is still present
+func (ngxc *NginxController) unchanged(filename string, content []byte) bool {
+	ngxc.changeLock.Lock()
+	hash, ok := ngxc.changes.hashes[filename]
+	ngxc.changeLock.Unlock()
+	if !ok || hash != sha256.Sum256(content) {
+		return false
+	}
+	_, err := os.Stat(filename)
+	return err == nil
+}
+
+// written records that filename now holds content
+func (ngxc *NginxController) written(filename string, content []byte) {
+	ngxc.changeLock.Lock()
+	defer ngxc.changeLock.Unlock()
+	ngxc.changes.hashes[filename] = sha256.Sum256(content)
+	ngxc.changes.generation++
+}
+
+// removed records that filename has been removed
+func (ngxc *NginxController) removed(filename string) {
+	ngxc.changeLock.Lock()
+	defer ngxc.changeLock.Unlock()
+	delete(ngxc.changes.hashes, filename)
+	ngxc.changes.generation++
+}
+
+// writeConfigFile atomically replaces filename with content, unless content
+// is unchanged
+func (ngxc *NginxController) writeConfigFile(filename string, content []byte) error {
+	if ngxc.unchanged(filename, content) {
+		glog.V(3).Infof("configuration unchanged, skipping write: %v", filename)
+		return nil
+	}
+	if err := replaceFile(filename, content); err != nil {
+		return err
+	}
+	ngxc.written(filename, content)
+	return nil
+}
+
+// reloadPending returns whether or not any configuration file has changed
+// since the last successful reload, and the current generation
+func (ngxc *NginxController) reloadPending() (bool, uint64) {
+	ngxc.changeLock.Lock()
+	defer ngxc.changeLock.Unlock()
+	return ngxc.changes.generation != ngxc.changes.reloaded, ngxc.changes.generation
+}
+
+// reloadDone records the result, and duration, of a reload of the
+// configuration generation
+func (ngxc *NginxController) reloadDone(generation uint64, duration time.Duration, err error) {
+	ngxc.changeLock.Lock()
+	defer ngxc.changeLock.Unlock()
+	ngxc.changes.stats.DurationSeconds += duration.Seconds()
+	if err != nil {
+		ngxc.changes.stats.Failed++
+		ngxc.changes.stats.LastError = err.Error()
+		return
+	}
+	ngxc.changes.reloaded = generation
+	ngxc.changes.stats.Applied++
+	ngxc.changes.stats.LastError = ""
+}
+
+// started records that NGINX is running the current configuration
+func (ngxc *NginxController) started() {
+	ngxc.changeLock.Lock()
+	defer ngxc.changeLock.Unlock()
+	ngxc.changes.reloaded = ngxc.changes.generation
+}
+
+func (ngxc *NginxController) reloadSkipped() {
+	ngxc.changeLock.Lock()
+	defer ngxc.changeLock.Unlock()
+	ngxc.changes.stats.Skipped++
+}
+
+// ReloadStats returns the reload counters
+func (ngxc *NginxController) ReloadStats() ReloadStats {
+	ngxc.changeLock.Lock()
+	defer ngxc.changeLock.Unlock()
+	return ngxc.changes.stats
+}
+
+func (r ReloadStats) String() string {
+	j, err := json.Marshal(r)
+	if err != nil {
+		return string("cant't marshal: " + reflect.TypeOf(r).String() + ", to json string, err: " + err.Error())
+	}
+	return string(j)
+}
@@ -0,0 +1,80 @@
+package nginx
+
+import (
+	"context"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+const (
+	// resolveTimeout - how long a node hostname lookup may take
+	resolveTimeout = 2 * time.Second
+	// resolveCacheTTL - how long the result of a lookup is used for
+	resolveCacheTTL = 30 * time.Second
+)
+
+// resolution - whether or not a hostname resolved, and until when the result
+// is used
+type resolution struct {
+	resolved bool
+	expires  time.Time
+}
+
+// hostResolver checks that node hostnames resolve, so that a hostname that
+// NGINX could not resolve is not rendered as an upstream server
+type hostResolver struct {
+	lock    sync.Mutex
+	results map[string]resolution
+}
+
+func newHostResolver() *hostResolver {
+	return &hostResolver{results: make(map[string]resolution)}
+}
+
+// resolves returns true if host resolves to at least one address, using the
+// name server of the resolver annotation value, e.g. "10.0.0.10 valid=30s",
+// or the system's resolver when it is empty
+func (r *hostResolver) resolves(host, resolver string) bool {
+	server := ""
+	if fields := strings.Fields(resolver); len(fields) > 0 {
+		server = fields[0]
+		if _, _, err := net.SplitHostPort(server); err != nil {
+			server = net.JoinHostPort(strings.Trim(server, "[]"), "53")
+		}
+	}
+	key := server + "|" + host
+
+	r.lock.Lock()
+	result, ok := r.results[key]
+	r.lock.Unlock()
+	if ok && time.Now().Before(result.expires) {
+		return result.resolved
+	}
+
+	lookup := net.DefaultResolver
+	if server != "" {
+		lookup = &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, network, server)
+			},
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), resolveTimeout)
+	defer cancel()
+	addrs, err := lookup.LookupHost(ctx, host)
+	resolved := err == nil && len(addrs) > 0
+	if !resolved {
+		glog.V(2).Infof("node hostname %s does not resolve: %v", host, err)
+	}
+
+	r.lock.Lock()
+	r.results[key] = resolution{resolved: resolved, expires: time.Now().Add(resolveCacheTTL)}
+	r.lock.Unlock()
+	return resolved
+}
@@ -3,18 +3,24 @@ package nginx
 import (
 	"encoding/json"
 	"reflect"
+	"strings"
+
+	"github.com/sostheim/lbex/annotations"
 
 	"k8s.io/client-go/pkg/api/v1"
+	"k8s.io/client-go/pkg/labels"
 )
 
 // SupportedAlgorithms - NGINX load balanacing upstream directives
 // http://nginx.org/en/docs/stream/ngx_stream_upstream_module.html#upstream
 // http://nginx.org/en/docs/stream/ngx_stream_upstream_module.html#least_conn
 // http://nginx.org/en/docs/stream/ngx_stream_upstream_module.html#least_time
+// http://nginx.org/en/docs/stream/ngx_stream_upstream_module.html#hash
 var SupportedAlgorithms = []string{
 	RoundRobin,
 	LeastConnections,
 	LowestLatency,
+	SourceIPHash,
 }
 
 const (
@@ -24,6 +30,8 @@ const (
 	LeastConnections string = "least_conn"
 	// LowestLatency - direct traffic to server with the lowest average latency and the least number of active connections.
 	LowestLatency string = "least_time"
+	// SourceIPHash - direct traffic from the same client address to the same server, while it is available.
+	SourceIPHash string = "source_ip_hash"
 	// DefaultAlgorithm - round robin
 	DefaultAlgorithm string = RoundRobin
 )
@@ -95,10 +103,13 @@ const (
 	DefaultNodeSet = Host
 )
 
-// NodeAddressType - node IP address type
+// NodeAddressType - node address type, the node address type annotation is
+// a comma separated list of types in order of preference, e.g.
+// "external,internal,hostname"
 var NodeAddressType = []string{
 	Internal,
 	External,
+	Hostname,
 }
 
 const (
@@ -106,10 +117,27 @@ const (
 	Internal string = "internal"
 	// External - upstream nodes IP address type is external public or private
 	External string = "external"
+	// Hostname - upstream nodes address is the node's hostname, which must resolve
+	Hostname string = "hostname"
 	// DefaultNodeAddressType - default address type
 	DefaultNodeAddressType = Internal
 )
 
+// IPFamilies - node IP address family
+var IPFamilies = []string{
+	IPv4,
+	IPv6,
+}
+
+const (
+	// IPv4 - upstream nodes IP addresses are IPv4 addresses, default family
+	IPv4 string = "ipv4"
+	// IPv6 - upstream nodes IP addresses are IPv6 addresses
+	IPv6 string = "ipv6"
+	// DefaultIPFamily - default IP address family
+	DefaultIPFamily = IPv4
+)
+
 // Target is a service network topology target
 type Target struct {
 	// ServicePort - the port that we listen on for the service's external clients
@@ -139,6 +167,15 @@ type ServiceSpec struct {
 	ConfigName   string
 	UpstreamType string
 	Topology     []Target
+	// ListenAddress - the address that the service's listeners bind to, all
+	// addresses when empty
+	ListenAddress string
+	// NodeSelector - the label selector of the nodes that are eligible for
+	// the node upstream type, all nodes when empty
+	NodeSelector string
+	// Substitutions - annotations with invalid values, that are replaced by
+	// their' default value
+	Substitutions []annotations.Finding `json:",omitempty"`
 }
 
 // ValidateAlgorithm - returns the input 'a' algorithm value iff it is a valid
@@ -205,6 +242,46 @@ func ValidateNodeAddressType(at string) string {
 	return at
 }
 
+// ValidateNodeAddressTypes - returns the input comma separated list of
+// address types, in order, iff every type is a valid value from
+// NodeAddressType, otherwise returns the default type value
+func ValidateNodeAddressTypes(types string) []string {
+	chain := []string{}
+	for _, at := range strings.Split(types, ",") {
+		at = strings.TrimSpace(at)
+		if ValidateNodeAddressType(at) != at {
+			return []string{DefaultNodeAddressType}
+		}
+		chain = append(chain, at)
+	}
+	return chain
+}
+
+// ValidateNodeSelector - returns the input 'selector' iff it is a valid label
+// selector, otherwise returns the default selector
+func ValidateNodeSelector(selector, defaultSelector string) string {
+	if _, err := labels.Parse(selector); err != nil {
+		return defaultSelector
+	}
+	return selector
+}
+
+// ValidateIPFamily - returns the input 'family' iff it is a valid value from
+// IPFamilies, otherwise returns default family value
+func ValidateIPFamily(family string) string {
+	found := false
+	for _, current := range IPFamilies {
+		if family == current {
+			found = true
+			break
+		}
+	}
+	if !found {
+		return DefaultIPFamily
+	}
+	return family
+}
+
 // ValidateNodeSet - returns the input 'set' selection iff it is a valid value
 // from NodeSelectionSets, otherwise returns default set value
 func ValidateNodeSet(set string) string {
@@ -221,6 +298,45 @@ func ValidateNodeSet(set string) string {
 	return set
 }
 
+// LintOptions - the rules for linting service annotations against the values
+// supported by the NGINX configurator, nodeSelector is the default node
+// selector, and serviceAddresses is true when LoadBalancer services are
+// allocated load balancer addresses (--vip-range)
+func LintOptions(requirePort bool, nodeSelector string, serviceAddresses bool) annotations.LintOptions {
+	return annotations.LintOptions{
+		Values: map[string][]string{
+			annotations.LBEXAlgorithmKey:    SupportedAlgorithms,
+			annotations.LBEXMethodKey:       SupportedMethods,
+			annotations.LBEXUpstreamType:    UpstreamTypes,
+			annotations.LBEXNodeSet:         NodeSelectionSets,
+			annotations.LBEXNodeAddressType: NodeAddressType,
+			annotations.LBEXIPFamily:        IPFamilies,
+		},
+		Defaults: map[string]string{
+			annotations.LBEXAlgorithmKey:    DefaultAlgorithm,
+			annotations.LBEXMethodKey:       DefaultMethod,
+			annotations.LBEXUpstreamType:    DefaultUpstreamType,
+			annotations.LBEXNodeSet:         DefaultNodeSet,
+			annotations.LBEXNodeAddressType: DefaultNodeAddressType,
+			annotations.LBEXIPFamily:        DefaultIPFamily,
+			annotations.LBEXNodeSelector:    nodeSelector,
+		},
+		Requires: map[string]annotations.Requirement{
+			annotations.LBEXMethodKey:       {Key: annotations.LBEXAlgorithmKey, Values: []string{LowestLatency}},
+			annotations.LBEXNodeSet:         {Key: annotations.LBEXUpstreamType, Values: []string{HostNode}},
+			annotations.LBEXNodeAddressType: {Key: annotations.LBEXUpstreamType, Values: []string{HostNode}},
+			annotations.LBEXIPFamily:        {Key: annotations.LBEXUpstreamType, Values: []string{HostNode}},
+			annotations.LBEXNodeSelector:    {Key: annotations.LBEXUpstreamType, Values: []string{HostNode}},
+		},
+		Lists: map[string]bool{
+			annotations.LBEXNodeAddressType: true,
+		},
+		UnnamedPort:      SingleDefaultPortName,
+		RequirePort:      requirePort,
+		ServiceAddresses: serviceAddresses,
+	}
+}
+
 func (t Target) String() string {
 	j, err := json.Marshal(t)
 	if err != nil {
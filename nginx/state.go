@@ -0,0 +1,266 @@
+package nginx
+
+import (
+	"reflect"
+	"sort"
+	"sync"
+
+	"github.com/golang/glog"
+)
+
+// State is a backend's record of the known nodes, and of the nodes and
+// targets that populate each service's upstreams.  All service entries are
+// keyed by the service key (namespace/name), and a reverse index maps each
+// node to the services that it is an upstream member of.
+type State struct {
+	lock sync.RWMutex
+
+	// map node names (key) to Node type
+	nodes map[string]Node
+
+	// map service key to the names of the nodes that populate its upstreams
+	serviceNodes map[string]map[string]bool
+
+	// reverse index: map node name to the keys of the services it populates
+	nodeServices map[string]map[string]bool
+
+	// map service key to the targets that populate its upstreams
+	serviceTargets map[string][]Target
+
+	// set of service keys whose upstreams are made up of all nodes
+	allNodeServices map[string]bool
+
+	// map service key to the size of its' generated configuration
+	serviceSummaries map[string]ServiceSummary
+}
+
+// ServiceSummary - the size of a service's generated configuration
+type ServiceSummary struct {
+	Listeners       int
+	UpstreamServers int
+}
+
+// NewState creates an empty State
+func NewState() *State {
+	return &State{
+		nodes:            make(map[string]Node),
+		serviceNodes:     make(map[string]map[string]bool),
+		nodeServices:     make(map[string]map[string]bool),
+		serviceTargets:   make(map[string][]Target),
+		allNodeServices:  make(map[string]bool),
+		serviceSummaries: make(map[string]ServiceSummary),
+	}
+}
+
+func sortedKeys(set map[string]bool) []string {
+	list := make([]string, 0, len(set))
+	for key := range set {
+		list = append(list, key)
+	}
+	sort.Strings(list)
+	return list
+}
+
+// SetNode adds or replaces the node, returning the previous value if any
+func (s *State) SetNode(node Node) (Node, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	prev, ok := s.nodes[node.Name]
+	s.nodes[node.Name] = node
+	return prev, ok
+}
+
+// RemoveNode removes the node, its' reverse index entries are retained until
+// each affected service's upstreams are recomputed.
+func (s *State) RemoveNode(name string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	delete(s.nodes, name)
+}
+
+// SetServiceUpstreams replaces the upstream membership of the service
+func (s *State) SetServiceUpstreams(key string, nodeNames []string, targets []Target, allNodes bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.clearService(key)
+
+	if len(nodeNames) > 0 {
+		members := make(map[string]bool, len(nodeNames))
+		for _, name := range nodeNames {
+			members[name] = true
+			if s.nodeServices[name] == nil {
+				s.nodeServices[name] = make(map[string]bool)
+			}
+			s.nodeServices[name][key] = true
+		}
+		s.serviceNodes[key] = members
+	}
+	if len(targets) > 0 {
+		s.serviceTargets[key] = targets
+	}
+	if allNodes {
+		s.allNodeServices[key] = true
+	}
+}
+
+// RemoveService removes every record of the service
+func (s *State) RemoveService(key string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.clearService(key)
+}
+
+// clearService must be called with the lock held
+func (s *State) clearService(key string) {
+	for name := range s.serviceNodes[key] {
+		delete(s.nodeServices[name], key)
+		if len(s.nodeServices[name]) == 0 {
+			delete(s.nodeServices, name)
+		}
+	}
+	delete(s.serviceNodes, key)
+	delete(s.serviceTargets, key)
+	delete(s.allNodeServices, key)
+	delete(s.serviceSummaries, key)
+}
+
+// SetServiceSummary records the size of the service's generated configuration
+func (s *State) SetServiceSummary(key string, summary ServiceSummary) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.serviceSummaries[key] = summary
+}
+
+// ServiceSummaries returns the size of each service's generated configuration,
+// by service key
+func (s *State) ServiceSummaries() map[string]ServiceSummary {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	result := make(map[string]ServiceSummary, len(s.serviceSummaries))
+	for key, summary := range s.serviceSummaries {
+		result[key] = summary
+	}
+	return result
+}
+
+// UpdateNode adds, updates, or (for an inactive node) removes the node from
+// the set of upstream candidates, and returns the keys of the affected
+// services, ordered.
+func (s *State) UpdateNode(node Node) []string {
+	elem, ok := s.Node(node.Name)
+	switch {
+	case !ok && node.Active:
+		glog.V(4).Infof("add new node: %v", node)
+		s.SetNode(node)
+		return s.servicesForCandidate(node.Name)
+	case !ok:
+		glog.V(4).Infof("ignoring new inactive node: %v", node)
+		return []string{}
+	case node.Active:
+		glog.V(4).Infof("update existing active node: %v", node)
+		s.SetNode(node)
+		if !elem.sameAddresses(node) || !reflect.DeepEqual(elem.Labels, node.Labels) {
+			return s.servicesForCandidate(node.Name)
+		}
+		if elem.Ready != node.Ready || elem.Draining != node.Draining {
+			glog.V(2).Infof("node %s ready: %t, draining: %t", node.Name, node.Ready, node.Draining)
+			return s.ServicesForNode(node.Name)
+		}
+		return []string{}
+	default:
+		glog.V(4).Infof("update (delete) existing inactive node: %v", node)
+		s.RemoveNode(node.Name)
+		return s.ServicesForNode(node.Name)
+	}
+}
+
+// Node returns the named node, and whether or not it is known
+func (s *State) Node(name string) (Node, bool) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	node, ok := s.nodes[name]
+	return node, ok
+}
+
+// Nodes returns all known nodes, ordered by name
+func (s *State) Nodes() []Node {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	list := make([]Node, 0, len(s.nodes))
+	for _, node := range s.nodes {
+		list = append(list, node)
+	}
+	sort.Sort(nodeByName(list))
+	return list
+}
+
+// Services returns the keys of all services with upstream state, ordered
+func (s *State) Services() []string {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	set := make(map[string]bool)
+	for key := range s.serviceNodes {
+		set[key] = true
+	}
+	for key := range s.serviceTargets {
+		set[key] = true
+	}
+	return sortedKeys(set)
+}
+
+// ServicesForNode returns the keys of the services that the named node is an
+// upstream member of, ordered
+func (s *State) ServicesForNode(name string) []string {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return sortedKeys(s.nodeServices[name])
+}
+
+// servicesForCandidate returns the keys of the services whose upstreams
+// might include the named node, which includes those that excluded it for
+// want of a usable address or matching labels, ordered
+func (s *State) servicesForCandidate(name string) []string {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	keys := make(map[string]bool)
+	for key := range s.nodeServices[name] {
+		keys[key] = true
+	}
+	for key := range s.allNodeServices {
+		keys[key] = true
+	}
+	for key, targets := range s.serviceTargets {
+		for _, target := range targets {
+			if target.NodeName == name {
+				keys[key] = true
+				break
+			}
+		}
+	}
+	return sortedKeys(keys)
+}
+
+// AllNodeServices returns the keys of the services whose upstreams are made up
+// of all nodes, ordered
+func (s *State) AllNodeServices() []string {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return sortedKeys(s.allNodeServices)
+}
+
+// ServiceNodes returns the names of the nodes that populate the service's
+// upstreams, ordered
+func (s *State) ServiceNodes(key string) []string {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return sortedKeys(s.serviceNodes[key])
+}
+
+// ServiceTargets returns the targets that populate the service's upstreams
+func (s *State) ServiceTargets(key string) []Target {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	targets := make([]Target, len(s.serviceTargets[key]))
+	copy(targets, s.serviceTargets[key])
+	return targets
+}
@@ -0,0 +1,133 @@
+package nginx
+
+import (
+	"reflect"
+	"testing"
+)
+
+// newTestState returns a state with nodes n1 and n2, the service ns/host
+// whose upstream is made up of the node hosting its' pod, n1, and the service
+// ns/all whose upstream is made up of all nodes
+func newTestState() *State {
+	s := NewState()
+	s.SetNode(Node{Name: "n1", InternalIP: "10.0.0.1", Active: true, Ready: true})
+	s.SetNode(Node{Name: "n2", InternalIP: "10.0.0.2", Active: true, Ready: true})
+	s.SetServiceUpstreams("ns/host", []string{"n1"}, []Target{{NodeName: "n1", NodePort: 30080}}, false)
+	s.SetServiceUpstreams("ns/all", []string{"n1", "n2"}, []Target{{NodeName: "n2", NodePort: 30081}}, true)
+	return s
+}
+
+func TestStateUpdateNode(t *testing.T) {
+	tests := []struct {
+		name     string
+		node     Node
+		affected []string
+		known    bool
+	}{
+		{
+			name:     "new active node",
+			node:     Node{Name: "n3", InternalIP: "10.0.0.3", Active: true, Ready: true},
+			affected: []string{"ns/all"},
+			known:    true,
+		},
+		{
+			name:     "new inactive node",
+			node:     Node{Name: "n3", InternalIP: "10.0.0.3"},
+			affected: []string{},
+			known:    false,
+		},
+		{
+			name:     "unchanged node",
+			node:     Node{Name: "n1", InternalIP: "10.0.0.1", Active: true, Ready: true},
+			affected: []string{},
+			known:    true,
+		},
+		{
+			name:     "address change",
+			node:     Node{Name: "n2", InternalIP: "10.0.0.20", Active: true, Ready: true},
+			affected: []string{"ns/all"},
+			known:    true,
+		},
+		{
+			name:     "address change of a node that is only a target",
+			node:     Node{Name: "n1", ExternalIP: "192.0.2.1", InternalIP: "10.0.0.1", Active: true, Ready: true},
+			affected: []string{"ns/all", "ns/host"},
+			known:    true,
+		},
+		{
+			name:     "not ready",
+			node:     Node{Name: "n1", InternalIP: "10.0.0.1", Active: true},
+			affected: []string{"ns/all", "ns/host"},
+			known:    true,
+		},
+		{
+			name:     "draining",
+			node:     Node{Name: "n2", InternalIP: "10.0.0.2", Active: true, Ready: true, Draining: true},
+			affected: []string{"ns/all"},
+			known:    true,
+		},
+		{
+			name:     "label change",
+			node:     Node{Name: "n2", InternalIP: "10.0.0.2", Active: true, Ready: true, Labels: map[string]string{"role": "edge"}},
+			affected: []string{"ns/all"},
+			known:    true,
+		},
+		{
+			name:     "inactive node",
+			node:     Node{Name: "n1", InternalIP: "10.0.0.1"},
+			affected: []string{"ns/all", "ns/host"},
+			known:    false,
+		},
+	}
+	for _, test := range tests {
+		s := newTestState()
+		affected := s.UpdateNode(test.node)
+		if !reflect.DeepEqual(affected, test.affected) {
+			t.Errorf("%s: affected services: got %v, want %v", test.name, affected, test.affected)
+		}
+		if _, known := s.Node(test.node.Name); known != test.known {
+			t.Errorf("%s: node known: got %t, want %t", test.name, known, test.known)
+		}
+	}
+}
+
+func TestStateReverseIndexes(t *testing.T) {
+	s := newTestState()
+
+	if got, want := s.ServicesForNode("n1"), []string{"ns/all", "ns/host"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("services for n1: got %v, want %v", got, want)
+	}
+	if got, want := s.ServicesForNode("n2"), []string{"ns/all"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("services for n2: got %v, want %v", got, want)
+	}
+	if got, want := s.ServiceNodes("ns/all"), []string{"n1", "n2"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("nodes of ns/all: got %v, want %v", got, want)
+	}
+	if got, want := s.AllNodeServices(), []string{"ns/all"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("all node services: got %v, want %v", got, want)
+	}
+
+	// replacing the membership removes the previous reverse index entries
+	s.SetServiceUpstreams("ns/all", []string{"n2"}, nil, true)
+	if got, want := s.ServicesForNode("n1"), []string{"ns/host"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("services for n1 after update: got %v, want %v", got, want)
+	}
+	if got := s.ServiceTargets("ns/all"); len(got) != 0 {
+		t.Errorf("targets of ns/all after update: got %v, want none", got)
+	}
+
+	s.SetServiceSummary("ns/host", ServiceSummary{Listeners: 1, UpstreamServers: 1})
+	s.RemoveService("ns/host")
+	if got := s.ServicesForNode("n1"); len(got) != 0 {
+		t.Errorf("services for n1 after removal: got %v, want none", got)
+	}
+	if got := s.ServiceNodes("ns/host"); len(got) != 0 {
+		t.Errorf("nodes of ns/host after removal: got %v, want none", got)
+	}
+	if _, ok := s.ServiceSummaries()["ns/host"]; ok {
+		t.Errorf("summary of ns/host retained after removal")
+	}
+	if got, want := s.AllNodeServices(), []string{"ns/all"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("all node services after removal: got %v, want %v", got, want)
+	}
+}
@@ -1,13 +1,19 @@
 package nginx
 
 import (
+	"bytes"
 	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
 	"os"
 	"path"
 	"reflect"
-	"text/template"
+	"sort"
+	"strconv"
 
 	"github.com/golang/glog"
+	"github.com/sostheim/lbex/accesslog"
 )
 
 // StreamNginxConfig describes an NGINX Stream configuration primarily for Service LoadBalancing
@@ -15,11 +21,15 @@ type StreamNginxConfig struct {
 	Resolver  string
 	Upstreams []StreamUpstream
 	Servers   []StreamServer
+	// AccessLog - the access_log destination of each server, and the format
+	// of its' entries, no access log is written when empty
+	AccessLog       string
+	AccessLogFormat string
 }
 
 // StreamUpstream describes an NGINX upstream (context stream)
 // http://nginx.org/en/docs/stream/ngx_stream_upstream_module.html#upstream
-// The 'hash' directive is not supported in the 'upstream' context currently.
+// The 'hash' directive is only generated for the SourceIPHash algorithm.
 type StreamUpstream struct {
 	Name            string
 	Algorithm       string
@@ -51,6 +61,11 @@ type StreamServer struct {
 	ProxyPassthrough     bool
 	ProxyProtocolTimeout string
 	ProxyPassAddress     string
+	// Service and PortName identify the service port in the access log.  The
+	// log format is named after ProxyPassAddress, the upstream of the service
+	// port, as log format names are global to the stream context.
+	Service  string
+	PortName string
 }
 
 // StreamListen describes an NGINX server listener (context stream::server)
@@ -59,9 +74,24 @@ type StreamListen struct {
 	Address string
 	Port    string
 	UDP     bool
+	// DualStack - listen on all IPv4 and IPv6 addresses, Address is ignored
+	DualStack bool
 	// other fields omitted, e.g SSL, backlog, ... so_keepalive
 }
 
+// HostPort returns the address and port of the listen directive: the port
+// alone for all IPv4 addresses, "[::]:port" for dual stack, and otherwise the
+// address (bracketed for IPv6) and port
+func (s StreamListen) HostPort() string {
+	if s.DualStack {
+		return net.JoinHostPort("::", s.Port)
+	}
+	if s.Address == "" {
+		return s.Port
+	}
+	return net.JoinHostPort(s.Address, s.Port)
+}
+
 // NewStreamUpstreamWithDefaultServer creates an upstream with the default server.
 // Do not initialize Algorithm or LeastTimeMethod!
 func NewStreamUpstreamWithDefaultServer(name string) StreamUpstream {
@@ -78,37 +108,52 @@ func IsStreamUpstreamDefault(su StreamUpstream) bool {
 
 // DeleteStreamConfiguration deletes the configuration file, which corresponds to the
 // specified stream load balancer from NGINX conf directory
-func (ngxc *NginxController) DeleteStreamConfiguration(name string) {
+func (ngxc *NginxController) DeleteStreamConfiguration(name string) error {
 	filename := ngxc.getStreamConfigFileName(name)
+	ngxc.releaseQuarantine(name)
 
 	if ngxc.cfgType != LocalCfg {
 		// Many services are checked for existence, regarless of whether or not
 		// we have a configuration for that service.
 		if _, err := os.Stat(filename); os.IsNotExist(err) {
-			return
+			return nil
 		}
 		glog.V(2).Infof("deleting %v", filename)
 		if err := os.Remove(filename); err != nil {
-			glog.Warningf("Failed to delete %v: %v", filename, err)
+			return fmt.Errorf("failed to delete %v: %v", filename, err)
 		}
+		ngxc.removed(filename)
 	}
+	return nil
 }
 
-// AddOrUpdateStream creates or updates a file with the specified stream config
-func (ngxc *NginxController) AddOrUpdateStream(name string, config StreamNginxConfig) {
+// AddOrUpdateStream creates or updates a file with the specified stream config.
+// On error, including when NGINX rejects the configuration (InvalidConfigError),
+// the previous configuration for the stream is left in place.
+func (ngxc *NginxController) AddOrUpdateStream(name string, config StreamNginxConfig) error {
 	filename := ngxc.getStreamConfigFileName(name)
-	ngxc.templateStream(config, filename)
+	return ngxc.templateStream(name, config, filename)
+}
+
+// StreamConfiguration returns the current content of the stream's
+// configuration file
+func (ngxc *NginxController) StreamConfiguration(name string) ([]byte, error) {
+	if ngxc.cfgType == LocalCfg {
+		return nil, fmt.Errorf("no configuration is written for local configuration type")
+	}
+	content, err := ioutil.ReadFile(ngxc.getStreamConfigFileName(name))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read stream configuration: %v", err)
+	}
+	return content, nil
 }
 
 func (ngxc *NginxController) getStreamConfigFileName(name string) string {
 	return path.Join(ngxc.nginxConfdPath, name+".stream.conf")
 }
 
-func (ngxc *NginxController) templateStream(config StreamNginxConfig, filename string) {
-	tmpl, err := template.New("stream.tmpl").ParseFiles("stream.tmpl")
-	if err != nil {
-		glog.Fatalf("failed to parse stream template file: %v", err)
-	}
+func (ngxc *NginxController) templateStream(name string, config StreamNginxConfig, filename string) error {
+	tmpl := ngxc.Templates().Stream
 
 	if glog.V(2) {
 		glog.Infof("writing NGINX stream configuration to: %v", filename)
@@ -116,16 +161,72 @@ func (ngxc *NginxController) templateStream(config StreamNginxConfig, filename s
 	}
 
 	if ngxc.cfgType != LocalCfg {
-		w, err := os.Create(filename)
-		if err != nil {
-			glog.Fatalf("failed to open %v: %v", filename, err)
+		if ngxc.streamAccessLog != "" {
+			config.AccessLog = ngxc.streamAccessLog
+			config.AccessLogFormat = accesslog.Format
 		}
-		defer w.Close()
-
-		if err := tmpl.Execute(w, config); err != nil {
-			glog.Fatalf("failed to write template %v", err)
+		var content bytes.Buffer
+		if err := tmpl.Execute(&content, config); err != nil {
+			return fmt.Errorf("failed to execute template %v: %v", streamTemplateName, err)
 		}
+		return ngxc.commitConfigFile(name, filename, content.Bytes())
+	}
+	return nil
+}
+
+// sortStreamConfig orders the upstreams by name, each upstream's servers by
+// address, and the servers by listen port, so that the same configuration
+// always renders identically.
+func sortStreamConfig(config *StreamNginxConfig) {
+	sort.Sort(streamUpstreamByName(config.Upstreams))
+	for _, upstream := range config.Upstreams {
+		sort.Stable(streamUpstreamServerByAddress(upstream.UpstreamServers))
+	}
+	sort.Sort(streamServerByListen(config.Servers))
+}
+
+type streamUpstreamByName []StreamUpstream
+
+func (s streamUpstreamByName) Len() int {
+	return len(s)
+}
+func (s streamUpstreamByName) Swap(i, j int) {
+	s[i], s[j] = s[j], s[i]
+}
+func (s streamUpstreamByName) Less(i, j int) bool {
+	return s[i].Name < s[j].Name
+}
+
+type streamUpstreamServerByAddress []StreamUpstreamServer
+
+func (s streamUpstreamServerByAddress) Len() int {
+	return len(s)
+}
+func (s streamUpstreamServerByAddress) Swap(i, j int) {
+	s[i], s[j] = s[j], s[i]
+}
+func (s streamUpstreamServerByAddress) Less(i, j int) bool {
+	return s[i].Address < s[j].Address
+}
+
+type streamServerByListen []StreamServer
+
+func (s streamServerByListen) Len() int {
+	return len(s)
+}
+func (s streamServerByListen) Swap(i, j int) {
+	s[i], s[j] = s[j], s[i]
+}
+func (s streamServerByListen) Less(i, j int) bool {
+	pi, _ := strconv.Atoi(s[i].Listen.Port)
+	pj, _ := strconv.Atoi(s[j].Listen.Port)
+	if pi != pj {
+		return pi < pj
+	}
+	if s[i].Listen.Address != s[j].Listen.Address {
+		return s[i].Listen.Address < s[j].Listen.Address
 	}
+	return !s[i].Listen.UDP && s[j].Listen.UDP
 }
 
 func (s StreamNginxConfig) String() string {
@@ -0,0 +1,216 @@
+package nginx
+
+import (
+	"embed"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"text/template"
+	"time"
+
+	"github.com/golang/glog"
+	"k8s.io/client-go/pkg/util/wait"
+)
+
+const (
+	mainTemplateName   = "nginx.conf.tmpl"
+	streamTemplateName = "stream.tmpl"
+	httpTemplateName   = "http.tmpl"
+)
+
+// defaultTemplates - the templates compiled in to the binary, these are used
+// for any template that isn't overridden in the operator's template directory.
+//
+//go:embed nginx.conf.tmpl stream.tmpl http.tmpl
+var defaultTemplates embed.FS
+
+// Templates holds the parsed set of NGINX configuration templates
+type Templates struct {
+	Main   *template.Template
+	Stream *template.Template
+	HTTP   *template.Template
+	// Dir - the override directory the templates were loaded from, if any
+	Dir string
+}
+
+// NewTemplates parses the embedded default templates, replacing each with an
+// override of the same file name from dir (when dir is not empty).  Every
+// template is validated by rendering it against a sample model, so that an
+// invalid override is rejected here rather than on the first service update.
+func NewTemplates(dir string) (*Templates, error) {
+	var err error
+	tmpls := &Templates{Dir: dir}
+
+	if tmpls.Main, err = parseTemplate(dir, mainTemplateName); err != nil {
+		return nil, err
+	}
+	if tmpls.Stream, err = parseTemplate(dir, streamTemplateName); err != nil {
+		return nil, err
+	}
+	if tmpls.HTTP, err = parseTemplate(dir, httpTemplateName); err != nil {
+		return nil, err
+	}
+
+	if err = tmpls.Validate(); err != nil {
+		return nil, err
+	}
+	return tmpls, nil
+}
+
+// parseTemplate parses the override for name from dir if one exists,
+// otherwise the embedded default.
+func parseTemplate(dir, name string) (*template.Template, error) {
+	if dir != "" {
+		filename := path.Join(dir, name)
+		if _, err := os.Stat(filename); err == nil {
+			glog.V(2).Infof("using template override: %s", filename)
+			tmpl, err := template.New(name).ParseFiles(filename)
+			if err != nil {
+				return nil, fmt.Errorf("failed to parse template override %s: %v", filename, err)
+			}
+			return tmpl, nil
+		} else if !os.IsNotExist(err) {
+			return nil, fmt.Errorf("failed to stat template override %s: %v", filename, err)
+		}
+	}
+
+	tmpl, err := template.New(name).ParseFS(defaultTemplates, name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse default template %s: %v", name, err)
+	}
+	return tmpl, nil
+}
+
+// Validate renders each template against a representative sample model.
+func (t *Templates) Validate() error {
+	if err := t.Main.Execute(ioutil.Discard, sampleMainConfig()); err != nil {
+		return fmt.Errorf("template %s failed validation: %v", mainTemplateName, err)
+	}
+	if err := t.Stream.Execute(ioutil.Discard, sampleStreamConfig()); err != nil {
+		return fmt.Errorf("template %s failed validation: %v", streamTemplateName, err)
+	}
+	if err := t.HTTP.Execute(ioutil.Discard, sampleHTTPConfig()); err != nil {
+		return fmt.Errorf("template %s failed validation: %v", httpTemplateName, err)
+	}
+	return nil
+}
+
+func sampleMainConfig() *NginxMainConfig {
+	return &NginxMainConfig{
+		ErrorLogFile:         "/var/log/nginx/error.log",
+		ErrorLogLevel:        "warn",
+		PidFile:              "/var/run/nginx.pid",
+		User:                 "root",
+		Group:                "root",
+		WorkerProcesses:      "2",
+		Environment:          map[string]string{"SAMPLE": "1"},
+		DefaultStreamContext: true,
+		DefaultHTTPContext:   true,
+		HTTPContext: NginxMainHTTPConfig{
+			ServerNamesHashMaxSize: "512",
+			HealthStatus:           true,
+			HealthPort:             7331,
+			HTTPSnippets:           []string{"# sample"},
+		},
+	}
+}
+
+func sampleStreamConfig() StreamNginxConfig {
+	return StreamNginxConfig{
+		Resolver: "127.0.0.1",
+		Upstreams: []StreamUpstream{
+			{
+				Name:            "default-sample-unnamed",
+				Algorithm:       LowestLatency,
+				LeastTimeMethod: DefaultMethod,
+				UpstreamServers: []StreamUpstreamServer{
+					{Address: "127.0.0.1:30123", Weight: "1", MaxFails: "1", Backup: true},
+				},
+			},
+		},
+		Servers: []StreamServer{
+			{
+				Listen:           StreamListen{Address: "0.0.0.0", Port: "123", UDP: true},
+				ProxyPassAddress: "default-sample-unnamed",
+				ProxyPassthrough: true,
+				Service:          "default/sample",
+				PortName:         "ntp",
+			},
+		},
+		AccessLog:       "syslog:server=unix:/var/run/lbex/stream-log.sock",
+		AccessLogFormat: "$protocol|$status",
+	}
+}
+
+func sampleHTTPConfig() HTTPNginxConfig {
+	upstream := NewUpstreamWithDefaultServer("default-sample--sample")
+	return HTTPNginxConfig{
+		Upstreams: []Upstream{upstream},
+		Servers: []Server{
+			{
+				Name:           "sample.example.com",
+				SSL:            true,
+				SSLCertificate: "/etc/nginx/ssl/sample.pem",
+				HSTS:           true,
+				Locations: []Location{
+					{Path: "/", Upstream: upstream, Websocket: true},
+				},
+			},
+		},
+	}
+}
+
+// templateFingerprint returns a stable description of the override files
+// present in dir, used to detect changes without a file system notifier.
+func templateFingerprint(dir string) string {
+	fingerprint := ""
+	for _, name := range []string{mainTemplateName, streamTemplateName, httpTemplateName} {
+		info, err := os.Stat(path.Join(dir, name))
+		if err != nil {
+			continue
+		}
+		fingerprint += fmt.Sprintf("%s:%d:%d;", name, info.Size(), info.ModTime().UnixNano())
+	}
+	return fingerprint
+}
+
+// WatchTemplates polls the override directory every period.  When the set of
+// overrides changes, the templates are re-parsed and re-validated; valid
+// templates replace the current set, the main configuration file is rewritten
+// and onChange is invoked so that the caller can re-render its configuration.
+// Invalid templates are logged and the current set is left in place.
+// WatchTemplates returns once stopCh is closed, even when there is no override
+// directory to watch.
+func (ngxc *NginxController) WatchTemplates(dir string, period time.Duration, onChange func(), stopCh <-chan struct{}) {
+	if dir == "" {
+		<-stopCh
+		return
+	}
+	last := templateFingerprint(dir)
+	wait.Until(func() {
+		current := templateFingerprint(dir)
+		if current == last {
+			return
+		}
+		last = current
+
+		tmpls, err := NewTemplates(dir)
+		if err != nil {
+			glog.Errorf("template change rejected, keeping current templates: %v", err)
+			return
+		}
+		glog.V(2).Infof("reloading templates from: %s", dir)
+		ngxc.SetTemplates(tmpls)
+		if ngxc.mainCfg != nil {
+			if err := ngxc.UpdateMainConfigFile(); err != nil {
+				glog.Errorf("error updating main configuration after template change: %v", err)
+			} else if err := ngxc.Reload(); err != nil {
+				glog.Errorf("error on reload after template change: %v", err)
+			}
+		}
+		if onChange != nil {
+			onChange()
+		}
+	}, period, stopCh)
+}
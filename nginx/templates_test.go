@@ -0,0 +1,48 @@
+package nginx
+
+import (
+	"bytes"
+	"regexp"
+	"testing"
+)
+
+func TestStreamTemplateLogFormatNames(t *testing.T) {
+	tmpls, err := NewTemplates("")
+	if err != nil {
+		t.Fatalf("NewTemplates: %v", err)
+	}
+
+	// services on the same port, with different VIPs, in the same stream context
+	var out bytes.Buffer
+	for _, svc := range []struct{ key, upstream, vip string }{
+		{"ns/a", "ns-a-dns", "192.0.2.1"},
+		{"ns/b", "ns-b-dns", "192.0.2.2"},
+	} {
+		cfg := sampleStreamConfig()
+		cfg.Upstreams[0].Name = svc.upstream
+		cfg.Servers[0].ProxyPassAddress = svc.upstream
+		cfg.Servers[0].Listen.Address = svc.vip
+		cfg.Servers[0].Service = svc.key
+		if err := tmpls.Stream.Execute(&out, cfg); err != nil {
+			t.Fatalf("%s: %v", svc.key, err)
+		}
+	}
+
+	defined := map[string]int{}
+	for _, match := range regexp.MustCompile(`log_format (\S+) `).FindAllStringSubmatch(out.String(), -1) {
+		defined[match[1]]++
+	}
+	if len(defined) != 2 {
+		t.Fatalf("got log formats %v, want one for each service", defined)
+	}
+	for name, count := range defined {
+		if count != 1 {
+			t.Errorf("log format %s defined %d times", name, count)
+		}
+	}
+	for _, match := range regexp.MustCompile(`access_log \S+ (\S+);`).FindAllStringSubmatch(out.String(), -1) {
+		if defined[match[1]] == 0 {
+			t.Errorf("access log uses undefined log format %s", match[1])
+		}
+	}
+}
@@ -0,0 +1,209 @@
+package nginx
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/golang/glog"
+)
+
+// stagingSuffix - generated configuration is written to a staging file with
+// this suffix first, which doesn't match any of the main configuration's
+// include patterns (*.stream.conf, *.http.conf).
+const stagingSuffix = ".staging"
+
+// InvalidConfigError - a generated configuration was rejected by validation
+type InvalidConfigError struct {
+	Name string
+	Err  error
+}
+
+func (e *InvalidConfigError) Error() string {
+	return fmt.Sprintf("configuration %s rejected, previous configuration restored: %v", e.Name, e.Err)
+}
+
+// Rejected - the configuration was rejected, retrying it unchanged won't help
+func (e *InvalidConfigError) Rejected() bool {
+	return true
+}
+
+// IsInvalidConfig checks the error type
+func IsInvalidConfig(e error) bool {
+	_, ok := e.(*InvalidConfigError)
+	return ok
+}
+
+// writeStagingFile writes content to filename's staging file and flushes it to
+// disk, returning the name of the staging file.
+func writeStagingFile(filename string, content []byte) (string, error) {
+	staging := filename + stagingSuffix
+	w, err := os.Create(staging)
+	if err != nil {
+		return staging, fmt.Errorf("failed to open %v: %v", staging, err)
+	}
+	if _, err = w.Write(content); err == nil {
+		err = w.Sync()
+	}
+	if cerr := w.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(staging)
+		return staging, fmt.Errorf("failed to write %v: %v", staging, err)
+	}
+	return staging, nil
+}
+
+// replaceFile atomically replaces filename with content.
+func replaceFile(filename string, content []byte) error {
+	staging, err := writeStagingFile(filename, content)
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(staging, filename); err != nil {
+		os.Remove(staging)
+		return fmt.Errorf("failed to rename %v to %v: %v", staging, filename, err)
+	}
+	return nil
+}
+
+// commitConfigFile transactionally replaces the named configuration file with
+// content, unless content is unchanged.  The new content is staged, and the
+// complete NGINX configuration is validated with the staged file in place of
+// the named file, before the staged file is atomically renamed in to place.
+// If validation fails the staged file is removed, the configuration is
+// quarantined, and an InvalidConfigError is returned.  The rejected file is
+// never in the configuration directory, so it can't be loaded by a reload or
+// restart of NGINX, and never breaks the reload of any other configuration.
+func (ngxc *NginxController) commitConfigFile(name, filename string, content []byte) error {
+	if ngxc.unchanged(filename, content) {
+		glog.V(3).Infof("configuration unchanged, skipping write: %v", filename)
+		return nil
+	}
+
+	staging, err := writeStagingFile(filename, content)
+	if err != nil {
+		return err
+	}
+
+	if verr := ngxc.validateStaged(filename, staging); verr != nil {
+		os.Remove(staging)
+		ierr := &InvalidConfigError{Name: name, Err: verr}
+		ngxc.quarantine(name, ierr)
+		return ierr
+	}
+
+	if err := os.Rename(staging, filename); err != nil {
+		os.Remove(staging)
+		return fmt.Errorf("failed to rename %v to %v: %v", staging, filename, err)
+	}
+	ngxc.written(filename, content)
+	ngxc.releaseQuarantine(name)
+	return nil
+}
+
+// validateStaged tests the complete NGINX configuration, with the staging file
+// in place of filename.  The main configuration is copied to a temporary
+// directory, with its' includes of the configuration directory replaced by a
+// directory of links to the current configuration files and the staging file.
+func (ngxc *NginxController) validateStaged(filename, staging string) error {
+	if ngxc.cfgType == LocalCfg || ngxc.dryRun {
+		return nil
+	}
+	mainConf, err := ioutil.ReadFile(path.Join(ngxc.nginxConfPath, mainConfFilename))
+	if err != nil {
+		return fmt.Errorf("failed to read the main configuration: %v", err)
+	}
+
+	dir, err := ioutil.TempDir("", "lbex-validate")
+	if err != nil {
+		return fmt.Errorf("failed to create a validation directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	confd := path.Join(dir, "conf.d")
+	if err := os.Mkdir(confd, 0755); err != nil {
+		return fmt.Errorf("failed to create a validation directory: %v", err)
+	}
+
+	files, err := ioutil.ReadDir(ngxc.nginxConfdPath)
+	if err != nil {
+		return fmt.Errorf("failed to read %v: %v", ngxc.nginxConfdPath, err)
+	}
+	for _, file := range files {
+		if file.IsDir() || file.Name() == path.Base(filename) || strings.HasSuffix(file.Name(), stagingSuffix) {
+			continue
+		}
+		if err := os.Symlink(path.Join(ngxc.nginxConfdPath, file.Name()), path.Join(confd, file.Name())); err != nil {
+			return fmt.Errorf("failed to link %v: %v", file.Name(), err)
+		}
+	}
+	abs, err := filepath.Abs(staging)
+	if err != nil {
+		return err
+	}
+	if err := os.Symlink(abs, path.Join(confd, path.Base(filename))); err != nil {
+		return fmt.Errorf("failed to link %v: %v", staging, err)
+	}
+
+	testConf := path.Join(dir, mainConfFilename)
+	content := strings.Replace(string(mainConf), ngxc.nginxConfdPath+"/", confd+"/", -1)
+	if err := ioutil.WriteFile(testConf, []byte(content), 0644); err != nil {
+		return fmt.Errorf("failed to write %v: %v", testConf, err)
+	}
+	if err := shellOut("nginx -t -c " + testConf); err != nil {
+		return fmt.Errorf("invalid nginx configuration detected: %s", err)
+	}
+	return nil
+}
+
+// Validate tests the complete NGINX configuration
+func (ngxc *NginxController) Validate() error {
+	if ngxc.cfgType == LocalCfg || ngxc.dryRun {
+		return nil
+	}
+	if err := shellOut("nginx -t"); err != nil {
+		return fmt.Errorf("invalid nginx configuration detected: %s", err)
+	}
+	return nil
+}
+
+func (ngxc *NginxController) quarantine(name string, err error) {
+	ngxc.qLock.Lock()
+	defer ngxc.qLock.Unlock()
+	glog.Errorf("quarantining configuration: %s: %v", name, err)
+	ngxc.quarantined[name] = err
+}
+
+func (ngxc *NginxController) releaseQuarantine(name string) {
+	ngxc.qLock.Lock()
+	defer ngxc.qLock.Unlock()
+	if _, ok := ngxc.quarantined[name]; ok {
+		glog.V(2).Infof("releasing configuration from quarantine: %s", name)
+		delete(ngxc.quarantined, name)
+	}
+}
+
+// Quarantined returns whether or not a configuration is currently quarantined,
+// and if so the validation error that caused it to be.
+func (ngxc *NginxController) Quarantined(name string) (bool, error) {
+	ngxc.qLock.RLock()
+	defer ngxc.qLock.RUnlock()
+	err, ok := ngxc.quarantined[name]
+	return ok, err
+}
+
+// QuarantinedConfigurations returns the set of quarantined configurations,
+// and the error that caused each to be quarantined.
+func (ngxc *NginxController) QuarantinedConfigurations() map[string]error {
+	ngxc.qLock.RLock()
+	defer ngxc.qLock.RUnlock()
+	result := make(map[string]error, len(ngxc.quarantined))
+	for name, err := range ngxc.quarantined {
+		result[name] = err
+	}
+	return result
+}
@@ -2,6 +2,9 @@ package main
 
 import (
 	"errors"
+	"net"
+
+	"github.com/golang/glog"
 
 	"k8s.io/client-go/pkg/api"
 	v1 "k8s.io/client-go/pkg/api/v1"
@@ -13,11 +16,23 @@ type Node struct {
 	Address NodeAddress
 }
 
-// NodeAddress models a k8s worker node address v1.NodeAddress (node.status.addresses)
+const (
+	// ExcludeNodeLabel - a node with this label set to "true" is drained from
+	// the upstreams, as it would be if it were cordoned
+	ExcludeNodeLabel = "loadbalancer.lbex/exclude"
+	// taintEffectNoExecute - the taint effect that evicts a node's pods, which
+	// is not yet defined by the vendored API
+	taintEffectNoExecute = "NoExecute"
+)
+
+// NodeAddress models a k8s worker node address v1.NodeAddress (node.status.addresses),
+// the IPv4 and IPv6 addresses of each type
 type NodeAddress struct {
-	Hostname   string
-	ExternalIP string
-	InternalIP string
+	Hostname     string
+	ExternalIP   string
+	InternalIP   string
+	ExternalIPv6 string
+	InternalIPv6 string
 }
 
 // ValidateNodeObjectType return wether or not the given object
@@ -60,7 +75,9 @@ func GetNodePodCIDR(obj interface{}) (string, error) {
 	return string(node.Spec.PodCIDR), nil
 }
 
-// GetNodeAddress returns the node's addresses object, or an error
+// GetNodeAddress returns the node's addresses object, or an error.  A dual
+// stack node has an IPv4 and an IPv6 address of each type, the first of each
+// family is used.
 func GetNodeAddress(obj interface{}) (NodeAddress, error) {
 	nodeAddr := NodeAddress{}
 	node, ok := obj.(*v1.Node)
@@ -73,14 +90,28 @@ func GetNodeAddress(obj interface{}) (NodeAddress, error) {
 		case v1.NodeHostName:
 			nodeAddr.Hostname = addr.Address
 		case v1.NodeExternalIP:
-			nodeAddr.ExternalIP = addr.Address
+			setFamilyAddress(&nodeAddr.ExternalIP, &nodeAddr.ExternalIPv6, addr.Address)
 		case v1.NodeInternalIP:
-			nodeAddr.InternalIP = addr.Address
+			setFamilyAddress(&nodeAddr.InternalIP, &nodeAddr.InternalIPv6, addr.Address)
 		}
 	}
 	return nodeAddr, nil
 }
 
+// setFamilyAddress sets ipv4, or ipv6, to the address according to its' IP
+// family, unless it is already set
+func setFamilyAddress(ipv4, ipv6 *string, address string) {
+	ip := net.ParseIP(address)
+	switch {
+	case ip == nil:
+		return
+	case ip.To4() != nil && *ipv4 == "":
+		*ipv4 = address
+	case ip.To4() == nil && *ipv6 == "":
+		*ipv6 = address
+	}
+}
+
 // GetNodeExternalIP returns the node's external ip address value as a string, or an error
 func GetNodeExternalIP(obj interface{}) (string, error) {
 	addrs, err := GetNodeAddress(obj)
@@ -108,6 +139,19 @@ func GetNodeHostname(obj interface{}) (string, error) {
 	return addrs.Hostname, nil
 }
 
+// GetNodeLabels returns a copy of the node's labels, or nil
+func GetNodeLabels(obj interface{}) map[string]string {
+	node, ok := obj.(*v1.Node)
+	if !ok || len(node.Labels) == 0 {
+		return nil
+	}
+	nodeLabels := make(map[string]string, len(node.Labels))
+	for key, value := range node.Labels {
+		nodeLabels[key] = value
+	}
+	return nodeLabels
+}
+
 // IsNodeScheduleable returns the node's schedulability status, true if the
 // node can schedule pods, false otherwise
 func IsNodeScheduleable(obj interface{}) bool {
@@ -117,3 +161,49 @@ func IsNodeScheduleable(obj interface{}) bool {
 	}
 	return node.Spec.Unschedulable == false
 }
+
+// IsNodeReady returns the node's readiness, true unless its' Ready condition
+// is other than true, or its' network is unavailable
+func IsNodeReady(obj interface{}) bool {
+	node, ok := obj.(*v1.Node)
+	if !ok {
+		return false
+	}
+	for _, condition := range node.Status.Conditions {
+		switch condition.Type {
+		case v1.NodeReady:
+			if condition.Status != v1.ConditionTrue {
+				return false
+			}
+		case v1.NodeNetworkUnavailable:
+			if condition.Status == v1.ConditionTrue {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// IsNodeDraining returns true if the node's pods are leaving, or should not be
+// load balanced to: the node is cordoned (unschedulable), has a NoExecute
+// taint, or has the exclude label set to "true"
+func IsNodeDraining(obj interface{}) bool {
+	node, ok := obj.(*v1.Node)
+	if !ok {
+		return false
+	}
+	if node.Spec.Unschedulable || node.Labels[ExcludeNodeLabel] == "true" {
+		return true
+	}
+	taints, err := api.GetTaintsFromNodeAnnotations(node.Annotations)
+	if err != nil {
+		glog.V(3).Infof("node %s: invalid taints annotation: %v", node.Name, err)
+		return false
+	}
+	for _, taint := range taints {
+		if string(taint.Effect) == taintEffectNoExecute {
+			return true
+		}
+	}
+	return false
+}
@@ -36,7 +36,7 @@ func newNodesListWatchControllerForClientset(lbex *lbExController) *lwController
 		UpdateFunc: nodeUpdatedFunc(lbex),
 	}
 
-	lbex.nodesStore, lwc.controller = cache.NewInformer(listWatch, &v1.Node{}, resyncPeriod, eventHandler)
+	lbex.nodesStore, lwc.controller = cache.NewInformer(listWatch, &v1.Node{}, resyncPeriod, recordInformerSyncs("nodes", eventHandler))
 
 	return lwc
 }
@@ -85,10 +85,13 @@ func nodeUpdateEqual(old, new *v1.Node) bool {
 	// - node.status.capacity
 	// - node.status.nodeinfo
 	// Data that varies freqently, but doesn't affect our ability to use the node:
-	// - node.status.conditions <--- constantly changing timestamps for health checks
+	// - node.status.conditions <--- constantly changing timestamps for health checks,
+	//   only the readiness that the Ready and NetworkUnavailable conditions' status
+	//   add up to is compared
 	// - node.status.images <--- chanes every time a new image is pulled
 
-	return reflect.DeepEqual(old.GetAnnotations(), new.GetAnnotations()) &&
+	return IsNodeReady(old) == IsNodeReady(new) &&
+		reflect.DeepEqual(old.GetAnnotations(), new.GetAnnotations()) &&
 		reflect.DeepEqual(old.GetLabels(), new.GetLabels()) &&
 		reflect.DeepEqual(old.Spec, new.Spec) &&
 		reflect.DeepEqual(old.Status.Addresses, new.Status.Addresses) &&
@@ -0,0 +1,199 @@
+package proxy
+
+import (
+	"hash/fnv"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/sostheim/lbex/nginx"
+)
+
+// SupportedAlgorithms - the subset of nginx.SupportedAlgorithms implemented by
+// the proxy, which has no latency based algorithm.
+var SupportedAlgorithms = []string{
+	nginx.RoundRobin,
+	nginx.LeastConnections,
+	nginx.SourceIPHash,
+}
+
+// tracker tracks the open connections (or UDP sessions) to one upstream
+// address of a listener.  A tracker is shared by each successive pool of the
+// listener, so connection counts survive live updates.
+type tracker struct {
+	address string
+	active  int64
+
+	lock     sync.Mutex
+	conns    map[io.Closer]bool
+	draining bool
+}
+
+func newTracker(address string) *tracker {
+	return &tracker{
+		address: address,
+		conns:   make(map[io.Closer]bool),
+	}
+}
+
+// track adds the connection, returns false if the upstream is draining, in
+// which case the connection must not be used.
+func (t *tracker) track(c io.Closer) bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.draining {
+		return false
+	}
+	t.conns[c] = true
+	atomic.AddInt64(&t.active, 1)
+	return true
+}
+
+func (t *tracker) untrack(c io.Closer) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.conns[c] {
+		delete(t.conns, c)
+		atomic.AddInt64(&t.active, -1)
+	}
+}
+
+// Active returns the number of open connections
+func (t *tracker) Active() int64 {
+	return atomic.LoadInt64(&t.active)
+}
+
+// drain stops new connections to the upstream, and allows existing ones up to
+// timeout to complete before closing them.
+func (t *tracker) drain(timeout time.Duration) {
+	t.lock.Lock()
+	t.draining = true
+	remaining := len(t.conns)
+	t.lock.Unlock()
+
+	if remaining == 0 {
+		return
+	}
+	glog.V(3).Infof("draining %d connection(s) to upstream: %s", remaining, t.address)
+	time.AfterFunc(timeout, func() {
+		t.lock.Lock()
+		defer t.lock.Unlock()
+		if len(t.conns) > 0 {
+			glog.V(3).Infof("drain timeout, closing %d connection(s) to upstream: %s", len(t.conns), t.address)
+		}
+		for c := range t.conns {
+			c.Close()
+		}
+	})
+}
+
+// upstream is one server of a pool
+type upstream struct {
+	*tracker
+	weight        int
+	backup        bool
+	down          bool
+	currentWeight int
+}
+
+// pool is an immutable upstream set, plus the algorithm's selection state.
+// Live updates replace a listener's pool.
+type pool struct {
+	algorithm string
+	lock      sync.Mutex
+	upstreams []*upstream
+}
+
+// pick selects the upstream for a new connection from client, or nil if there
+// is none available.  Backup upstreams are only selected when no primary
+// upstream is available.
+func (p *pool) pick(client net.IP) *upstream {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	candidates := p.available(false)
+	if len(candidates) == 0 {
+		candidates = p.available(true)
+	}
+	if len(candidates) == 0 {
+		return nil
+	}
+
+	switch p.algorithm {
+	case nginx.SourceIPHash:
+		return pickSourceHash(candidates, client)
+	case nginx.LeastConnections:
+		return pickLeastConnections(candidates)
+	default:
+		return pickRoundRobin(candidates)
+	}
+}
+
+// available must be called with the lock held
+func (p *pool) available(backup bool) []*upstream {
+	list := []*upstream{}
+	for _, u := range p.upstreams {
+		if !u.down && u.backup == backup {
+			list = append(list, u)
+		}
+	}
+	return list
+}
+
+// pickRoundRobin - NGINX's smooth weighted round robin, with equal weights
+// the upstreams are selected in turn.
+func pickRoundRobin(candidates []*upstream) *upstream {
+	var best *upstream
+	total := 0
+	for _, u := range candidates {
+		u.currentWeight += u.weight
+		total += u.weight
+		if best == nil || u.currentWeight > best.currentWeight {
+			best = u
+		}
+	}
+	best.currentWeight -= total
+	return best
+}
+
+// pickLeastConnections - the upstream with the fewest open connections
+// relative to its' weight, ties are resolved by round robin.
+func pickLeastConnections(candidates []*upstream) *upstream {
+	least := []*upstream{}
+	for _, u := range candidates {
+		if len(least) == 0 {
+			least = append(least, u)
+			continue
+		}
+		// compare active/weight without division
+		lhs := u.Active() * int64(least[0].weight)
+		rhs := least[0].Active() * int64(u.weight)
+		switch {
+		case lhs < rhs:
+			least = []*upstream{u}
+		case lhs == rhs:
+			least = append(least, u)
+		}
+	}
+	return pickRoundRobin(least)
+}
+
+// pickSourceHash - rendezvous (highest random weight) hashing of the client
+// address, so removing an upstream only remaps the clients that were using it.
+func pickSourceHash(candidates []*upstream, client net.IP) *upstream {
+	var best *upstream
+	var bestScore uint64
+	for _, u := range candidates {
+		h := fnv.New64a()
+		h.Write(client.To16())
+		h.Write([]byte(u.address))
+		score := h.Sum64()
+		if best == nil || score > bestScore {
+			best, bestScore = u, score
+		}
+	}
+	return best
+}
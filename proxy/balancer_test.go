@@ -0,0 +1,122 @@
+package proxy
+
+import (
+	"net"
+	"testing"
+
+	"github.com/sostheim/lbex/nginx"
+)
+
+func newTestUpstream(address string, weight int) *upstream {
+	return &upstream{tracker: newTracker(address), weight: weight}
+}
+
+// testConn is a connection placeholder for the trackers
+type testConn struct{ id int }
+
+func (c *testConn) Close() error { return nil }
+
+func TestPickRoundRobinSmooth(t *testing.T) {
+	a, b, c := newTestUpstream("a", 5), newTestUpstream("b", 1), newTestUpstream("c", 1)
+	candidates := []*upstream{a, b, c}
+
+	// NGINX's smooth weighted round robin sequence for weights 5, 1, 1
+	want := []string{"a", "a", "b", "a", "c", "a", "a"}
+	for round := 0; round < 2; round++ {
+		for i, address := range want {
+			if got := pickRoundRobin(candidates).address; got != address {
+				t.Fatalf("round %d, pick %d: got %s, want %s", round, i, got, address)
+			}
+		}
+	}
+}
+
+func TestPickRoundRobinEqualWeights(t *testing.T) {
+	candidates := []*upstream{newTestUpstream("a", 1), newTestUpstream("b", 1), newTestUpstream("c", 1)}
+	counts := make(map[string]int)
+	for i := 0; i < 30; i++ {
+		counts[pickRoundRobin(candidates).address]++
+	}
+	for _, u := range candidates {
+		if counts[u.address] != 10 {
+			t.Errorf("upstream %s: picked %d times, want 10", u.address, counts[u.address])
+		}
+	}
+}
+
+func TestPickLeastConnections(t *testing.T) {
+	a, b, c := newTestUpstream("a", 1), newTestUpstream("b", 1), newTestUpstream("c", 2)
+	for i := 0; i < 2; i++ {
+		a.track(&testConn{i})
+	}
+	b.track(&testConn{0})
+	for i := 0; i < 3; i++ {
+		c.track(&testConn{i})
+	}
+	// active/weight: a 2, b 1, c 1.5
+	if got := pickLeastConnections([]*upstream{a, b, c}).address; got != "b" {
+		t.Errorf("got %s, want b", got)
+	}
+
+	// ties are resolved by round robin
+	b.track(&testConn{1})
+	c.track(&testConn{3})
+	// active/weight: a 2, b 2, c 2
+	counts := make(map[string]int)
+	for i := 0; i < 8; i++ {
+		counts[pickLeastConnections([]*upstream{a, b, c}).address]++
+	}
+	if counts["a"] != 2 || counts["b"] != 2 || counts["c"] != 4 {
+		t.Errorf("tied picks: got %v, want a 2, b 2, c 4", counts)
+	}
+}
+
+func TestPickSourceHash(t *testing.T) {
+	candidates := []*upstream{newTestUpstream("a", 1), newTestUpstream("b", 1), newTestUpstream("c", 1)}
+	clients := []net.IP{}
+	for i := 1; i <= 64; i++ {
+		clients = append(clients, net.IPv4(192, 0, 2, byte(i)))
+	}
+
+	picks := make(map[string]string)
+	used := make(map[string]bool)
+	for _, client := range clients {
+		u := pickSourceHash(candidates, client)
+		if again := pickSourceHash(candidates, client); again != u {
+			t.Fatalf("client %s: picked %s then %s", client, u.address, again.address)
+		}
+		picks[client.String()] = u.address
+		used[u.address] = true
+	}
+	if len(used) != len(candidates) {
+		t.Errorf("%d clients only used upstreams %v", len(clients), used)
+	}
+
+	// removing an upstream only remaps the clients that were using it
+	remaining := []*upstream{candidates[0], candidates[2]}
+	for _, client := range clients {
+		before := picks[client.String()]
+		after := pickSourceHash(remaining, client).address
+		if before != "b" && after != before {
+			t.Errorf("client %s: remapped from %s to %s", client, before, after)
+		}
+	}
+}
+
+func TestPoolPickBackupAndDown(t *testing.T) {
+	primary, backup := newTestUpstream("primary", 1), newTestUpstream("backup", 1)
+	backup.backup = true
+	p := &pool{algorithm: nginx.RoundRobin, upstreams: []*upstream{primary, backup}}
+
+	if got := p.pick(nil); got != primary {
+		t.Errorf("got %v, want the primary upstream", got.address)
+	}
+	primary.down = true
+	if got := p.pick(nil); got != backup {
+		t.Errorf("primary down: got %v, want the backup upstream", got.address)
+	}
+	backup.down = true
+	if got := p.pick(nil); got != nil {
+		t.Errorf("all down: got %v, want none", got.address)
+	}
+}
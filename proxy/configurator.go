@@ -0,0 +1,163 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/golang/glog"
+	"github.com/sostheim/lbex/nginx"
+)
+
+// Configurator drives a Proxy from the service model.  As for the other data
+// planes, the upstreams for each service are generated by an
+// nginx.Configurator, so the node, pod and cluster-ip upstream types resolve
+// to the same servers.
+type Configurator struct {
+	proxy       *Proxy
+	model       *nginx.Configurator
+	healthCheck bool
+	healthPort  int
+}
+
+// NewConfigurator creates a new Configurator
+func NewConfigurator(proxy *Proxy, healthCheck bool, healthPort int) *Configurator {
+	return &Configurator{
+		proxy:       proxy,
+		model:       nginx.NewConfigurator(nil),
+		healthCheck: healthCheck,
+		healthPort:  healthPort,
+	}
+}
+
+// Start starts the health check service, if enabled
+func (cfgtor *Configurator) Start() error {
+	if !cfgtor.healthCheck {
+		return nil
+	}
+	ln, err := net.Listen(TCP, ":"+strconv.Itoa(cfgtor.healthPort))
+	if err != nil {
+		return fmt.Errorf("failed to start health check service: %v", err)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("healthy\n"))
+	})
+	go func() {
+		glog.Errorf("health check service exited: %v", http.Serve(ln, mux))
+	}()
+	return nil
+}
+
+// Close closes every listener of the proxy
+func (cfgtor *Configurator) Close() {
+	cfgtor.proxy.Close()
+}
+
+// State returns the node and service upstream state
+func (cfgtor *Configurator) State() *nginx.State {
+	return cfgtor.model.State()
+}
+
+// AddOrUpdateNode - add, update (including removing) the node from the set of
+// upstream candidates, returns the keys of the services that are affected.
+func (cfgtor *Configurator) AddOrUpdateNode(node nginx.Node) []string {
+	return cfgtor.model.AddOrUpdateNode(node)
+}
+
+// DeleteNode - removes the node (if it exists) from the set of upstream
+// candidates, returns the keys of the services that are affected.
+func (cfgtor *Configurator) DeleteNode(name string) []string {
+	return cfgtor.model.DeleteNode(name)
+}
+
+// AddOrUpdateService applies the service's listeners and upstreams live
+func (cfgtor *Configurator) AddOrUpdateService(svc *nginx.ServiceSpec) error {
+	streamCfg := cfgtor.model.GenerateStreamConfig(svc)
+	return cfgtor.proxy.Update(svc.Key, generateListeners(svc.ConfigName, streamCfg))
+}
+
+// DeleteService closes the service's listeners
+func (cfgtor *Configurator) DeleteService(key, name string) error {
+	cfgtor.model.State().RemoveService(key)
+	cfgtor.proxy.Remove(key)
+	return nil
+}
+
+// ServiceConfig returns the service's current listeners, as JSON
+func (cfgtor *Configurator) ServiceConfig(key, name string) (string, error) {
+	listeners := cfgtor.proxy.Listeners(key)
+	if len(listeners) == 0 {
+		return "", fmt.Errorf("no configuration for service: %s", key)
+	}
+	j, err := json.MarshalIndent(listeners, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	return string(j) + "\n", nil
+}
+
+// Validate - the proxy's configuration is always applied directly
+func (cfgtor *Configurator) Validate() error {
+	return nil
+}
+
+// Reload - upstream changes are applied live, there is nothing to reload
+func (cfgtor *Configurator) Reload() error {
+	return nil
+}
+
+// Healthy - the proxy runs in process, so is running if LBEX is
+func (cfgtor *Configurator) Healthy() error {
+	return nil
+}
+
+// ReloadStats - the proxy never reloads
+func (cfgtor *Configurator) ReloadStats() nginx.ReloadStats {
+	return nginx.ReloadStats{}
+}
+
+// generateListeners converts the stream configuration model for a service in
+// to proxy listeners
+func generateListeners(name string, streamCfg nginx.StreamNginxConfig) []Listener {
+	upstreams := make(map[string]nginx.StreamUpstream)
+	for _, upstream := range streamCfg.Upstreams {
+		upstreams[upstream.Name] = upstream
+	}
+
+	listeners := []Listener{}
+	for _, server := range streamCfg.Servers {
+		upstream, ok := upstreams[server.ProxyPassAddress]
+		if !ok {
+			glog.Warningf("no upstream %s for: %s port %s", server.ProxyPassAddress, name, server.Listen.Port)
+			continue
+		}
+		if server.ProxyPassthrough {
+			glog.Warningf("proxy does not support passthrough, ignored for: %s port %s", name, server.Listen.Port)
+		}
+
+		protocol := TCP
+		if server.Listen.UDP {
+			protocol = UDP
+		}
+		listener := Listener{
+			Protocol:  protocol,
+			Address:   net.JoinHostPort(server.Listen.Address, server.Listen.Port),
+			Algorithm: strings.ToLower(upstream.Algorithm),
+		}
+		for _, us := range upstream.UpstreamServers {
+			weight, _ := strconv.Atoi(us.Weight)
+			listener.Upstreams = append(listener.Upstreams, Upstream{
+				Address: us.Address,
+				Weight:  weight,
+				Backup:  us.Backup,
+				Down:    us.Down,
+			})
+		}
+		listeners = append(listeners, listener)
+	}
+	return listeners
+}
@@ -0,0 +1,313 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"reflect"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+const (
+	// TCP - listener protocol
+	TCP = "tcp"
+	// UDP - listener protocol
+	UDP = "udp"
+
+	dialTimeout    = 10 * time.Second
+	udpIdleTimeout = 60 * time.Second
+)
+
+// Listener describes a listening address and the upstreams that it balances
+// connections across
+type Listener struct {
+	Protocol  string
+	Address   string
+	Algorithm string
+	Upstreams []Upstream
+}
+
+// Upstream describes a single upstream server of a Listener
+type Upstream struct {
+	Address string
+	Weight  int
+	Backup  bool
+	Down    bool
+}
+
+// Proxy is an in-process L4 (TCP and UDP) load balancer.  The upstreams of a
+// listener are updated live, without interrupting existing connections, and
+// connections to removed upstreams are drained.
+type Proxy struct {
+	lock         sync.Mutex
+	drainTimeout time.Duration
+
+	// map listener key (protocol/address) to listener
+	listeners map[string]*listener
+
+	// map service key to the keys of its' listeners
+	services map[string][]string
+}
+
+// NewProxy creates a Proxy.  Connections to removed upstreams (and listeners)
+// are closed after drainTimeout.
+func NewProxy(drainTimeout time.Duration) *Proxy {
+	return &Proxy{
+		drainTimeout: drainTimeout,
+		listeners:    make(map[string]*listener),
+		services:     make(map[string][]string),
+	}
+}
+
+func listenerKey(protocol, address string) string {
+	return protocol + "/" + address
+}
+
+// Update replaces the listeners of the service identified by key.  New
+// listeners are opened first, and if any can't be opened the service is left
+// unchanged.  The upstreams of existing listeners are replaced live.
+func (p *Proxy) Update(key string, listeners []Listener) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	owned := make(map[string]bool)
+	for _, lk := range p.services[key] {
+		owned[lk] = true
+	}
+
+	wanted := make(map[string]Listener)
+	opened := []*listener{}
+	for _, spec := range listeners {
+		lk := listenerKey(spec.Protocol, spec.Address)
+		if _, dup := wanted[lk]; dup {
+			glog.Warningf("service: %s, ignoring duplicate listener: %s", key, lk)
+			continue
+		}
+		wanted[lk] = spec
+		if owned[lk] {
+			continue
+		}
+		if _, exists := p.listeners[lk]; exists {
+			p.closeAll(opened)
+			return fmt.Errorf("listener %s is already in use by another service", lk)
+		}
+		l, err := newListener(spec.Protocol, spec.Address, p.drainTimeout)
+		if err != nil {
+			p.closeAll(opened)
+			return err
+		}
+		opened = append(opened, l)
+	}
+
+	for _, l := range opened {
+		p.listeners[l.key] = l
+		go l.serve()
+	}
+	for lk := range owned {
+		if _, ok := wanted[lk]; !ok {
+			p.listeners[lk].close()
+			delete(p.listeners, lk)
+		}
+	}
+
+	keys := make([]string, 0, len(wanted))
+	for lk, spec := range wanted {
+		p.listeners[lk].update(spec)
+		keys = append(keys, lk)
+	}
+	sort.Strings(keys)
+	if len(keys) > 0 {
+		p.services[key] = keys
+	} else {
+		delete(p.services, key)
+	}
+	return nil
+}
+
+// Remove closes all of the listeners of the service identified by key
+func (p *Proxy) Remove(key string) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	for _, lk := range p.services[key] {
+		p.listeners[lk].close()
+		delete(p.listeners, lk)
+	}
+	delete(p.services, key)
+}
+
+// Close closes every listener
+func (p *Proxy) Close() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	for lk, l := range p.listeners {
+		l.close()
+		delete(p.listeners, lk)
+	}
+	p.services = make(map[string][]string)
+}
+
+// Listeners returns the current listeners of the service identified by key
+func (p *Proxy) Listeners(key string) []Listener {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	list := []Listener{}
+	for _, lk := range p.services[key] {
+		list = append(list, p.listeners[lk].spec())
+	}
+	return list
+}
+
+// closeAll must be called with the lock held
+func (p *Proxy) closeAll(listeners []*listener) {
+	for _, l := range listeners {
+		l.close()
+	}
+}
+
+// listener is an open TCP or UDP listener and its' current upstream pool
+type listener struct {
+	key          string
+	protocol     string
+	address      string
+	drainTimeout time.Duration
+
+	tcp net.Listener
+	udp net.PacketConn
+
+	// current *pool, replaced by update
+	pool atomic.Value
+
+	lock     sync.Mutex
+	current  Listener
+	trackers map[string]*tracker
+	sessions map[string]*udpSession
+	closed   bool
+}
+
+func newListener(protocol, address string, drainTimeout time.Duration) (*listener, error) {
+	l := &listener{
+		key:          listenerKey(protocol, address),
+		protocol:     protocol,
+		address:      address,
+		drainTimeout: drainTimeout,
+		trackers:     make(map[string]*tracker),
+		sessions:     make(map[string]*udpSession),
+	}
+	l.pool.Store(&pool{})
+
+	var err error
+	switch protocol {
+	case TCP:
+		l.tcp, err = net.Listen(TCP, address)
+	case UDP:
+		l.udp, err = net.ListenPacket(UDP, address)
+	default:
+		err = fmt.Errorf("unsupported protocol: %s", protocol)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on %s: %v", l.key, err)
+	}
+	glog.V(2).Infof("listening on: %s", l.key)
+	return l, nil
+}
+
+func (l *listener) serve() {
+	if l.protocol == TCP {
+		l.serveTCP()
+	} else {
+		l.serveUDP()
+	}
+}
+
+func (l *listener) currentPool() *pool {
+	return l.pool.Load().(*pool)
+}
+
+func (l *listener) isClosed() bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.closed
+}
+
+// update replaces the upstream pool, upstreams that are no longer present are
+// drained
+func (l *listener) update(spec Listener) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	next := &pool{algorithm: spec.Algorithm}
+	present := make(map[string]bool)
+	for _, us := range spec.Upstreams {
+		if present[us.Address] {
+			continue
+		}
+		present[us.Address] = true
+		t, ok := l.trackers[us.Address]
+		if !ok {
+			t = newTracker(us.Address)
+			l.trackers[us.Address] = t
+		}
+		weight := us.Weight
+		if weight < 1 {
+			weight = 1
+		}
+		next.upstreams = append(next.upstreams, &upstream{
+			tracker: t,
+			weight:  weight,
+			backup:  us.Backup,
+			down:    us.Down,
+		})
+	}
+	l.pool.Store(next)
+	l.current = spec
+
+	for address, t := range l.trackers {
+		if !present[address] {
+			t.drain(l.drainTimeout)
+			delete(l.trackers, address)
+		}
+	}
+}
+
+func (l *listener) spec() Listener {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.current
+}
+
+// close stops accepting new connections and drains the existing ones
+func (l *listener) close() {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.closed {
+		return
+	}
+	l.closed = true
+	glog.V(2).Infof("closing listener: %s", l.key)
+
+	if l.tcp != nil {
+		l.tcp.Close()
+	}
+	for address, t := range l.trackers {
+		t.drain(l.drainTimeout)
+		delete(l.trackers, address)
+	}
+	if l.udp != nil {
+		// replies for UDP sessions are sent from the listening socket, so
+		// sessions can't outlive it
+		l.udp.Close()
+	}
+}
+
+func (l Listener) String() string {
+	j, err := json.Marshal(l)
+	if err != nil {
+		return string("cant't marshal: " + reflect.TypeOf(l).String() + ", to json string, err: " + err.Error())
+	}
+	return string(j)
+}
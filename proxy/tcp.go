@@ -0,0 +1,93 @@
+package proxy
+
+import (
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// tcpSession is a proxied client connection and its' upstream connection
+type tcpSession struct {
+	client net.Conn
+	server net.Conn
+}
+
+// Close closes both connections
+func (s *tcpSession) Close() error {
+	s.client.Close()
+	return s.server.Close()
+}
+
+func (l *listener) serveTCP() {
+	for {
+		conn, err := l.tcp.Accept()
+		if err != nil {
+			if l.isClosed() {
+				return
+			}
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				glog.Warningf("listener: %s, accept error: %v", l.key, err)
+				time.Sleep(100 * time.Millisecond)
+				continue
+			}
+			glog.Errorf("listener: %s, accept failed: %v", l.key, err)
+			return
+		}
+		go l.handleTCP(conn)
+	}
+}
+
+func (l *listener) handleTCP(client net.Conn) {
+	var ip net.IP
+	if addr, ok := client.RemoteAddr().(*net.TCPAddr); ok {
+		ip = addr.IP
+	}
+
+	up := l.currentPool().pick(ip)
+	if up == nil {
+		glog.V(3).Infof("listener: %s, no upstream available for client: %s", l.key, client.RemoteAddr())
+		client.Close()
+		return
+	}
+
+	server, err := net.DialTimeout(TCP, up.address, dialTimeout)
+	if err != nil {
+		glog.V(2).Infof("listener: %s, failed to connect to upstream: %s, err: %v", l.key, up.address, err)
+		client.Close()
+		return
+	}
+
+	session := &tcpSession{client: client, server: server}
+	if !up.track(session) {
+		session.Close()
+		return
+	}
+	defer up.untrack(session)
+
+	glog.V(4).Infof("listener: %s, proxying client: %s to upstream: %s", l.key, client.RemoteAddr(), up.address)
+	splice(client, server)
+	session.Close()
+}
+
+// splice copies data in both directions until both directions are complete.
+// When one direction completes the write side of its' destination is closed,
+// so half closed connections are proxied faithfully.
+func splice(client, server net.Conn) {
+	var wg sync.WaitGroup
+	wg.Add(2)
+	copyHalf := func(dst, src net.Conn) {
+		defer wg.Done()
+		io.Copy(dst, src)
+		if tc, ok := dst.(*net.TCPConn); ok {
+			tc.CloseWrite()
+		} else {
+			dst.Close()
+		}
+	}
+	go copyHalf(server, client)
+	go copyHalf(client, server)
+	wg.Wait()
+}
@@ -0,0 +1,126 @@
+package proxy
+
+import (
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// udpSession is the upstream socket for a single UDP client address.  Replies
+// from the upstream are sent to the client from the listening socket.
+type udpSession struct {
+	client     net.Addr
+	server     net.Conn
+	lastActive int64
+}
+
+// Close closes the upstream socket
+func (s *udpSession) Close() error {
+	return s.server.Close()
+}
+
+func (s *udpSession) touch() {
+	atomic.StoreInt64(&s.lastActive, time.Now().UnixNano())
+}
+
+func (s *udpSession) idle() time.Duration {
+	return time.Since(time.Unix(0, atomic.LoadInt64(&s.lastActive)))
+}
+
+func (l *listener) serveUDP() {
+	buf := make([]byte, 65535)
+	for {
+		n, addr, err := l.udp.ReadFrom(buf)
+		if err != nil {
+			if l.isClosed() {
+				return
+			}
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				glog.Warningf("listener: %s, read error: %v", l.key, err)
+				continue
+			}
+			glog.Errorf("listener: %s, read failed: %v", l.key, err)
+			return
+		}
+
+		session := l.udpSession(addr)
+		if session == nil {
+			continue
+		}
+		if _, err := session.server.Write(buf[:n]); err != nil {
+			glog.V(3).Infof("listener: %s, failed to forward datagram from: %s, err: %v", l.key, addr, err)
+			continue
+		}
+		session.touch()
+	}
+}
+
+// udpSession returns the client's existing session, or creates a new one
+func (l *listener) udpSession(client net.Addr) *udpSession {
+	l.lock.Lock()
+	session, ok := l.sessions[client.String()]
+	l.lock.Unlock()
+	if ok {
+		return session
+	}
+
+	var ip net.IP
+	if addr, ok := client.(*net.UDPAddr); ok {
+		ip = addr.IP
+	}
+	up := l.currentPool().pick(ip)
+	if up == nil {
+		glog.V(3).Infof("listener: %s, no upstream available for client: %s", l.key, client)
+		return nil
+	}
+
+	server, err := net.DialTimeout(UDP, up.address, dialTimeout)
+	if err != nil {
+		glog.V(2).Infof("listener: %s, failed to connect to upstream: %s, err: %v", l.key, up.address, err)
+		return nil
+	}
+	session = &udpSession{client: client, server: server}
+	session.touch()
+	if !up.track(session) {
+		session.Close()
+		return nil
+	}
+
+	l.lock.Lock()
+	l.sessions[client.String()] = session
+	l.lock.Unlock()
+
+	glog.V(4).Infof("listener: %s, new session for client: %s to upstream: %s", l.key, client, up.address)
+	go l.replyUDP(session, up.tracker)
+	return session
+}
+
+// replyUDP forwards the upstream's replies to the client, until the session
+// has been idle for udpIdleTimeout or is closed
+func (l *listener) replyUDP(session *udpSession, t *tracker) {
+	defer func() {
+		session.Close()
+		t.untrack(session)
+		l.lock.Lock()
+		delete(l.sessions, session.client.String())
+		l.lock.Unlock()
+	}()
+
+	buf := make([]byte, 65535)
+	for {
+		session.server.SetReadDeadline(time.Now().Add(udpIdleTimeout))
+		n, err := session.server.Read(buf)
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() && session.idle() < udpIdleTimeout {
+				continue
+			}
+			return
+		}
+		if _, err := l.udp.WriteTo(buf[:n], session.client); err != nil {
+			return
+		}
+		session.touch()
+	}
+}
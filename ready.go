@@ -0,0 +1,84 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+
+	"github.com/sostheim/lbex/nginx"
+)
+
+// nodeReadiness applies a change of each node's readiness to the upstreams
+// only once it has lasted for the delay, so that a node whose conditions flap
+// doesn't cause a reload on every change
+type nodeReadiness struct {
+	delay time.Duration
+	lock  sync.Mutex
+	// applied - the readiness of each node in the upstreams
+	applied map[string]bool
+	// changed - when each node's readiness started to differ from applied
+	changed map[string]time.Time
+}
+
+func newNodeReadiness(delay time.Duration) *nodeReadiness {
+	return &nodeReadiness{
+		delay:   delay,
+		applied: make(map[string]bool),
+		changed: make(map[string]time.Time),
+	}
+}
+
+// observe records the named node's current readiness, and returns the
+// readiness to apply, how long until a pending change is applied (zero when
+// there is none), and whether or not the change is new
+func (r *nodeReadiness) observe(name string, ready bool) (bool, time.Duration, bool) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	applied, ok := r.applied[name]
+	if !ok || applied == ready {
+		// a new node's readiness is applied immediately
+		r.applied[name] = ready
+		delete(r.changed, name)
+		return ready, 0, false
+	}
+	since, ok := r.changed[name]
+	if !ok {
+		since = time.Now()
+		r.changed[name] = since
+	}
+	if remaining := r.delay - time.Since(since); remaining > 0 {
+		return applied, remaining, !ok
+	}
+	r.applied[name] = ready
+	delete(r.changed, name)
+	return ready, 0, false
+}
+
+// clear forgets the named node
+func (r *nodeReadiness) clear(name string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	delete(r.applied, name)
+	delete(r.changed, name)
+}
+
+// applyReadyDelay holds the node's previous readiness until a change has
+// lasted for --node-ready-delay, when the node is synced again and the change
+// is applied
+func (lbex *lbExController) applyReadyDelay(node *nginx.Node) {
+	observed := node.Ready
+	ready, remaining, started := lbex.readiness.observe(node.Name, observed)
+	node.Ready = ready
+	if remaining <= 0 || !started {
+		return
+	}
+	glog.V(2).Infof("node %s ready: %t, applied in %v unless it changes back", node.Name, observed, remaining)
+	name := node.Name
+	time.AfterFunc(remaining, func() {
+		obj, exists, err := lbex.nodesStore.GetByKey(name)
+		if err == nil && exists {
+			lbex.nodesQueue.Enqueue(obj)
+		}
+	})
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNodeReadiness(t *testing.T) {
+	r := newNodeReadiness(time.Hour)
+
+	// a new node's readiness is applied immediately
+	if ready, remaining, _ := r.observe("n1", true); !ready || remaining != 0 {
+		t.Errorf("new node: got ready %t, %v remaining, want ready now", ready, remaining)
+	}
+
+	// a change is held until it has lasted for the delay
+	ready, remaining, started := r.observe("n1", false)
+	if !ready || remaining <= 0 || !started {
+		t.Errorf("not ready: got ready %t, %v remaining, started %t, want ready held", ready, remaining, started)
+	}
+	if _, _, started := r.observe("n1", false); started {
+		t.Errorf("still not ready: got started again")
+	}
+
+	// flapping back cancels the pending change
+	if ready, remaining, _ := r.observe("n1", true); !ready || remaining != 0 {
+		t.Errorf("ready again: got ready %t, %v remaining", ready, remaining)
+	}
+	if _, _, started := r.observe("n1", false); !started {
+		t.Errorf("not ready again: got the previous change")
+	}
+
+	// the change is applied once the delay has passed
+	r.changed["n1"] = time.Now().Add(-2 * time.Hour)
+	if ready, remaining, _ := r.observe("n1", false); ready || remaining != 0 {
+		t.Errorf("after the delay: got ready %t, %v remaining, want not ready", ready, remaining)
+	}
+
+	// a deleted node is forgotten
+	r.clear("n1")
+	if ready, remaining, _ := r.observe("n1", true); !ready || remaining != 0 {
+		t.Errorf("after deletion: got ready %t, %v remaining, want ready now", ready, remaining)
+	}
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"encoding/json"
+	goflag "flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	flag "github.com/spf13/pflag"
+
+	"github.com/sostheim/lbex/backend"
+	"github.com/sostheim/lbex/nginx"
+
+	v1 "k8s.io/client-go/pkg/api/v1"
+	"k8s.io/client-go/pkg/util/yaml"
+	"k8s.io/client-go/tools/cache"
+)
+
+const renderUsage = `Usage: lbex render [flags] FILE...
+
+Generates the NGINX configuration for the Services, Endpoints and Nodes in the
+YAML or JSON manifest FILEs (e.g. kubectl get services,endpoints,nodes -o yaml),
+without a cluster.  The configuration is printed, or written to --output-dir.
+
+`
+
+// renderKinds maps the kind of each supported object, or list of objects, to
+// the kind of the object
+var renderKinds = map[string]string{
+	"Service":       "Service",
+	"ServiceList":   "Service",
+	"Endpoints":     "Endpoints",
+	"EndpointsList": "Endpoints",
+	"Node":          "Node",
+	"NodeList":      "Node",
+}
+
+// manifestObject is the part of any object, or list of objects, needed to
+// determine its' kind
+type manifestObject struct {
+	Kind  string            `json:"kind"`
+	Items []json.RawMessage `json:"items"`
+}
+
+// runRender runs the render subcommand, returning the process exit code
+func runRender(args []string) int {
+	fs := flag.NewFlagSet("render", flag.ExitOnError)
+	fs.AddGoFlagSet(goflag.CommandLine)
+	cfg := newConfigForFlagSet(fs)
+	validate := fs.Bool("validate", false, "check the generated configuration with nginx -t, if nginx is installed")
+	fs.Usage = func() {
+		fmt.Fprint(os.Stderr, renderUsage)
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return 2
+	}
+
+	lbex := &lbExController{
+		cfg:           cfg,
+		servicesStore: cache.NewStore(keyFunc),
+		endpointStore: cache.NewStore(keyFunc),
+		nodesStore:    cache.NewStore(keyFunc),
+	}
+	for _, filename := range fs.Args() {
+		if err := lbex.loadManifest(filename); err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			return 1
+		}
+	}
+
+	outputDir := *cfg.outputDir
+	if outputDir == "" {
+		tmpDir, err := ioutil.TempDir("", "lbex-render")
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to create temporary directory: %v\n", err)
+			return 1
+		}
+		defer os.RemoveAll(tmpDir)
+		outputDir = tmpDir
+	}
+	outputDir, _ = filepath.Abs(outputDir)
+	if err := os.MkdirAll(outputDir, 0755); err != nil {
+		fmt.Fprintf(os.Stderr, "failed to create output directory: %v\n", err)
+		return 1
+	}
+
+	// a dry run NGINX backend writes the configuration, without starting NGINX
+	lb, err := backend.NewNginx(nginx.StreamCfg, outputDir, true, *cfg.templateDir, false, *cfg.healthCheck, *cfg.healthCheckPort)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return 1
+	}
+	lbex.lb = lb
+	if lbex.vips, err = newVIPAllocator(cfg, nil); err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return 1
+	}
+
+	for _, key := range lbex.nodesStore.ListKeys() {
+		obj, _, _ := lbex.nodesStore.GetByKey(key)
+		node, err := newNode(key, obj)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "node %s: %v\n", key, err)
+			continue
+		}
+		lb.AddOrUpdateNode(node)
+	}
+
+	status := 0
+	rendered := []string{}
+	keys := lbex.servicesStore.ListKeys()
+	sort.Strings(keys)
+	for _, key := range keys {
+		obj, _, _ := lbex.servicesStore.GetByKey(key)
+		if selection := lbex.selectService(obj); !selection.Selected {
+			fmt.Fprintf(os.Stderr, "skipped %s: %s\n", key, selection.Reason)
+			continue
+		}
+		vip, err := lbex.assignVIP(key, obj.(*v1.Service))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", key, err)
+			status = 1
+			continue
+		}
+		svcSpec, err := lbex.newServiceSpec(key, obj.(*v1.Service))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", key, err)
+			status = 1
+			continue
+		}
+		if svcSpec == nil {
+			fmt.Fprintf(os.Stderr, "skipped %s: no endpoints\n", key)
+			continue
+		}
+		svcSpec.ListenAddress = vip
+		for _, sub := range svcSpec.Substitutions {
+			fmt.Fprintf(os.Stderr, "%s: annotation %s has an invalid value: %q, using the default: %s\n", key, sub.Key, sub.Value, sub.Default)
+		}
+		if err := lb.Capabilities().Check(svcSpec); err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", key, err)
+			status = 1
+			continue
+		}
+		if err := lb.AddOrUpdateService(svcSpec); err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", key, err)
+			status = 1
+			continue
+		}
+		rendered = append(rendered, svcSpec.ConfigName)
+	}
+
+	if *cfg.outputDir == "" {
+		for _, name := range rendered {
+			filename := path.Join("conf.d", name+".stream.conf")
+			content, err := ioutil.ReadFile(path.Join(outputDir, filename))
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "%v\n", err)
+				status = 1
+				continue
+			}
+			fmt.Printf("# %s\n%s\n", filename, content)
+		}
+	}
+
+	if *validate {
+		if err := validateRendered(outputDir); err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			status = 1
+		}
+	}
+	return status
+}
+
+// loadManifest adds each Service, Endpoints and Node in the file to the
+// controller's stores
+func (lbex *lbExController) loadManifest(filename string) error {
+	f, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	decoder := yaml.NewYAMLOrJSONDecoder(f, 4096)
+	for {
+		var raw json.RawMessage
+		if err := decoder.Decode(&raw); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return fmt.Errorf("%s: %v", filename, err)
+		}
+		if len(raw) == 0 || string(raw) == "null" {
+			continue
+		}
+		if err := lbex.loadObject(raw, ""); err != nil {
+			return fmt.Errorf("%s: %v", filename, err)
+		}
+	}
+}
+
+// loadObject adds the object, or each object of a list, to its' store.  The
+// kind of list items without a kind of their own is given by itemKind.
+func (lbex *lbExController) loadObject(raw json.RawMessage, itemKind string) error {
+	var obj manifestObject
+	if err := json.Unmarshal(raw, &obj); err != nil {
+		return err
+	}
+	kind := obj.Kind
+	if kind == "" {
+		kind = itemKind
+	}
+
+	if kind == "List" || strings.HasSuffix(kind, "List") {
+		for _, item := range obj.Items {
+			if err := lbex.loadObject(item, renderKinds[kind]); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	var store cache.Store
+	var object interface{}
+	switch renderKinds[kind] {
+	case "Service":
+		store, object = lbex.servicesStore, &v1.Service{}
+	case "Endpoints":
+		store, object = lbex.endpointStore, &v1.Endpoints{}
+	case "Node":
+		store, object = lbex.nodesStore, &v1.Node{}
+	default:
+		// other kinds of object in a dump are ignored
+		return nil
+	}
+	if err := json.Unmarshal(raw, object); err != nil {
+		return fmt.Errorf("invalid %s: %v", kind, err)
+	}
+	return store.Add(object)
+}
+
+// validateRendered checks the rendered stream configuration with `nginx -t`,
+// using a minimal main configuration that includes it
+func validateRendered(outputDir string) error {
+	if _, err := exec.LookPath("nginx"); err != nil {
+		fmt.Fprintf(os.Stderr, "validation skipped, nginx is not installed: %v\n", err)
+		return nil
+	}
+
+	tmpDir, err := ioutil.TempDir("", "lbex-validate")
+	if err != nil {
+		return fmt.Errorf("failed to create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+	// nginx opens <prefix>/logs/error.log before reading the configuration
+	os.MkdirAll(path.Join(tmpDir, "logs"), 0755)
+
+	mainConf := path.Join(tmpDir, "nginx.conf")
+	content := fmt.Sprintf("error_log stderr;\npid %s;\nevents {}\nstream {\n    include %s;\n}\n",
+		path.Join(tmpDir, "nginx.pid"), path.Join(outputDir, "conf.d", "*.stream.conf"))
+	if err := ioutil.WriteFile(mainConf, []byte(content), 0644); err != nil {
+		return fmt.Errorf("failed to write %s: %v", mainConf, err)
+	}
+
+	out, err := exec.Command("nginx", "-t", "-p", tmpDir, "-c", mainConf).CombinedOutput()
+	os.Stderr.Write(out)
+	if err != nil {
+		return fmt.Errorf("nginx rejected the configuration: %v", err)
+	}
+	return nil
+}
@@ -37,7 +37,7 @@ func newServicesListWatchControllerForClientset(lbex *lbExController) *lwControl
 		UpdateFunc: serviceUpdatedFunc(lbex),
 	}
 
-	lbex.servicesStore, lwc.controller = cache.NewInformer(listWatch, &v1.Service{}, resyncPeriod, eventHandler)
+	lbex.servicesStore, lwc.controller = cache.NewInformer(listWatch, &v1.Service{}, resyncPeriod, recordInformerSyncs("services", eventHandler))
 
 	return lwc
 }
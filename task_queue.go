@@ -2,6 +2,7 @@ package main
 
 import (
 	"fmt"
+	"sync"
 	"time"
 
 	"k8s.io/client-go/pkg/util/wait"
@@ -18,14 +19,30 @@ var (
 // TaskQueue manages a work queue through an independent worker that
 // invokes the given sync function for every work item inserted.
 type TaskQueue struct {
-	// queue is the work queue the worker polls
-	queue *workqueue.Type
+	// name identifies the queue's metrics
+	name string
+	// queue is the work queue the worker polls, failed items are requeued
+	// with per item exponential backoff
+	queue workqueue.RateLimitingInterface
 	// sync is called for each item in the queue
 	sync func(interface{}) error
 	// workerDone is closed when the worker exits
 	workerDone chan struct{}
 	// keyFn function (default if one is not supplied to New)
 	keyFn func(obj interface{}) (interface{}, error)
+
+	// the queue's contents, as far as they are visible to the TaskQueue:
+	// workqueue doesn't expose the items it holds
+	contents     QueueContents
+	contentsLock sync.Mutex
+}
+
+// QueueContents - the keys waiting in a TaskQueue, the key being processed,
+// and the keys waiting to be retried after a failure, with their retry count
+type QueueContents struct {
+	Queued     []string
+	Processing string
+	Retrying   map[string]int
 }
 
 // Run ...
@@ -47,13 +64,15 @@ func (t *TaskQueue) Enqueue(obj interface{}) {
 	}
 
 	glog.V(5).Infof("queuing: %s, for object: %v", key, obj)
+	t.queued(key)
 	t.queue.Add(key)
 }
 
-// Requeue - enqueues ns/name of the given api object in the task queue.
+// Requeue - enqueues ns/name of the given api object in the task queue,
+// after the item's backoff delay has elapsed.
 func (t *TaskQueue) Requeue(key string, err error) {
-	glog.Warningf("requeuing %v, err %v", key, err)
-	t.queue.Add(key)
+	glog.Warningf("requeuing %v (retry: %d), err %v", key, t.queue.NumRequeues(key), err)
+	t.queue.AddRateLimited(key)
 }
 
 // worker processes work in the queue through sync.
@@ -71,11 +90,67 @@ func (t *TaskQueue) worker() {
 		}
 
 		glog.V(4).Infof("syncing: %s", keyValue)
+		t.processing(keyValue)
 		if err := t.sync(keyValue); err != nil {
 			t.Requeue(keyValue, err)
+			t.processed(keyValue, t.queue.NumRequeues(key))
+		} else {
+			t.queue.Forget(key)
+			t.processed(keyValue, 0)
 		}
 		t.queue.Done(key)
+		queueLastProcessed.With(t.name).Set(float64(time.Now().Unix()))
+	}
+}
+
+func (t *TaskQueue) queued(key string) {
+	t.contentsLock.Lock()
+	defer t.contentsLock.Unlock()
+	for _, queued := range t.contents.Queued {
+		if queued == key {
+			return
+		}
+	}
+	t.contents.Queued = append(t.contents.Queued, key)
+}
+
+func (t *TaskQueue) processing(key string) {
+	t.contentsLock.Lock()
+	defer t.contentsLock.Unlock()
+	for i, queued := range t.contents.Queued {
+		if queued == key {
+			t.contents.Queued = append(t.contents.Queued[:i], t.contents.Queued[i+1:]...)
+			break
+		}
+	}
+	t.contents.Processing = key
+}
+
+// processed records the number of retries of key, zero if it succeeded
+func (t *TaskQueue) processed(key string, retries int) {
+	t.contentsLock.Lock()
+	defer t.contentsLock.Unlock()
+	t.contents.Processing = ""
+	if retries > 0 {
+		t.contents.Retrying[key] = retries
+	} else {
+		delete(t.contents.Retrying, key)
+	}
+}
+
+// Contents returns a copy of the queue's contents
+func (t *TaskQueue) Contents() QueueContents {
+	t.contentsLock.Lock()
+	defer t.contentsLock.Unlock()
+	contents := QueueContents{
+		Queued:     append([]string{}, t.contents.Queued...),
+		Processing: t.contents.Processing,
+		Retrying:   make(map[string]int, len(t.contents.Retrying)),
+	}
+	for key, retries := range t.contents.Retrying {
+		contents.Retrying[key] = retries
 	}
+	return contents
 }
 
 // IsShuttingDown returns if the method Shutdown was invoked
@@ -99,21 +174,23 @@ func (t *TaskQueue) defaultKeyFunc(obj interface{}) (interface{}, error) {
 	return key, nil
 }
 
-// NewTaskQueue creates a new task queue with the given sync function.
+// NewTaskQueue creates a new task queue with the given name and sync function.
 // The sync function is called for every element inserted into the queue.
-func NewTaskQueue(syncFn func(interface{}) error) *TaskQueue {
-	return NewTaskQueueKeyFn(syncFn, nil)
+func NewTaskQueue(name string, syncFn func(interface{}) error) *TaskQueue {
+	return NewTaskQueueKeyFn(name, syncFn, nil)
 }
 
-// NewTaskQueueKeyFn creates a new task queue with the given sync function and
-// API Object Key generator function.
+// NewTaskQueueKeyFn creates a new task queue with the given name, sync
+// function and API Object Key generator function.
 // The user's sync function is called for every element inserted into the queue.
-func NewTaskQueueKeyFn(syncFn func(interface{}) error, keyFn func(interface{}) (interface{}, error)) *TaskQueue {
+func NewTaskQueueKeyFn(name string, syncFn func(interface{}) error, keyFn func(interface{}) (interface{}, error)) *TaskQueue {
 	taskQueue := &TaskQueue{
-		queue:      workqueue.New(),
+		name:       name,
+		queue:      workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), name),
 		sync:       syncFn,
 		workerDone: make(chan struct{}),
 		keyFn:      keyFn,
+		contents:   QueueContents{Queued: []string{}, Retrying: make(map[string]int)},
 	}
 
 	if taskQueue.keyFn == nil {
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/sostheim/lbex/bgp"
+	"github.com/sostheim/lbex/election"
+	"github.com/sostheim/lbex/ipam"
+	"github.com/sostheim/lbex/l2"
+
+	"k8s.io/client-go/kubernetes"
+	v1 "k8s.io/client-go/pkg/api/v1"
+	"k8s.io/client-go/pkg/util/wait"
+)
+
+const (
+	// l2LeaseDuration - how long the L2 lease is held without being renewed,
+	// the longest time that the addresses are not announced on a failover
+	l2LeaseDuration = 15 * time.Second
+	// l2RetryPeriod - how often the L2 lease is renewed, or acquired
+	l2RetryPeriod = 2 * time.Second
+	// bgpHealthInterval - how often the data plane's health is checked, to
+	// decide whether or not the addresses are advertised to the BGP peers
+	bgpHealthInterval = 5 * time.Second
+)
+
+// newVIPAllocator creates the allocator of load balancer addresses from the
+// --vip-range pools, or returns nil when no pools are configured.  Without a
+// clientset, or for a dry run, allocations are not persisted.
+func newVIPAllocator(cfg *config, clientset *kubernetes.Clientset) (*ipam.Allocator, error) {
+	if len(*cfg.vipRanges) == 0 {
+		return nil, nil
+	}
+	pools, err := ipam.ParsePools(*cfg.vipRanges)
+	if err != nil {
+		return nil, err
+	}
+	if clientset == nil {
+		return ipam.NewAllocator(pools, ipam.NewMemoryStore(nil)), nil
+	}
+
+	parts := strings.Split(*cfg.vipConfigMap, "/")
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return nil, fmt.Errorf("invalid --vip-configmap %q, must be namespace/name", *cfg.vipConfigMap)
+	}
+	var store ipam.Store = ipam.NewConfigMapStore(clientset.Core(), parts[0], parts[1])
+	if *cfg.dryRun {
+		// a dry run starts from the persisted allocations, but makes no changes
+		allocations, _, err := store.Load()
+		if err != nil {
+			return nil, fmt.Errorf("failed to load address allocations: %v", err)
+		}
+		store = ipam.NewMemoryStore(allocations)
+	}
+	return ipam.NewAllocator(pools, store), nil
+}
+
+// enableL2 creates the announcer of the allocated addresses on
+// --l2-interface, and the elector that activates it on just one of the LBEX
+// instances that share the lease
+func (lbex *lbExController) enableL2() error {
+	if *lbex.cfg.l2Interface == "" {
+		return nil
+	}
+	if lbex.vips == nil {
+		return fmt.Errorf("--l2-interface requires --vip-range")
+	}
+	if *lbex.cfg.dryRun {
+		glog.Infof("dry run, L2 announcements on %s are disabled", *lbex.cfg.l2Interface)
+		return nil
+	}
+
+	lease := *lbex.cfg.l2Lease
+	if lease == "" {
+		pool := *lbex.cfg.servicePool
+		if pool == "" {
+			pool = "default"
+		}
+		lease = "kube-system/lbex-l2-" + pool
+	}
+	parts := strings.Split(lease, "/")
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return fmt.Errorf("invalid --l2-lease %q, must be namespace/name", lease)
+	}
+
+	announcer, err := l2.NewAnnouncer(*lbex.cfg.l2Interface)
+	if err != nil {
+		return err
+	}
+	identity, err := os.Hostname()
+	if err != nil {
+		return fmt.Errorf("failed to get the hostname for the L2 lease identity: %v", err)
+	}
+	lbex.announcer = announcer
+	lbex.elector = election.NewElector(lbex.clientset.Core(), parts[0], parts[1], identity,
+		l2LeaseDuration, l2RetryPeriod, election.Callbacks{
+			OnStartedLeading: announcer.Activate,
+			OnStoppedLeading: announcer.Deactivate,
+		})
+	glog.V(2).Infof("L2 announcements on %s, for the holder of lease %s", *lbex.cfg.l2Interface, lease)
+	return nil
+}
+
+// enableBGP creates the speaker that advertises the allocated addresses to
+// the BGP peers of their' pools, as configured by --bgp-config
+func (lbex *lbExController) enableBGP() error {
+	if *lbex.cfg.bgpConfig == "" {
+		return nil
+	}
+	if lbex.vips == nil {
+		return fmt.Errorf("--bgp-config requires --vip-range")
+	}
+	cfg, err := bgp.LoadConfig(*lbex.cfg.bgpConfig)
+	if err != nil {
+		return err
+	}
+	if *lbex.cfg.dryRun {
+		glog.Infof("dry run, BGP advertisements are disabled")
+		return nil
+	}
+	pools := lbex.vips.Pools()
+	for pool := range cfg.Pools {
+		if _, ok := pools[pool]; !ok {
+			glog.Warningf("BGP peers of pool %q, which has no --vip-range", pool)
+		}
+	}
+	lbex.speaker = bgp.NewSpeaker(cfg)
+	glog.V(2).Infof("BGP configuration: %v", cfg)
+	return nil
+}
+
+// advertiseWhileHealthy advertises the addresses to the BGP peers while the
+// data plane is healthy, and withdraws them when it is not, until stopCh is
+// closed
+func (lbex *lbExController) advertiseWhileHealthy() {
+	wait.Until(func() {
+		lbex.speaker.SetEnabled(lbex.lb.Healthy() == nil)
+	}, bgpHealthInterval, lbex.stopCh)
+}
+
+// assignVIP returns the load balancer address of a LoadBalancer service that
+// this LBEX instance selects, allocating one from the service's pool, and
+// publishes it in the service's status.  The address of any other service is
+// released.  It returns "" when no address pools are configured.
+func (lbex *lbExController) assignVIP(key string, service *v1.Service) (string, error) {
+	if lbex.vips == nil {
+		return "", nil
+	}
+	selection := lbex.selectService(service)
+	if !selection.Selected || service.Spec.Type != v1.ServiceTypeLoadBalancer {
+		lbex.releaseVIP(key, service)
+		return "", nil
+	}
+
+	vip, err := lbex.vips.Allocate(key, selection.Pool, service.Spec.LoadBalancerIP)
+	if err != nil {
+		return "", err
+	}
+	if lbex.announcer != nil {
+		lbex.announcer.Announce(key, vip)
+	}
+	if lbex.speaker != nil {
+		lbex.speaker.Advertise(key, vip, selection.Pool)
+	}
+	lbex.publishVIP(service, vip)
+	return vip, nil
+}
+
+// releaseVIP releases the service's address, if it has one from this
+// instance's pools, and removes it from the status of the service, if it
+// still exists.  The store may be shared with LBEX instances that select
+// other services from other pools, whose addresses are left alone.
+func (lbex *lbExController) releaseVIP(key string, service *v1.Service) {
+	if lbex.vips == nil {
+		return
+	}
+	if lbex.announcer != nil {
+		lbex.announcer.Withdraw(key)
+	}
+	if lbex.speaker != nil {
+		lbex.speaker.Withdraw(key)
+	}
+	vip, allocated := lbex.vips.Lookup(key)
+	if !allocated {
+		return
+	}
+	if _, ours := lbex.vips.PoolOf(vip); !ours {
+		return
+	}
+	if err := lbex.vips.Release(key); err != nil {
+		glog.Errorf("service %s: %v", key, err)
+		return
+	}
+	if service != nil {
+		lbex.publishVIP(service, "")
+	}
+}
+
+// publishVIP sets the service's status load balancer ingress to the address,
+// or clears it when vip is empty, unless it is already set
+func (lbex *lbExController) publishVIP(service *v1.Service, vip string) {
+	ingress := []v1.LoadBalancerIngress{}
+	if vip != "" {
+		ingress = append(ingress, v1.LoadBalancerIngress{IP: vip})
+	}
+	current := service.Status.LoadBalancer.Ingress
+	if len(current) == len(ingress) && (len(ingress) == 0 || current[0].IP == vip) {
+		return
+	}
+	if lbex.clientset == nil {
+		return
+	}
+	if *lbex.cfg.dryRun {
+		glog.V(2).Infof("dry run, service %s/%s status load balancer address: %q", service.Namespace, service.Name, vip)
+		return
+	}
+
+	// the store's copy of the service must not be modified
+	updated := *service
+	updated.Status.LoadBalancer = v1.LoadBalancerStatus{Ingress: ingress}
+	if _, err := lbex.clientset.Core().Services(service.Namespace).UpdateStatus(&updated); err != nil {
+		glog.Errorf("service %s/%s: failed to update the load balancer status: %v", service.Namespace, service.Name, err)
+		return
+	}
+	glog.V(2).Infof("service %s/%s: published load balancer address: %q", service.Namespace, service.Name, vip)
+}
+
+// releaseStaleVIPs releases the addresses of services that were deleted while
+// LBEX was not running, once the services informer has synced
+func (lbex *lbExController) releaseStaleVIPs() {
+	if lbex.vips == nil {
+		return
+	}
+	wait.PollUntil(time.Second, func() (bool, error) {
+		return lbex.servicesLWC.controller.HasSynced(), nil
+	}, lbex.stopCh)
+
+	allocations, err := lbex.vips.Allocations()
+	if err != nil {
+		glog.Errorf("releaseStaleVIPs: %v", err)
+		return
+	}
+	for key := range allocations {
+		if _, exists, err := lbex.servicesStore.GetByKey(key); err == nil && !exists {
+			glog.V(2).Infof("releaseStaleVIPs: service %s no longer exists", key)
+			lbex.releaseVIP(key, nil)
+		}
+	}
+}